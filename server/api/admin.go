@@ -0,0 +1,251 @@
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// itemOverhead is the approximate number of bytes used by the cache to store
+// each item, in addition to the item itself.
+const itemOverhead = 96
+
+// Snapshotter writes a snapshot of the cache.
+type Snapshotter interface {
+	Snapshot() error
+}
+
+// SessionEnder ends sessions.
+type SessionEnder interface {
+	EndSession(uuid string) (payload.Payload, bool)
+}
+
+// Reloader reloads the configuration.
+type Reloader interface {
+	Reload() error
+}
+
+// CacheStats describes the contents of the cache.
+type CacheStats struct {
+	Items          int `json:"items"`
+	EstimatedBytes int `json:"estimated_bytes"`
+}
+
+// AdminHandler manages the cache. All requests must be authenticated with a
+// bearer token, and every action is logged as an audit event.
+type AdminHandler struct {
+	prefix      string
+	token       string
+	cache       *cacher.Cacher
+	sessions    SessionEnder
+	snapshotter Snapshotter
+	reloader    Reloader
+	logger      log.Logger
+}
+
+// NewAdminHandler creates a new AdminHandler, serving requests below prefix.
+// Sessions are expired by sessions, e.g. the payload.Handler writing to the
+// cache. If snapshotter or reloader are nil, snapshots or reloads cannot be
+// triggered.
+func NewAdminHandler(prefix string, token string, cache *cacher.Cacher, sessions SessionEnder, snapshotter Snapshotter, reloader Reloader, logger log.Logger) *AdminHandler {
+	return &AdminHandler{
+		prefix:      strings.TrimSuffix(prefix, "/"),
+		token:       token,
+		cache:       cache,
+		sessions:    sessions,
+		snapshotter: snapshotter,
+		reloader:    reloader,
+		logger:      logger,
+	}
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, h.prefix), "/")
+
+	if !h.authorized(r) {
+		h.audit(r, path, http.StatusUnauthorized)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"), h.logger)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "cache":
+		h.serveStats(w, r)
+	case path == "cache/flush":
+		h.serveFlush(w, r)
+	case path == "snapshot":
+		h.serveSnapshot(w, r)
+	case path == "reload":
+		h.serveReload(w, r)
+	case len(parts) == 3 && parts[0] == "sessions" && parts[2] == "expire":
+		h.serveExpire(w, r, parts[1])
+	default:
+		h.audit(r, path, http.StatusNotFound)
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path '%s'", r.URL.Path), h.logger)
+	}
+}
+
+func (h *AdminHandler) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+// audit logs an admin action.
+func (h *AdminHandler) audit(r *http.Request, action string, status int, keyvals ...interface{}) {
+	l := level.Info(h.logger)
+	if status >= http.StatusBadRequest {
+		l = level.Warn(h.logger)
+	}
+
+	labels := []interface{}{
+		"msg", "Audit event",
+		"action", action,
+		"method", r.Method,
+		"remote_addr", r.RemoteAddr,
+		"status", status,
+	}
+	_ = l.Log(append(labels, keyvals...)...)
+}
+
+// allowMethod audits the action, writes an error and returns false if the
+// request does not use method.
+func (h *AdminHandler) allowMethod(w http.ResponseWriter, r *http.Request, action string, method string) bool {
+	if r.Method == method {
+		return true
+	}
+
+	h.audit(r, action, http.StatusMethodNotAllowed)
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method), h.logger)
+	return false
+}
+
+func (h *AdminHandler) serveStats(w http.ResponseWriter, r *http.Request) {
+	if !h.allowMethod(w, r, "stats", http.MethodGet) {
+		return
+	}
+
+	stats := CacheStats{}
+	for _, c := range h.cache.Items() {
+		stats.Items++
+		stats.EstimatedBytes += itemOverhead + c.Object.(payload.Payload).Size()
+	}
+
+	h.audit(r, "stats", http.StatusOK, "items", stats.Items)
+	writeJSON(w, stats, h.logger)
+}
+
+func (h *AdminHandler) serveFlush(w http.ResponseWriter, r *http.Request) {
+	if !h.allowMethod(w, r, "flush", http.MethodPost) {
+		return
+	}
+
+	f, err := parseFilter(r)
+	if err != nil {
+		h.audit(r, "flush", http.StatusBadRequest, "err", err)
+		writeError(w, http.StatusBadRequest, err, h.logger)
+		return
+	}
+
+	flushed := 0
+	if f == (filter{}) {
+		flushed = h.cache.ItemCount()
+		h.cache.Flush()
+	} else {
+		for k, c := range h.cache.Items() {
+			if f.matches(c.Object.(payload.Payload)) {
+				h.cache.Delete(k)
+				flushed++
+			}
+		}
+	}
+
+	h.audit(r, "flush", http.StatusOK,
+		"host", f.host,
+		"dashboard", f.dashboard,
+		"user", f.user,
+		"state", f.state,
+		"flushed", flushed,
+	)
+	writeJSON(w, struct {
+		Flushed int `json:"flushed"`
+	}{flushed}, h.logger)
+}
+
+func (h *AdminHandler) serveExpire(w http.ResponseWriter, r *http.Request, uuid string) {
+	if !h.allowMethod(w, r, "expire", http.MethodPost) {
+		return
+	}
+
+	p, exists := h.sessions.EndSession(uuid)
+	if !exists {
+		h.audit(r, "expire", http.StatusNotFound, "uuid", uuid)
+		writeError(w, http.StatusNotFound, fmt.Errorf("session '%s' was not found", uuid), h.logger)
+		return
+	}
+
+	h.audit(r, "expire", http.StatusOK, "uuid", uuid)
+	writeJSON(w, struct {
+		UUID    string    `json:"uuid"`
+		EndTime time.Time `json:"end_time"`
+	}{p.UUID, p.LastSeen()}, h.logger)
+}
+
+func (h *AdminHandler) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !h.allowMethod(w, r, "snapshot", http.MethodPost) {
+		return
+	}
+
+	if h.snapshotter == nil {
+		h.audit(r, "snapshot", http.StatusNotImplemented)
+		writeError(w, http.StatusNotImplemented, errors.New("snapshots are not configured"), h.logger)
+		return
+	}
+
+	err := h.snapshotter.Snapshot()
+	if err != nil {
+		h.audit(r, "snapshot", http.StatusInternalServerError, "err", err)
+		writeError(w, http.StatusInternalServerError, err, h.logger)
+		return
+	}
+
+	h.audit(r, "snapshot", http.StatusOK)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AdminHandler) serveReload(w http.ResponseWriter, r *http.Request) {
+	if !h.allowMethod(w, r, "reload", http.MethodPost) {
+		return
+	}
+
+	if h.reloader == nil {
+		h.audit(r, "reload", http.StatusNotImplemented)
+		writeError(w, http.StatusNotImplemented, errors.New("reloading is not configured"), h.logger)
+		return
+	}
+
+	err := h.reloader.Reload()
+	if err != nil {
+		h.audit(r, "reload", http.StatusInternalServerError, "err", err)
+		writeError(w, http.StatusInternalServerError, err, h.logger)
+		return
+	}
+
+	h.audit(r, "reload", http.StatusOK)
+	w.WriteHeader(http.StatusNoContent)
+}
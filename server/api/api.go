@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// DefaultLimit is the page size used when no limit is requested.
+	DefaultLimit = 100
+	// MaxLimit is the largest page size that may be requested.
+	MaxLimit = 1000
+)
+
+// page is a requested slice of a sorted result.
+type page struct {
+	limit  int
+	offset int
+}
+
+// parsePage reads the limit and offset query parameters.
+func parsePage(r *http.Request) (page, error) {
+	pg := page{limit: DefaultLimit}
+
+	q := r.URL.Query()
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > MaxLimit {
+			return pg, fmt.Errorf("limit must be between 1 and %d", MaxLimit)
+		}
+		pg.limit = limit
+	}
+	if v := q.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return pg, fmt.Errorf("offset must be a positive integer")
+		}
+		pg.offset = offset
+	}
+
+	return pg, nil
+}
+
+// bounds returns the start and end indexes of the page in a result of n items.
+func (pg page) bounds(n int) (int, int) {
+	start := pg.offset
+	if start > n {
+		start = n
+	}
+	end := start + pg.limit
+	if end > n {
+		end = n
+	}
+
+	return start, end
+}
+
+// parseWindow reads the window query parameter. A zero window is unbounded.
+func parseWindow(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("window")
+	if v == "" {
+		return 0, nil
+	}
+
+	window, err := time.ParseDuration(v)
+	if err != nil || window < 0 {
+		return 0, fmt.Errorf("window must be a positive duration")
+	}
+
+	return window, nil
+}
+
+// parseOrder reads the order query parameter, returning true for descending.
+func parseOrder(r *http.Request) (bool, error) {
+	switch r.URL.Query().Get("order") {
+	case "", "desc":
+		return true, nil
+	case "asc":
+		return false, nil
+	}
+
+	return false, fmt.Errorf("order must be one of: [asc, desc]")
+}
+
+// writeJSON writes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, v interface{}, logger log.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to write response", "err", err)
+	}
+}
+
+// writeError writes an error as the JSON response body.
+func writeError(w http.ResponseWriter, code int, err error, logger log.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	writeJSON(w, struct {
+		Error string `json:"error"`
+	}{err.Error()}, logger)
+}
@@ -0,0 +1,444 @@
+package api_test
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/api"
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/MacroPower/macropower-analytics-panel/server/store"
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	payloadURL    = "/write"
+	dashboardsURL = "/api/v1/dashboards"
+	sessionsURL   = "/api/v1/sessions"
+	adminURL      = "/api/v1/admin"
+	exportURL     = "/api/v1/export"
+	adminToken    = "secret"
+	logger        = log.NewNopLogger()
+)
+
+func newTestServer(cache *cacher.Cacher) *httptest.Server {
+	mux := http.NewServeMux()
+	handler := payload.NewHandler(cache, 10, nil, nil, logger)
+	mux.Handle(payloadURL, handler)
+	mux.Handle(dashboardsURL, api.NewDashboardHandler(cache, time.Duration(0), logger))
+	sessionHandler := api.NewSessionHandler(sessionsURL, cache, time.Duration(0), logger)
+	mux.Handle(sessionsURL, sessionHandler)
+	mux.Handle(sessionsURL+"/", sessionHandler)
+	mux.Handle(adminURL+"/", api.NewAdminHandler(adminURL, adminToken, cache, handler, nil, nil, logger))
+	mux.Handle(exportURL, api.NewExportHandler(func() api.SessionStore { return nil }, time.Duration(0), logger))
+
+	return httptest.NewServer(mux)
+}
+
+func getJSON(t *testing.T, url string, v interface{}) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func doAdmin(t *testing.T, method string, url string, token string, v interface{}) int {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK && v != nil {
+		err = json.NewDecoder(resp.Body).Decode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func sendSession(t *testing.T, url string, uuid string, uid string, login string, start int, end int, focus bool) {
+	request := payloadtest.GetPayload(t)
+	request.UUID = uuid
+	request.Type = "start"
+	request.Dashboard.UID = uid
+	request.User.Login = login
+	request.Time = start
+	payloadtest.SendPayload(t, url, request)
+
+	request.Type = "end"
+	request.Time = end
+	request.HasFocus = focus
+	payloadtest.SendPayload(t, url, request)
+}
+
+func TestDashboards(t *testing.T) {
+	cache := cacher.NewCache()
+	testserver := newTestServer(cache)
+	defer testserver.Close()
+
+	now := int(time.Now().Unix())
+	sendSession(t, testserver.URL+payloadURL, "test1", "popular", "a", now-600, now-300, true)
+	sendSession(t, testserver.URL+payloadURL, "test2", "popular", "b", now-600, now-500, false)
+	sendSession(t, testserver.URL+payloadURL, "test3", "popular", "b", now-300, now-200, true)
+	sendSession(t, testserver.URL+payloadURL, "test4", "unused", "a", now-7200, now-7000, true)
+	time.Sleep(100 * time.Millisecond)
+
+	var list api.DashboardList
+	code := getJSON(t, testserver.URL+dashboardsURL+"?sort=sessions", &list)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status '%d', got '%d'", http.StatusOK, code)
+	}
+	if list.Total != 2 || len(list.Dashboards) != 2 {
+		t.Fatalf("Expected '%d' dashboards, got '%d'", 2, list.Total)
+	}
+
+	d := list.Dashboards[0]
+	if d.UID != "popular" || d.Sessions != 3 || d.UniqueUsers != 2 {
+		t.Errorf("Unexpected dashboard: %+v", d)
+	}
+	if d.DurationSeconds != 500 || d.FocusedDurationSeconds != 400 {
+		t.Errorf("Unexpected durations: %+v", d)
+	}
+	if !d.LastViewed.Equal(time.Unix(int64(now-200), 0)) {
+		t.Errorf("Unexpected last viewed time: %s", d.LastViewed)
+	}
+
+	code = getJSON(t, testserver.URL+dashboardsURL+"?window=1h", &list)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status '%d', got '%d'", http.StatusOK, code)
+	}
+	if list.Total != 1 || list.Dashboards[0].UID != "popular" {
+		t.Errorf("Expected only the popular dashboard within the window, got %+v", list.Dashboards)
+	}
+
+	code = getJSON(t, testserver.URL+dashboardsURL+"?sort=last_viewed&order=asc&limit=1&offset=1", &list)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status '%d', got '%d'", http.StatusOK, code)
+	}
+	if list.Total != 2 || len(list.Dashboards) != 1 || list.Dashboards[0].UID != "popular" {
+		t.Errorf("Expected the second page to contain the popular dashboard, got %+v", list.Dashboards)
+	}
+
+	code = getJSON(t, testserver.URL+dashboardsURL+"?sort=unknown", &list)
+	if code != http.StatusBadRequest {
+		t.Errorf("Expected status '%d', got '%d'", http.StatusBadRequest, code)
+	}
+
+	// Anonymous users are not counted.
+	request := payloadtest.GetPayload(t)
+	request.Dashboard.UID = "anonymous"
+	request.User.ID = 0
+	request.User.Login = ""
+	request.Type = "start"
+	request.Time = now - 60
+	for _, uuid := range []string{"test5", "test6"} {
+		request.UUID = uuid
+		payloadtest.SendPayload(t, testserver.URL+payloadURL, request)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	code = getJSON(t, testserver.URL+dashboardsURL+"?sort=last_viewed&limit=1", &list)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status '%d', got '%d'", http.StatusOK, code)
+	}
+	if d := list.Dashboards[0]; d.UID != "anonymous" || d.Sessions != 2 || d.UniqueUsers != 0 {
+		t.Errorf("Expected no unique users of the anonymous dashboard, got %+v", d)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	cache := cacher.NewCache()
+	testserver := newTestServer(cache)
+	defer testserver.Close()
+
+	sendSession(t, testserver.URL+payloadURL, "test1", "dashboard1", "a", 1600000000, 1600000300, true)
+
+	request := payloadtest.GetPayload(t)
+	request.UUID = "test2"
+	request.Type = "start"
+	request.Dashboard.UID = "dashboard2"
+	request.User.Login = "b"
+	request.Time = 1600000000
+	payloadtest.SendPayload(t, testserver.URL+payloadURL, request)
+
+	request.Type = "heartbeat"
+	request.Time = 1600000060
+	request.HasFocus = false
+	payloadtest.SendPayload(t, testserver.URL+payloadURL, request)
+	time.Sleep(100 * time.Millisecond)
+
+	var list api.SessionList
+	code := getJSON(t, testserver.URL+sessionsURL, &list)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status '%d', got '%d'", http.StatusOK, code)
+	}
+	if list.Total != 2 {
+		t.Fatalf("Expected '%d' sessions, got '%d'", 2, list.Total)
+	}
+
+	code = getJSON(t, testserver.URL+sessionsURL+"?state=active&user=b", &list)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status '%d', got '%d'", http.StatusOK, code)
+	}
+	if list.Total != 1 || list.Sessions[0].UUID != "test2" {
+		t.Fatalf("Expected only the active session, got %+v", list.Sessions)
+	}
+
+	s := list.Sessions[0]
+	if !s.Active || s.DurationSeconds != 60 || s.FocusedDurationSeconds != 0 {
+		t.Errorf("Unexpected session: %+v", s)
+	}
+	if len(s.Timeline) != 2 || s.Timeline[1].Type != "heartbeat" || s.Timeline[1].HasFocus {
+		t.Errorf("Unexpected timeline: %+v", s.Timeline)
+	}
+	if s.Interactions != 0 || len(s.Views) != 1 || s.Views[0].RawFrom != request.TimeRange.Raw.From {
+		t.Errorf("Unexpected views: %+v", s.Views)
+	}
+
+	code = getJSON(t, testserver.URL+sessionsURL+"?dashboard=dashboard1&state=active", &list)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status '%d', got '%d'", http.StatusOK, code)
+	}
+	if list.Total != 0 {
+		t.Errorf("Expected no sessions, got %+v", list.Sessions)
+	}
+
+	var session api.Session
+	code = getJSON(t, testserver.URL+sessionsURL+"/test1", &session)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status '%d', got '%d'", http.StatusOK, code)
+	}
+	if session.Active || session.DurationSeconds != 300 || session.Payload == nil {
+		t.Errorf("Unexpected session: %+v", session)
+	}
+
+	code = getJSON(t, testserver.URL+sessionsURL+"/unknown", &session)
+	if code != http.StatusNotFound {
+		t.Errorf("Expected status '%d', got '%d'", http.StatusNotFound, code)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	cache := cacher.NewCache()
+	testserver := newTestServer(cache)
+	defer testserver.Close()
+
+	sendSession(t, testserver.URL+payloadURL, "test1", "dashboard1", "a", 1600000000, 1600000300, true)
+	sendSession(t, testserver.URL+payloadURL, "test2", "dashboard2", "a", 1600000000, 1600000300, true)
+
+	request := payloadtest.GetPayload(t)
+	request.UUID = "test3"
+	request.Type = "start"
+	request.Time = 1600000000
+	payloadtest.SendPayload(t, testserver.URL+payloadURL, request)
+	request.Type = "heartbeat"
+	request.Time = 1600000060
+	payloadtest.SendPayload(t, testserver.URL+payloadURL, request)
+	time.Sleep(100 * time.Millisecond)
+
+	code := doAdmin(t, http.MethodGet, testserver.URL+adminURL+"/cache", "wrong", nil)
+	if code != http.StatusUnauthorized {
+		t.Errorf("Expected status '%d', got '%d'", http.StatusUnauthorized, code)
+	}
+
+	var stats api.CacheStats
+	code = doAdmin(t, http.MethodGet, testserver.URL+adminURL+"/cache", adminToken, &stats)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status '%d', got '%d'", http.StatusOK, code)
+	}
+	if stats.Items != 3 || stats.EstimatedBytes == 0 {
+		t.Errorf("Unexpected cache stats: %+v", stats)
+	}
+
+	code = doAdmin(t, http.MethodPost, testserver.URL+adminURL+"/sessions/test3/expire", adminToken, nil)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status '%d', got '%d'", http.StatusOK, code)
+	}
+	c, _ := cache.Get("test3")
+	p := c.(payload.Payload)
+	if _, _, endSet := p.IsTimeSet(); !endSet {
+		t.Error("Expected session to be ended")
+	}
+	if actual := p.GetDuration(time.Duration(0)); actual != time.Minute {
+		t.Errorf("Expected the duration '%s', got '%s'", time.Minute, actual)
+	}
+
+	code = doAdmin(t, http.MethodPost, testserver.URL+adminURL+"/sessions/unknown/expire", adminToken, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("Expected status '%d', got '%d'", http.StatusNotFound, code)
+	}
+
+	code = doAdmin(t, http.MethodPost, testserver.URL+adminURL+"/cache/flush?dashboard=dashboard1", adminToken, nil)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status '%d', got '%d'", http.StatusOK, code)
+	}
+	if _, exists := cache.Get("test1"); exists || cache.ItemCount() != 2 {
+		t.Errorf("Expected only the matching session to be flushed, got '%d' items", cache.ItemCount())
+	}
+
+	code = doAdmin(t, http.MethodPost, testserver.URL+adminURL+"/snapshot", adminToken, nil)
+	if code != http.StatusNotImplemented {
+		t.Errorf("Expected status '%d', got '%d'", http.StatusNotImplemented, code)
+	}
+
+	code = doAdmin(t, http.MethodPost, testserver.URL+adminURL+"/reload", adminToken, nil)
+	if code != http.StatusNotImplemented {
+		t.Errorf("Expected status '%d', got '%d'", http.StatusNotImplemented, code)
+	}
+
+	code = doAdmin(t, http.MethodPost, testserver.URL+adminURL+"/cache/flush", adminToken, nil)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status '%d', got '%d'", http.StatusOK, code)
+	}
+	if cache.ItemCount() != 0 {
+		t.Errorf("Expected cache to be empty, got '%d' items", cache.ItemCount())
+	}
+}
+
+func TestAdminAudit(t *testing.T) {
+	buf := &payloadtest.SafeBuffer{}
+	handler := payload.NewHandler(cacher.NewCache(), 10, nil, nil, logger)
+	defer handler.Close()
+	admin := api.NewAdminHandler(adminURL, adminToken, cacher.NewCache(), handler, nil, nil, log.NewLogfmtLogger(buf))
+	testserver := httptest.NewServer(admin)
+	defer testserver.Close()
+
+	// Rejected requests are audited.
+	for _, test := range []struct {
+		method string
+		path   string
+		status int
+		action string
+	}{
+		{http.MethodGet, "/unknown", http.StatusNotFound, "unknown"},
+		{http.MethodGet, "/cache/flush", http.StatusMethodNotAllowed, "flush"},
+		{http.MethodPost, "/cache/flush?state=unknown", http.StatusBadRequest, "flush"},
+	} {
+		code := doAdmin(t, test.method, testserver.URL+adminURL+test.path, adminToken, nil)
+		if code != test.status {
+			t.Errorf("Expected status '%d' for %s, got '%d'", test.status, test.path, code)
+		}
+		expected := fmt.Sprintf("action=%s method=%s", test.action, test.method)
+		if !strings.Contains(buf.String(), expected) || !strings.Contains(buf.String(), fmt.Sprintf("status=%d", test.status)) {
+			t.Errorf("Expected an audit event for %s, got:\n%s", test.path, buf.String())
+		}
+	}
+}
+
+// storeObserver writes every Payload to a store.
+type storeObserver struct {
+	t *testing.T
+	s *store.SQL
+}
+
+func (o storeObserver) Observe(p payload.Payload) {
+	err := o.s.Write(p)
+	if err != nil {
+		o.t.Error(err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	// Sessions cannot be exported if they are not stored.
+	unstored := newTestServer(cacher.NewCache())
+	defer unstored.Close()
+	resp, err := http.Get(unstored.URL + exportURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Expected status '%d', got '%d'", http.StatusNotImplemented, resp.StatusCode)
+	}
+
+	s, err := store.NewSQL("sqlite", filepath.Join(t.TempDir(), "analytics.db"), time.Duration(0), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	handler := payload.NewHandler(cacher.NewCache(), 10, nil, []payload.Observer{storeObserver{t, s}}, logger)
+	mux := http.NewServeMux()
+	mux.Handle(payloadURL, handler)
+	mux.Handle(exportURL, api.NewExportHandler(func() api.SessionStore { return s }, time.Duration(0), logger))
+	testserver := httptest.NewServer(mux)
+	defer testserver.Close()
+
+	sendSession(t, testserver.URL+payloadURL, "test3", "a", "b", 1600007200, 1600007300, false)
+	sendSession(t, testserver.URL+payloadURL, "test1", "a", "a", 1600000000, 1600000300, true)
+	sendSession(t, testserver.URL+payloadURL, "test2", "b", "b", 1600003600, 1600003700, true)
+	handler.Close()
+
+	for _, test := range []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{"test1", "test2", "test3"}},
+		{"?format=csv&from=1600000400", []string{"test2", "test3"}},
+		{"?from=2020-09-13T12:00:00Z&to=2020-09-13T13:30:00Z", []string{"test1", "test2"}},
+		{"?dashboard=a", []string{"test1", "test3"}},
+		{"?user=b", []string{"test2", "test3"}},
+	} {
+		resp, err := http.Get(testserver.URL + exportURL + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := csv.NewReader(resp.Body).ReadAll()
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Header.Get("Content-Type") != "text/csv; charset=utf-8" {
+			t.Errorf("Unexpected content type %s", resp.Header.Get("Content-Type"))
+		}
+		if records[0][0] != "uuid" || records[0][len(records[0])-1] != "variable_textBox" {
+			t.Errorf("Unexpected header: %v", records[0])
+		}
+		var uuids []string
+		for _, record := range records[1:] {
+			uuids = append(uuids, record[0])
+		}
+		if fmt.Sprint(uuids) != fmt.Sprint(test.expected) {
+			t.Errorf("Expected sessions %v for %q, got %v", test.expected, test.query, uuids)
+		}
+	}
+
+	for _, query := range []string{"?format=xlsx", "?from=yesterday", "?state=unknown"} {
+		resp, err := http.Get(testserver.URL + exportURL + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status '%d' for %q, got '%d'", http.StatusBadRequest, query, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/go-kit/kit/log"
+)
+
+// Dashboard is the usage of a dashboard over a window.
+type Dashboard struct {
+	Host                   string    `json:"host"`
+	UID                    string    `json:"uid"`
+	Name                   string    `json:"name"`
+	LastViewed             time.Time `json:"last_viewed"`
+	Sessions               int       `json:"sessions"`
+	DurationSeconds        float64   `json:"duration_seconds"`
+	FocusedDurationSeconds float64   `json:"focused_duration_seconds"`
+	UniqueUsers            int       `json:"unique_users"`
+
+	users map[string]struct{}
+}
+
+// DashboardList is the response of the DashboardHandler.
+type DashboardList struct {
+	Total      int         `json:"total"`
+	Dashboards []Dashboard `json:"dashboards"`
+}
+
+// dashboardSorts are the fields that dashboards can be sorted by.
+var dashboardSorts = map[string]func(a, b Dashboard) bool{
+	"last_viewed": func(a, b Dashboard) bool { return a.LastViewed.Before(b.LastViewed) },
+	"sessions":    func(a, b Dashboard) bool { return a.Sessions < b.Sessions },
+	"duration":    func(a, b Dashboard) bool { return a.DurationSeconds < b.DurationSeconds },
+	"focused_duration": func(a, b Dashboard) bool {
+		return a.FocusedDurationSeconds < b.FocusedDurationSeconds
+	},
+	"unique_users": func(a, b Dashboard) bool { return a.UniqueUsers < b.UniqueUsers },
+	"name":         func(a, b Dashboard) bool { return a.Name < b.Name },
+}
+
+// DashboardHandler lists the dashboards seen in cached sessions.
+type DashboardHandler struct {
+	cache   *cacher.Cacher
+	timeout time.Duration
+	logger  log.Logger
+}
+
+// NewDashboardHandler creates a new DashboardHandler.
+func NewDashboardHandler(cache *cacher.Cacher, timeout time.Duration, logger log.Logger) *DashboardHandler {
+	return &DashboardHandler{
+		cache:   cache,
+		timeout: timeout,
+		logger:  logger,
+	}
+}
+
+func (h *DashboardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method), h.logger)
+		return
+	}
+
+	pg, err := parsePage(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err, h.logger)
+		return
+	}
+	window, err := parseWindow(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err, h.logger)
+		return
+	}
+	desc, err := parseOrder(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err, h.logger)
+		return
+	}
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "last_viewed"
+	}
+	less, ok := dashboardSorts[sortBy]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unsupported sort '%s'", sortBy), h.logger)
+		return
+	}
+
+	dashboards := h.dashboards(time.Now(), window)
+	sort.SliceStable(dashboards, func(i, j int) bool {
+		if desc {
+			return less(dashboards[j], dashboards[i])
+		}
+		return less(dashboards[i], dashboards[j])
+	})
+
+	start, end := pg.bounds(len(dashboards))
+	writeJSON(w, DashboardList{
+		Total:      len(dashboards),
+		Dashboards: dashboards[start:end],
+	}, h.logger)
+}
+
+// dashboards aggregates all sessions seen within the window ending at now.
+func (h *DashboardHandler) dashboards(now time.Time, window time.Duration) []Dashboard {
+	type key struct {
+		host string
+		uid  string
+	}
+	byKey := make(map[key]*Dashboard)
+
+	for _, c := range h.cache.Items() {
+		p := c.Object.(payload.Payload)
+
+		lastSeen := p.LastSeen()
+		if window != 0 && lastSeen.Before(now.Add(-window)) {
+			continue
+		}
+
+		k := key{host: p.HostLabel(), uid: p.Dashboard.UID}
+		d, exists := byKey[k]
+		if !exists {
+			d = &Dashboard{
+				Host:  k.host,
+				UID:   k.uid,
+				users: make(map[string]struct{}),
+			}
+			byKey[k] = d
+		}
+		if !lastSeen.Before(d.LastViewed) {
+			d.LastViewed = lastSeen
+			d.Name = p.Dashboard.Name
+		}
+		d.Sessions++
+		d.DurationSeconds += p.GetDuration(h.timeout).Seconds()
+		d.FocusedDurationSeconds += p.GetFocusedDuration(h.timeout).Seconds()
+		// Anonymous users cannot be told apart, so they are not counted, as
+		// in unique.Counter.
+		if p.User.ID != 0 || p.User.Login != "" {
+			d.users[strconv.Itoa(p.User.ID)+":"+p.User.Login] = struct{}{}
+		}
+	}
+
+	dashboards := make([]Dashboard, 0, len(byKey))
+	for _, d := range byKey {
+		d.UniqueUsers = len(d.users)
+		dashboards = append(dashboards, *d)
+	}
+
+	// Sort by a stable key first, so that pages are consistent.
+	sort.Slice(dashboards, func(i, j int) bool {
+		if dashboards[i].Host != dashboards[j].Host {
+			return dashboards[i].Host < dashboards[j].Host
+		}
+		return dashboards[i].UID < dashboards[j].UID
+	})
+
+	return dashboards
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/export"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/store"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// SessionStore reads stored sessions.
+type SessionStore interface {
+	// VariableNames returns the sorted names of the variables of the sessions
+	// selected by the Query.
+	VariableNames(q store.Query) ([]string, error)
+	// Sessions calls fn with each session selected by the Query, ordered by
+	// start time.
+	Sessions(q store.Query, fn func(p payload.Payload) error) error
+}
+
+// ExportHandler streams the stored sessions as CSV, NDJSON or Parquet.
+type ExportHandler struct {
+	sessions func() SessionStore
+	timeout  time.Duration
+	logger   log.Logger
+}
+
+// NewExportHandler creates a new ExportHandler, which exports the sessions of
+// the SessionStore returned by sessions. If it returns nil, sessions cannot be
+// exported.
+func NewExportHandler(sessions func() SessionStore, timeout time.Duration, logger log.Logger) *ExportHandler {
+	return &ExportHandler{
+		sessions: sessions,
+		timeout:  timeout,
+		logger:   logger,
+	}
+}
+
+func (h *ExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method), h.logger)
+		return
+	}
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if !contains(export.Formats, format) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("format must be one of: %v", export.Formats), h.logger)
+		return
+	}
+	from, err := parseTime(q.Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("from: %w", err), h.logger)
+		return
+	}
+	to, err := parseTime(q.Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("to: %w", err), h.logger)
+		return
+	}
+	f, err := parseFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err, h.logger)
+		return
+	}
+
+	sessions := h.sessions()
+	if sessions == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("sessions are not stored"), h.logger)
+		return
+	}
+
+	// Sessions are selected if any part of them is within the time range.
+	query := store.Query{
+		From:      from,
+		To:        to,
+		Host:      f.host,
+		Dashboard: f.dashboard,
+		User:      f.user,
+		State:     f.state,
+	}
+	variables, err := sessions.VariableNames(query)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err, h.logger)
+		return
+	}
+	ew, err := export.NewWriter(format, w, export.SessionColumns(variables))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err, h.logger)
+		return
+	}
+
+	w.Header().Set("Content-Type", export.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="sessions.%s"`, format))
+	err = sessions.Sessions(query, func(p payload.Payload) error {
+		return ew.WriteRow(export.SessionRow(p, variables, h.timeout))
+	})
+	if err == nil {
+		err = ew.Close()
+	}
+	if err != nil {
+		level.Error(h.logger).Log("msg", "Failed to write export", "err", err)
+	}
+}
+
+// parseTime parses an RFC 3339 time or unix timestamp. An empty value is the
+// zero time.
+func parseTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+
+	if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("must be an RFC 3339 time or unix timestamp")
+	}
+
+	return t, nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/go-kit/kit/log"
+)
+
+// Session is the state of a cached session.
+type Session struct {
+	UUID                   string           `json:"uuid"`
+	Type                   string           `json:"type"`
+	Active                 bool             `json:"active"`
+	Host                   string           `json:"host"`
+	DashboardUID           string           `json:"dashboard_uid"`
+	DashboardName          string           `json:"dashboard_name"`
+	UserLogin              string           `json:"user_login"`
+	Kind                   string           `json:"kind"`
+	LastSeen               time.Time        `json:"last_seen"`
+	DurationSeconds        float64          `json:"duration_seconds"`
+	FocusedDurationSeconds float64          `json:"focused_duration_seconds"`
+	Timeline               []payload.Event  `json:"timeline"`
+	Interactions           int              `json:"interactions"`
+	Views                  []payload.View   `json:"views"`
+	Payload                *payload.Payload `json:"payload,omitempty"`
+}
+
+// SessionList is the response of the SessionHandler when listing sessions.
+type SessionList struct {
+	Total    int       `json:"total"`
+	Sessions []Session `json:"sessions"`
+}
+
+// SessionHandler lists and describes cached sessions.
+type SessionHandler struct {
+	prefix  string
+	cache   *cacher.Cacher
+	timeout time.Duration
+	logger  log.Logger
+}
+
+// NewSessionHandler creates a new SessionHandler. Sessions are listed on
+// prefix, and described on prefix + "/{uuid}".
+func NewSessionHandler(prefix string, cache *cacher.Cacher, timeout time.Duration, logger log.Logger) *SessionHandler {
+	return &SessionHandler{
+		prefix:  strings.TrimSuffix(prefix, "/"),
+		cache:   cache,
+		timeout: timeout,
+		logger:  logger,
+	}
+}
+
+func (h *SessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method), h.logger)
+		return
+	}
+
+	uuid := strings.Trim(strings.TrimPrefix(r.URL.Path, h.prefix), "/")
+	if uuid != "" {
+		h.serveSession(w, uuid)
+		return
+	}
+
+	h.serveList(w, r)
+}
+
+func (h *SessionHandler) serveSession(w http.ResponseWriter, uuid string) {
+	c, exists := h.cache.Get(uuid)
+	if !exists {
+		writeError(w, http.StatusNotFound, fmt.Errorf("session '%s' was not found", uuid), h.logger)
+		return
+	}
+
+	p := c.(payload.Payload)
+	s := h.session(p)
+	s.Payload = &p
+
+	writeJSON(w, s, h.logger)
+}
+
+func (h *SessionHandler) serveList(w http.ResponseWriter, r *http.Request) {
+	pg, err := parsePage(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err, h.logger)
+		return
+	}
+	f, err := parseFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err, h.logger)
+		return
+	}
+
+	sessions := []Session{}
+	for _, c := range h.cache.Items() {
+		p := c.Object.(payload.Payload)
+		if f.matches(p) {
+			sessions = append(sessions, h.session(p))
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastSeen.Equal(sessions[j].LastSeen) {
+			return sessions[i].LastSeen.After(sessions[j].LastSeen)
+		}
+		return sessions[i].UUID < sessions[j].UUID
+	})
+
+	start, end := pg.bounds(len(sessions))
+	writeJSON(w, SessionList{
+		Total:    len(sessions),
+		Sessions: sessions[start:end],
+	}, h.logger)
+}
+
+func (h *SessionHandler) session(p payload.Payload) Session {
+	_, _, endSet := p.IsTimeSet()
+
+	return Session{
+		UUID:                   p.UUID,
+		Type:                   p.Type,
+		Active:                 !endSet,
+		Host:                   p.HostLabel(),
+		DashboardUID:           p.Dashboard.UID,
+		DashboardName:          p.Dashboard.Name,
+		UserLogin:              p.User.Login,
+		Kind:                   p.Kind(),
+		LastSeen:               p.LastSeen(),
+		DurationSeconds:        p.GetDuration(h.timeout).Seconds(),
+		FocusedDurationSeconds: p.GetFocusedDuration(h.timeout).Seconds(),
+		Timeline:               p.Events(),
+		Interactions:           p.Interactions(),
+		Views:                  p.Views(),
+	}
+}
+
+// filter selects sessions by their attributes. Empty fields match anything.
+type filter struct {
+	host      string
+	dashboard string
+	user      string
+	state     string
+}
+
+// parseFilter reads the host, dashboard, user and state query parameters.
+func parseFilter(r *http.Request) (filter, error) {
+	q := r.URL.Query()
+	f := filter{
+		host:      q.Get("host"),
+		dashboard: q.Get("dashboard"),
+		user:      q.Get("user"),
+		state:     q.Get("state"),
+	}
+
+	switch f.state {
+	case "", "active", "ended":
+	default:
+		return f, fmt.Errorf("state must be one of: [active, ended]")
+	}
+
+	return f, nil
+}
+
+// matches returns true if the Payload matches the filter. Dashboards match on
+// either their UID or name.
+func (f filter) matches(p payload.Payload) bool {
+	if f.host != "" && f.host != p.HostLabel() {
+		return false
+	}
+	if f.dashboard != "" && f.dashboard != p.Dashboard.UID && f.dashboard != p.Dashboard.Name {
+		return false
+	}
+	if f.user != "" && f.user != p.User.Login {
+		return false
+	}
+
+	_, _, endSet := p.IsTimeSet()
+	switch f.state {
+	case "active":
+		return !endSet
+	case "ended":
+		return endSet
+	}
+
+	return true
+}
@@ -1,8 +1,10 @@
 package cacher_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -35,3 +37,48 @@ func TestFlushOnMaxSizeExceeded(t *testing.T) {
 		t.Errorf("Expected '%d' items, got '%d'", 0, cacheItemCountAfterFlush)
 	}
 }
+
+// stringCodec encodes strings as JSON.
+type stringCodec struct{}
+
+func (stringCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (stringCodec) Unmarshal(data []byte) (interface{}, error) {
+	var s string
+	err := json.Unmarshal(data, &s)
+	return s, err
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json.gz")
+
+	cache := cacher.NewCache()
+	snapshotter := cacher.NewSnapshotter(cache, path, stringCodec{}, logger)
+
+	err := snapshotter.Restore()
+	if err != nil {
+		t.Fatalf("Expected a missing snapshot to be ignored, got '%s'", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		cache.Set(fmt.Sprint(i), fmt.Sprintf("value%d", i), cacher.Expiration)
+	}
+	err = snapshotter.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restoredCache := cacher.NewCache()
+	err = cacher.NewSnapshotter(restoredCache, path, stringCodec{}, logger).Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restoredCache.ItemCount() != 10 {
+		t.Errorf("Expected '%d' items, got '%d'", 10, restoredCache.ItemCount())
+	}
+	if v, _ := restoredCache.Get("3"); v != "value3" {
+		t.Errorf("Expected the value '%s', got '%v'", "value3", v)
+	}
+}
@@ -0,0 +1,186 @@
+package cacher
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// SnapshotVersion is the current version of the snapshot file format.
+const SnapshotVersion = 1
+
+// Codec converts cached items to and from their serialized form.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+// snapshot is the content of a snapshot file.
+type snapshot struct {
+	Version int                        `json:"version"`
+	Created time.Time                  `json:"created"`
+	Items   map[string]json.RawMessage `json:"items"`
+}
+
+// Snapshotter writes the contents of a Cache to a gzip compressed JSON file,
+// and restores them from it.
+type Snapshotter struct {
+	mu     sync.Mutex
+	cache  *Cacher
+	path   string
+	codec  Codec
+	logger log.Logger
+}
+
+// NewSnapshotter creates a new Snapshotter.
+func NewSnapshotter(cache *Cacher, path string, codec Codec, logger log.Logger) *Snapshotter {
+	return &Snapshotter{
+		cache:  cache,
+		path:   path,
+		codec:  codec,
+		logger: logger,
+	}
+}
+
+// Snapshot writes all items in the cache to the snapshot file. The file is
+// replaced atomically, so a failed snapshot never corrupts the previous one.
+func (s *Snapshotter) Snapshot() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	count, err := s.write(tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		return err
+	}
+
+	level.Debug(s.logger).Log("msg", "Wrote cache snapshot", "path", s.path, "items", count)
+	return nil
+}
+
+// write streams the encoded snapshot to f, so that it is not held in memory.
+// The items are copied from the cache first, since it cannot be iterated
+// while it is being written to; the copy shares the cached values.
+func (s *Snapshotter) write(f *os.File) (int, error) {
+	bw := bufio.NewWriter(f)
+	gw := gzip.NewWriter(bw)
+
+	created, err := json.Marshal(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	fmt.Fprintf(gw, `{"version":%d,"created":%s,"items":{`, SnapshotVersion, created)
+
+	count := 0
+	for k, item := range s.cache.Items() {
+		key, err := json.Marshal(k)
+		if err != nil {
+			return count, err
+		}
+		value, err := s.codec.Marshal(item.Object)
+		if err != nil {
+			return count, fmt.Errorf("could not encode item '%s': %w", k, err)
+		}
+
+		if count > 0 {
+			gw.Write([]byte(","))
+		}
+		gw.Write(key)
+		gw.Write([]byte(":"))
+		gw.Write(value)
+		count++
+	}
+	gw.Write([]byte("}}"))
+
+	err = gw.Close()
+	if err != nil {
+		return count, err
+	}
+
+	return count, bw.Flush()
+}
+
+// Restore loads all items from the snapshot file into the cache. It is not
+// an error if the snapshot file does not exist. Items which cannot be decoded
+// are skipped.
+func (s *Snapshotter) Restore() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		level.Info(s.logger).Log("msg", "No cache snapshot to restore", "path", s.path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	var snap snapshot
+	err = json.NewDecoder(gr).Decode(&snap)
+	if err != nil {
+		return err
+	}
+	if snap.Version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+
+	restored := 0
+	for k, data := range snap.Items {
+		v, err := s.codec.Unmarshal(data)
+		if err != nil {
+			level.Warn(s.logger).Log("msg", "Skipping item in cache snapshot", "key", k, "err", err)
+			continue
+		}
+		s.cache.Set(k, v, Expiration)
+		restored++
+	}
+
+	level.Info(s.logger).Log(
+		"msg", "Restored cache snapshot",
+		"path", s.path,
+		"created", snap.Created,
+		"items", restored,
+	)
+	return nil
+}
+
+// StartSnapshotter writes a snapshot every interval.
+func StartSnapshotter(s *Snapshotter, interval time.Duration, logger log.Logger) {
+	for {
+		time.Sleep(interval)
+		err := s.Snapshot()
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to write cache snapshot", "err", err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Record is a captured request body.
+type Record struct {
+	// Received is when the request was received.
+	Received time.Time `json:"received"`
+	// RemoteAddr is the address of the client which sent the request.
+	RemoteAddr string `json:"remote_addr"`
+	// Body is the request body, if it is valid UTF-8.
+	Body string `json:"body,omitempty"`
+	// BodyBase64 is the request body, if it is not valid UTF-8.
+	BodyBase64 []byte `json:"body_base64,omitempty"`
+}
+
+// Bytes returns the body exactly as it was sent.
+func (r Record) Bytes() []byte {
+	if r.BodyBase64 != nil {
+		return r.BodyBase64
+	}
+	return []byte(r.Body)
+}
+
+// Redactor removes private information from a request body before it is
+// captured.
+type Redactor interface {
+	// Redact returns the body to capture. If it returns an error, the body
+	// is not captured.
+	Redact(body []byte) ([]byte, error)
+}
+
+// Handler is an http.Handler which appends every request body to a Writer as
+// a JSON line, before passing the request to the next Handler. Bodies are
+// captured even if they are later rejected.
+type Handler struct {
+	mu          sync.Mutex
+	next        http.Handler
+	w           io.Writer
+	maxBodySize int64
+	redactor    Redactor
+	logger      log.Logger
+}
+
+// NewHandler creates a new Handler. Bodies larger than maxBodySize bytes are
+// rejected without being captured. If redactor is not nil, bodies are
+// captured as returned by it, and the next Handler receives them unchanged.
+func NewHandler(next http.Handler, w io.Writer, maxBodySize int64, redactor Redactor, logger log.Logger) *Handler {
+	return &Handler{
+		next:        next,
+		w:           w,
+		maxBodySize: maxBodySize,
+		redactor:    redactor,
+		logger:      logger,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	received := time.Now().UTC()
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, h.maxBodySize))
+	if err != nil {
+		status := http.StatusBadRequest
+		if int64(len(body)) >= h.maxBodySize {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, "", status)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	captured := body
+	if h.redactor != nil {
+		captured, err = h.redactor.Redact(body)
+	}
+	if err != nil {
+		level.Debug(h.logger).Log("msg", "Not capturing payload which cannot be redacted", "err", err)
+	} else {
+		err = h.write(Record{Received: received, RemoteAddr: r.RemoteAddr}, captured)
+		if err != nil {
+			level.Error(h.logger).Log("msg", "Failed to capture payload", "err", err)
+		}
+	}
+
+	h.next.ServeHTTP(w, r)
+}
+
+func (h *Handler) write(rec Record, body []byte) error {
+	if utf8.Valid(body) {
+		rec.Body = string(body)
+	} else {
+		rec.BodyBase64 = body
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, err = h.w.Write(line)
+	return err
+}
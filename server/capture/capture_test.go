@@ -0,0 +1,157 @@
+package capture_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/capture"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/MacroPower/macropower-analytics-panel/server/privacy"
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	logger = log.NewNopLogger()
+)
+
+func TestHandler(t *testing.T) {
+	var received [][]byte
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, body)
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	buf := &payloadtest.SafeBuffer{}
+	testserver := httptest.NewServer(capture.NewHandler(next, buf, 1024, nil, logger))
+	defer testserver.Close()
+
+	bodies := [][]byte{
+		[]byte("{\n  \"uuid\": \"test\",\n  \"type\": \"start\"\n}"),
+		{'{', 0xff, '}'},
+	}
+	start := time.Now()
+	for _, body := range bodies {
+		resp, err := http.Post(testserver.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Errorf("Expected status '%d', got '%d'", http.StatusCreated, resp.StatusCode)
+		}
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(buf.String()))
+	var i int
+	for ; scanner.Scan(); i++ {
+		var rec capture.Record
+		err := json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rec.Bytes(), bodies[i]) {
+			t.Errorf("Expected body %q, got %q", bodies[i], rec.Bytes())
+		}
+		if !bytes.Equal(received[i], bodies[i]) {
+			t.Errorf("Expected the next handler to receive %q, got %q", bodies[i], received[i])
+		}
+		if !strings.HasPrefix(rec.RemoteAddr, "127.0.0.1:") {
+			t.Errorf("Unexpected remote address '%s'", rec.RemoteAddr)
+		}
+		if rec.Received.Before(start.Add(-time.Second)) || rec.Received.After(time.Now()) {
+			t.Errorf("Unexpected receive time '%s'", rec.Received)
+		}
+	}
+	if i != len(bodies) {
+		t.Errorf("Expected '%d' records, got '%d'", len(bodies), i)
+	}
+	if !strings.Contains(buf.String(), `"body_base64"`) || strings.Count(buf.String(), `"body":`) != 1 {
+		t.Errorf("Expected one base64 body, got:\n%s", buf.String())
+	}
+}
+
+func TestHandlerMaxBodySize(t *testing.T) {
+	var called bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	buf := &payloadtest.SafeBuffer{}
+	testserver := httptest.NewServer(capture.NewHandler(next, buf, 16, nil, logger))
+	defer testserver.Close()
+
+	resp, err := http.Post(testserver.URL, "application/json", strings.NewReader(strings.Repeat("a", 17)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status '%d', got '%d'", http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+	if called {
+		t.Error("Expected the next handler not to be called")
+	}
+	if buf.String() != "" {
+		t.Errorf("Expected nothing to be captured, got %q", buf.String())
+	}
+}
+
+func TestHandlerRedact(t *testing.T) {
+	policy, err := privacy.NewPolicy("secret", privacy.Keep, privacy.Drop, privacy.Drop, privacy.Keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &payloadtest.Recorder{}
+	handler := payload.NewHandler(cacher.NewCache(), 10, policy, []payload.Observer{r}, logger)
+
+	buf := &payloadtest.SafeBuffer{}
+	testserver := httptest.NewServer(capture.NewHandler(handler, buf, 1024*1024, handler, logger))
+	defer testserver.Close()
+
+	p := payloadtest.GetPayload(t)
+	p.UUID = "test"
+	p.Type = "start"
+	payloadtest.SendPayload(t, testserver.URL, p)
+
+	// Bodies which are not payloads cannot be redacted, so they are not
+	// captured.
+	resp, err := http.Post(testserver.URL, "application/json", strings.NewReader("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	handler.Close()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected '%d' record, got:\n%s", 1, buf.String())
+	}
+	var rec capture.Record
+	err = json.Unmarshal([]byte(lines[0]), &rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var captured payload.Payload
+	err = json.Unmarshal(rec.Bytes(), &captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if captured.UUID != "test" || captured.User.Login != "" || captured.User.Email != "" || captured.User.Name != p.User.Name {
+		t.Errorf("Expected the user login and email to be dropped, got %+v", captured.User)
+	}
+
+	// The payload is still processed.
+	if payloads := r.Payloads(); len(payloads) != 1 || payloads[0].UUID != "test" {
+		t.Errorf("Expected the payload to be processed, got %d payloads", len(payloads))
+	}
+}
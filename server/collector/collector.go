@@ -18,8 +18,9 @@ const (
 
 // Exporter is an exporter for metrics derrived from payloads in the cache.
 type Exporter struct {
-	SessionCount    *prometheus.CounterVec
-	SessionDuration *prometheus.CounterVec
+	SessionCount        *prometheus.CounterVec
+	SessionDuration     *prometheus.CounterVec
+	SessionInteractions *prometheus.CounterVec
 
 	mu            sync.Mutex
 	up            prometheus.Gauge
@@ -34,21 +35,7 @@ type Exporter struct {
 
 // NewExporter creates an Exporter.
 func NewExporter(cache *cacher.Cacher, timeout time.Duration, userMetrics bool, logger log.Logger) *Exporter {
-	labels := []string{
-		"grafana_host",
-		"grafana_env",
-		"dashboard_name",
-		"dashboard_uid",
-		"dashboard_timezone",
-		"user_theme",
-		"user_timezone",
-		"user_locale",
-		"user_role",
-	}
-
-	if userMetrics {
-		labels = append(labels, "user_login", "user_name")
-	}
+	labels := LabelNames(userMetrics)
 
 	return &Exporter{
 		SessionCount: prometheus.NewCounterVec(
@@ -69,6 +56,15 @@ func NewExporter(cache *cacher.Cacher, timeout time.Duration, userMetrics bool,
 			},
 			labels,
 		),
+		SessionInteractions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "sessions_interactions_total",
+				Help:      "Number of changes to the time range or variables during sessions.",
+			},
+			labels,
+		),
 		up: prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Subsystem: subsystem,
@@ -94,6 +90,67 @@ func NewExporter(cache *cacher.Cacher, timeout time.Duration, userMetrics bool,
 	}
 }
 
+// LabelNames returns the names of the labels describing a session.
+func LabelNames(userMetrics bool) []string {
+	labels := []string{
+		"grafana_host",
+		"grafana_env",
+		"dashboard_name",
+		"dashboard_uid",
+		"dashboard_timezone",
+		"user_theme",
+		"user_timezone",
+		"user_locale",
+		"user_role",
+		"session_kind",
+	}
+
+	if userMetrics {
+		labels = append(labels, "user_login", "user_name")
+	}
+
+	return labels
+}
+
+// LabelValues returns the values of the labels describing the session of a
+// Payload, in the order of LabelNames.
+func LabelValues(p payload.Payload, userMetrics bool) []string {
+	var theme string
+	if p.User.LightTheme {
+		theme = "light"
+	} else {
+		theme = "dark"
+	}
+
+	var role string
+	if p.User.IsGrafanaAdmin {
+		role = "admin"
+	} else if p.User.HasEditPermissionInFolders {
+		role = "editor"
+	} else {
+		role = "user"
+	}
+
+	labels := []string{
+		p.HostLabel(),
+		p.Host.BuildInfo.Env,
+		p.Dashboard.Name,
+		p.Dashboard.UID,
+		p.TimeZone,
+		theme,
+		p.User.Timezone,
+		p.User.Locale,
+		role,
+		p.Kind(),
+	}
+
+	if userMetrics {
+		labels = append(labels, p.User.Login, p.User.Name)
+	}
+
+	return labels
+}
+
 // Describe describes all metrics with constant descriptions.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.up.Desc()
@@ -108,6 +165,7 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 
 	e.SessionCount.Reset()
 	e.SessionDuration.Reset()
+	e.SessionInteractions.Reset()
 
 	err := e.scrape(ch)
 	up := float64(1)
@@ -121,6 +179,7 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 
 	e.SessionCount.Collect(ch)
 	e.SessionDuration.Collect(ch)
+	e.SessionInteractions.Collect(ch)
 
 	ch <- e.up
 	ch <- e.totalScrapes
@@ -128,41 +187,16 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 }
 
 func (e *Exporter) scrape(ch chan<- prometheus.Metric) error {
+	now := time.Now()
 	cacheItems := e.cache.Items()
 	for _, c := range cacheItems {
 		p := c.Object.(payload.Payload)
-
-		var theme string
-		if p.User.LightTheme {
-			theme = "light"
-		} else {
-			theme = "dark"
-		}
-
-		var role string
-		if p.User.IsGrafanaAdmin {
-			role = "admin"
-		} else if p.User.HasEditPermissionInFolders {
-			role = "editor"
-		} else {
-			role = "user"
-		}
-
-		labels := []string{
-			p.Host.Hostname + ":" + p.Host.Port,
-			p.Host.BuildInfo.Env,
-			p.Dashboard.Name,
-			p.Dashboard.UID,
-			p.TimeZone,
-			theme,
-			p.User.Timezone,
-			p.User.Locale,
-			role,
-		}
-
-		if e.userMetrics {
-			labels = append(labels, p.User.Login, p.User.Name)
+		if !p.KindFinalAt(now) {
+			// The session is counted once its kind is final, so that it is
+			// not moved between series.
+			continue
 		}
+		labels := LabelValues(p, e.userMetrics)
 
 		sessionCount, err := e.SessionCount.GetMetricWithLabelValues(labels...)
 		if err != nil {
@@ -170,6 +204,12 @@ func (e *Exporter) scrape(ch chan<- prometheus.Metric) error {
 		}
 		sessionCount.Inc()
 
+		sessionInteractions, err := e.SessionInteractions.GetMetricWithLabelValues(labels...)
+		if err != nil {
+			return err
+		}
+		sessionInteractions.Add(float64(p.Interactions()))
+
 		startSet, hbSet, endSet := p.IsTimeSet()
 		if !startSet {
 			level.Error(e.logger).Log("msg", "Start time is not set for session", "uuid", p.UUID)
@@ -2,6 +2,7 @@ package collector_test
 
 import (
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -13,8 +14,10 @@ import (
 	"github.com/MacroPower/macropower-analytics-panel/server/payload"
 	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
 	"github.com/go-kit/kit/log"
+	"github.com/golang/snappy"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 var (
@@ -46,7 +49,7 @@ func getMetrics(t *testing.T, url string) string {
 func newMux() *http.ServeMux {
 	mux := http.NewServeMux()
 
-	handler := payload.NewHandler(cache, 10, true, true, true, logger)
+	handler := payload.NewHandler(cache, 10, nil, nil, logger)
 	mux.Handle(payloadURL, handler)
 
 	mux.Handle(metricsURL, promhttp.Handler())
@@ -72,7 +75,7 @@ func TestSessionsTotal(t *testing.T) {
 
 	m := getMetrics(t, testserver.URL)
 
-	expectedSessionsTotal := `grafana_analytics_sessions_total{dashboard_name="New Dashboard 1234",dashboard_timezone="utc",dashboard_uid="b_1UbypGz",grafana_env="production",grafana_host="localhost:3000",user_locale="en-US",user_login="admin",user_name="admin",user_role="admin",user_theme="dark",user_timezone="browser"} 2`
+	expectedSessionsTotal := `grafana_analytics_sessions_total{dashboard_name="New Dashboard 1234",dashboard_timezone="utc",dashboard_uid="b_1UbypGz",grafana_env="production",grafana_host="localhost:3000",session_kind="interactive",user_locale="en-US",user_login="admin",user_name="admin",user_role="admin",user_theme="dark",user_timezone="browser"} 2`
 	if !strings.Contains(m, expectedSessionsTotal) {
 		t.Errorf("Expected metrics to contain '%s', got:\n%s", expectedSessionsTotal, m)
 	}
@@ -108,15 +111,279 @@ func TestDurationSeconds(t *testing.T) {
 
 	m := getMetrics(t, testserver.URL)
 
-	expectedSessionsTotal := `grafana_analytics_sessions_total{dashboard_name="New Dashboard 1234",dashboard_timezone="utc",dashboard_uid="test123",grafana_env="production",grafana_host="localhost:3000",user_locale="en-US",user_login="admin",user_name="admin",user_role="admin",user_theme="dark",user_timezone="browser"} 1`
+	expectedSessionsTotal := `grafana_analytics_sessions_total{dashboard_name="New Dashboard 1234",dashboard_timezone="utc",dashboard_uid="test123",grafana_env="production",grafana_host="localhost:3000",session_kind="interactive",user_locale="en-US",user_login="admin",user_name="admin",user_role="admin",user_theme="dark",user_timezone="browser"} 1`
 	if !strings.Contains(m, expectedSessionsTotal) {
 		t.Errorf("Expected metrics to contain '%s', got:\n%s", expectedSessionsTotal, m)
 	}
 
-	expectedDurationSeconds := `grafana_analytics_sessions_duration_seconds_total{dashboard_name="New Dashboard 1234",dashboard_timezone="utc",dashboard_uid="test123",grafana_env="production",grafana_host="localhost:3000",user_locale="en-US",user_login="admin",user_name="admin",user_role="admin",user_theme="dark",user_timezone="browser"} 7200`
+	expectedDurationSeconds := `grafana_analytics_sessions_duration_seconds_total{dashboard_name="New Dashboard 1234",dashboard_timezone="utc",dashboard_uid="test123",grafana_env="production",grafana_host="localhost:3000",session_kind="interactive",user_locale="en-US",user_login="admin",user_name="admin",user_role="admin",user_theme="dark",user_timezone="browser"} 7200`
 	if !strings.Contains(m, expectedDurationSeconds) {
 		t.Errorf("Expected metrics to contain '%s', got:\n%s", expectedDurationSeconds, m)
 	}
 
 	cache.Flush()
 }
+
+func TestInteractions(t *testing.T) {
+	testserver := httptest.NewServer(newMux())
+	defer testserver.Close()
+
+	request := payloadtest.GetPayload(t)
+	request.UUID = "test1"
+	request.Dashboard.UID = "interactions"
+	for i, typ := range []string{"start", "heartbeat", "heartbeat", "end"} {
+		request.Type = typ
+		request.Time = 1600000000 + i*60
+		switch i {
+		case 1:
+			request.TimeRange.Raw.From = "now-1h"
+		case 3:
+			request.Variables = request.Variables[1:]
+		}
+		payloadtest.SendPayload(t, testserver.URL+payloadURL, request)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	m := getMetrics(t, testserver.URL)
+
+	expectedInteractions := `grafana_analytics_sessions_interactions_total{dashboard_name="New Dashboard 1234",dashboard_timezone="utc",dashboard_uid="interactions",grafana_env="production",grafana_host="localhost:3000",session_kind="interactive",user_locale="en-US",user_login="admin",user_name="admin",user_role="admin",user_theme="dark",user_timezone="browser"} 2`
+	if !strings.Contains(m, expectedInteractions) {
+		t.Errorf("Expected metrics to contain '%s', got:\n%s", expectedInteractions, m)
+	}
+
+	cache.Flush()
+}
+
+type remoteSample struct {
+	labels map[string]string
+	value  float64
+	ts     int64
+}
+
+// decodeWriteRequest decodes the samples of a WriteRequest protobuf message.
+func decodeWriteRequest(t *testing.T, b []byte) []remoteSample {
+	var samples []remoteSample
+	forEachField(t, b, func(num protowire.Number, v []byte, _ uint64) {
+		labels := make(map[string]string)
+		forEachField(t, v, func(num protowire.Number, v []byte, _ uint64) {
+			switch num {
+			case 1:
+				var name, value string
+				forEachField(t, v, func(num protowire.Number, v []byte, _ uint64) {
+					if num == 1 {
+						name = string(v)
+					} else {
+						value = string(v)
+					}
+				})
+				labels[name] = value
+			case 2:
+				s := remoteSample{labels: labels}
+				forEachField(t, v, func(num protowire.Number, _ []byte, n uint64) {
+					if num == 1 {
+						s.value = math.Float64frombits(n)
+					} else {
+						s.ts = int64(n)
+					}
+				})
+				samples = append(samples, s)
+			}
+		})
+	})
+
+	return samples
+}
+
+func forEachField(t *testing.T, b []byte, f func(num protowire.Number, v []byte, n uint64)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			f(num, v, 0)
+			b = b[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			f(num, nil, v)
+			b = b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			f(num, nil, v)
+			b = b[n:]
+		default:
+			t.Fatalf("Unexpected wire type %d", typ)
+		}
+	}
+}
+
+func TestRemoteWrite(t *testing.T) {
+	var (
+		requests int
+		samples  []remoteSample
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			t.Errorf("Expected snappy encoding, got '%s'", r.Header.Get("Content-Encoding"))
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Expected bearer token, got '%s'", r.Header.Get("Authorization"))
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, decodeWriteRequest(t, b)...)
+	}))
+	defer receiver.Close()
+
+	remoteCache := cacher.NewCache()
+	writer := collector.NewRemoteWriter(receiver.URL, "secret", map[string]string{"source": "remote_write"}, time.Duration(0), false, receiver.Client())
+	handler := payload.NewHandler(remoteCache, 10, nil, []payload.Observer{writer}, logger)
+	testserver := httptest.NewServer(handler)
+	defer testserver.Close()
+
+	request1 := payloadtest.GetPayload(t)
+	request1.UUID = "test1"
+	request1.Type = "start"
+	request1.Time = 1600000000
+	payloadtest.SendPayload(t, testserver.URL, request1)
+
+	request2 := payloadtest.GetPayload(t)
+	request2.UUID = "test1"
+	request2.Type = "end"
+	request2.Time = 1600000060
+	payloadtest.SendPayload(t, testserver.URL, request2)
+
+	request3 := payloadtest.GetPayload(t)
+	request3.UUID = "test2"
+	request3.Type = "start"
+	request3.Time = 1600000000
+	payloadtest.SendPayload(t, testserver.URL, request3)
+	handler.Close()
+
+	err := writer.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests)
+	}
+
+	var starts, duration float64
+	lastTS := make(map[string]int64)
+	firstTS := map[string]int64{
+		collector.SessionStartMetric:    1600000000000,
+		collector.SessionDurationMetric: 1600000060000,
+	}
+	for _, s := range samples {
+		if s.labels["source"] != "remote_write" || s.labels["grafana_host"] != "localhost:3000" {
+			t.Errorf("Unexpected labels %v", s.labels)
+		}
+		if _, exists := s.labels["user_login"]; exists {
+			t.Errorf("Expected no user labels, got %v", s.labels)
+		}
+
+		name := s.labels["__name__"]
+		// Samples are timestamped with the time of the event.
+		if expected := firstTS[name]; lastTS[name] == 0 && s.ts != expected {
+			t.Errorf("Expected the first sample of %s at %d, got %d", name, expected, s.ts)
+		}
+		if s.ts <= lastTS[name] {
+			t.Errorf("Expected increasing timestamps for %s, got %d after %d", name, s.ts, lastTS[name])
+		}
+		lastTS[name] = s.ts
+
+		switch name {
+		case collector.SessionStartMetric:
+			starts += s.value
+		case collector.SessionDurationMetric:
+			duration += s.value
+		default:
+			t.Errorf("Unexpected series %s", name)
+		}
+	}
+	if starts != 2 {
+		t.Errorf("Expected 2 session starts, got %v", starts)
+	}
+	if duration != 60 {
+		t.Errorf("Expected 60 seconds of duration, got %v", duration)
+	}
+}
+
+func TestRemoteWriteRequeue(t *testing.T) {
+	var (
+		requests int
+		samples  []remoteSample
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// Every attempt of the first Flush fails.
+		if requests <= 4 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, decodeWriteRequest(t, b)...)
+	}))
+	defer receiver.Close()
+
+	writer := collector.NewRemoteWriter(receiver.URL, "", nil, time.Duration(0), false, receiver.Client())
+
+	request := payloadtest.GetPayload(t)
+	request.UUID = "test1"
+	request.Type = "start"
+	request.Time = 1600000000
+	writer.Observe(request)
+
+	err := writer.Flush()
+	if err == nil {
+		t.Fatal("Expected the first Flush to fail")
+	}
+
+	request.UUID = "test2"
+	writer.Observe(request)
+
+	err = writer.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 2 {
+		t.Fatalf("Expected 2 samples, got %d", len(samples))
+	}
+	if samples[0].ts != 1600000000000 || samples[1].ts != 1600000000001 {
+		t.Errorf("Expected the requeued sample to be sent first, got %v", samples)
+	}
+}
@@ -0,0 +1,376 @@
+package collector
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// SessionStartMetric has a sample of 1 for every new session.
+	SessionStartMetric = "grafana_analytics_session_start"
+	// SessionDurationMetric has a sample for the duration added to a session
+	// by each event.
+	SessionDurationMetric = "grafana_analytics_session_duration_delta_seconds"
+
+	// remoteWriteRetries is the number of times a failed request is retried.
+	remoteWriteRetries = 3
+	// remoteWriteMaxPending is the maximum number of samples held between flushes.
+	remoteWriteMaxPending = 100000
+	// remoteWriteRetention is how long sessions and series are remembered
+	// after they were last seen.
+	remoteWriteRetention = 24 * time.Hour
+)
+
+// rwSample is a sample of a series.
+type rwSample struct {
+	series string
+	value  float64
+	ts     int64
+}
+
+// rwSeries is the state of a series.
+type rwSeries struct {
+	labels   []rwLabel
+	lastTS   int64
+	lastSeen time.Time
+}
+
+// rwSession is the state of a session.
+type rwSession struct {
+	duration float64
+	lastSeen time.Time
+}
+
+type rwLabel struct {
+	name  string
+	value string
+}
+
+// RemoteWriter pushes a sample for every session event to a Prometheus
+// remote-write receiver, timestamped with the time of the event.
+// Unlike counters, these samples can be summed exactly using sum_over_time.
+type RemoteWriter struct {
+	mu       sync.Mutex
+	series   map[string]*rwSeries
+	sessions map[string]*rwSession
+	// waiting holds the latest Payload of sessions whose kind is pending.
+	waiting map[string]payload.Payload
+	pending []rwSample
+
+	url         string
+	bearerToken string
+	labels      map[string]string
+	timeout     time.Duration
+	userMetrics bool
+	client      *http.Client
+
+	samples  prometheus.Counter
+	failures prometheus.Counter
+	dropped  prometheus.Counter
+}
+
+// NewRemoteWriter creates a RemoteWriter. The labels are added to all series,
+// in addition to the labels used by the Exporter.
+func NewRemoteWriter(url string, bearerToken string, labels map[string]string, timeout time.Duration, userMetrics bool, client *http.Client) *RemoteWriter {
+	return &RemoteWriter{
+		series:      make(map[string]*rwSeries),
+		sessions:    make(map[string]*rwSession),
+		waiting:     make(map[string]payload.Payload),
+		url:         url,
+		bearerToken: bearerToken,
+		labels:      labels,
+		timeout:     timeout,
+		userMetrics: userMetrics,
+		client:      client,
+		samples: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "remote_write_samples_total",
+			Help:      "Number of samples sent to the remote-write receiver.",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "remote_write_failures_total",
+			Help:      "Number of failed requests to the remote-write receiver.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "remote_write_dropped_samples_total",
+			Help:      "Number of samples which could not be sent to the remote-write receiver.",
+		}),
+	}
+}
+
+// Observe records samples for a Payload. Sessions are recorded once their kind
+// is final, starting with the duration they have reached. Sessions whose kind
+// is pending are recorded by Flush once they are idle.
+func (w *RemoteWriter) Observe(p payload.Payload) {
+	if p.Dashboard.UID == "new" {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if !p.KindFinalAt(now) {
+		w.waiting[p.UUID] = p
+		return
+	}
+	delete(w.waiting, p.UUID)
+	w.record(p, now)
+}
+
+// record records samples for a Payload whose kind is final.
+func (w *RemoteWriter) record(p payload.Payload, now time.Time) {
+	at := time.Unix(int64(p.Time), 0)
+	labelValues := LabelValues(p, w.userMetrics)
+
+	s, exists := w.sessions[p.UUID]
+	if !exists {
+		s = &rwSession{}
+		w.sessions[p.UUID] = s
+		w.add(SessionStartMetric, labelValues, 1, at, now)
+	}
+	s.lastSeen = now
+
+	duration := p.GetDuration(w.timeout).Seconds()
+	if delta := duration - s.duration; delta > 0 {
+		w.add(SessionDurationMetric, labelValues, delta, at, now)
+		s.duration = duration
+	}
+}
+
+// add queues a sample at the given time. Timestamps are made unique and
+// increasing within each series, since receivers reject multiple samples with
+// the same timestamp, and samples older than the latest one.
+func (w *RemoteWriter) add(name string, labelValues []string, value float64, at time.Time, now time.Time) {
+	key := name + "\xff" + strings.Join(labelValues, "\xff")
+
+	s, exists := w.series[key]
+	if !exists {
+		s = &rwSeries{labels: w.seriesLabels(name, labelValues)}
+		w.series[key] = s
+	}
+	s.lastSeen = now
+
+	ts := at.UnixNano() / int64(time.Millisecond)
+	if ts <= s.lastTS {
+		ts = s.lastTS + 1
+	}
+	s.lastTS = ts
+
+	if len(w.pending) >= remoteWriteMaxPending {
+		w.pending = w.pending[1:]
+		w.dropped.Inc()
+	}
+	w.pending = append(w.pending, rwSample{series: key, value: value, ts: ts})
+}
+
+// seriesLabels returns the sorted labels of a series.
+func (w *RemoteWriter) seriesLabels(name string, labelValues []string) []rwLabel {
+	labels := []rwLabel{{name: "__name__", value: name}}
+	for i, n := range LabelNames(w.userMetrics) {
+		if labelValues[i] != "" {
+			labels = append(labels, rwLabel{name: n, value: labelValues[i]})
+		}
+	}
+	for n, v := range w.labels {
+		labels = append(labels, rwLabel{name: n, value: v})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].name < labels[j].name
+	})
+
+	return labels
+}
+
+// Flush records sessions whose kind became final since they were observed,
+// sends all queued samples, and forgets sessions and series which have not
+// been seen within the retention period. If the samples could not be sent
+// after retrying, they are queued again to be sent by the next Flush.
+func (w *RemoteWriter) Flush() error {
+	w.mu.Lock()
+	now := time.Now()
+	for uuid, p := range w.waiting {
+		if p.KindFinalAt(now) {
+			delete(w.waiting, uuid)
+			w.record(p, now)
+		}
+	}
+	w.prune(now)
+	pending := w.pending
+	w.pending = nil
+	body := w.encode(pending)
+	w.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var err error
+	for attempt := 0; attempt <= remoteWriteRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(math.Pow(2, float64(attempt-1))) * time.Second)
+		}
+
+		var retry bool
+		retry, err = w.send(body)
+		if err == nil {
+			w.samples.Add(float64(len(pending)))
+			return nil
+		}
+		w.failures.Inc()
+		if !retry {
+			w.dropped.Add(float64(len(pending)))
+			return err
+		}
+	}
+
+	w.requeue(pending)
+	return err
+}
+
+// requeue queues samples which could not be sent ahead of the samples queued
+// since, dropping the oldest samples if too many are queued.
+func (w *RemoteWriter) requeue(samples []rwSample) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending = append(samples, w.pending...)
+	if n := len(w.pending) - remoteWriteMaxPending; n > 0 {
+		w.pending = w.pending[n:]
+		w.dropped.Add(float64(n))
+	}
+}
+
+// prune forgets sessions and series which have not been seen within the
+// retention period. Series with queued samples are kept.
+func (w *RemoteWriter) prune(now time.Time) {
+	for k, s := range w.sessions {
+		if now.Sub(s.lastSeen) > remoteWriteRetention {
+			delete(w.sessions, k)
+		}
+	}
+	queued := make(map[string]bool)
+	for _, s := range w.pending {
+		queued[s.series] = true
+	}
+	for k, s := range w.series {
+		if now.Sub(s.lastSeen) > remoteWriteRetention && !queued[k] {
+			delete(w.series, k)
+		}
+	}
+}
+
+// send sends an encoded request, and returns whether it may be retried if it failed.
+func (w *RemoteWriter) send(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.bearerToken)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("remote write returned status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+		return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+	}
+
+	return false, nil
+}
+
+// encode returns a snappy compressed WriteRequest protobuf message.
+func (w *RemoteWriter) encode(samples []rwSample) []byte {
+	var keys []string
+	bySeries := make(map[string][]rwSample)
+	for _, s := range samples {
+		if _, exists := bySeries[s.series]; !exists {
+			keys = append(keys, s.series)
+		}
+		bySeries[s.series] = append(bySeries[s.series], s)
+	}
+
+	var req []byte
+	for _, k := range keys {
+		var ts []byte
+		for _, l := range w.series[k].labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l.name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l.value)
+
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+		for _, s := range bySeries[k] {
+			var sample []byte
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(s.ts))
+
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, sample)
+		}
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+
+	return snappy.Encode(nil, req)
+}
+
+// Describe describes all metrics.
+func (w *RemoteWriter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- w.samples.Desc()
+	ch <- w.failures.Desc()
+	ch <- w.dropped.Desc()
+}
+
+// Collect collects all metrics.
+func (w *RemoteWriter) Collect(ch chan<- prometheus.Metric) {
+	ch <- w.samples
+	ch <- w.failures
+	ch <- w.dropped
+}
+
+// StartRemoteWriter flushes the RemoteWriter every interval.
+func StartRemoteWriter(w *RemoteWriter, interval time.Duration, logger log.Logger) {
+	for {
+		time.Sleep(interval)
+		err := w.Flush()
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to send samples to remote write", "err", err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/session"
+	"github.com/MacroPower/macropower-analytics-panel/server/webhook"
+	"github.com/alecthomas/kong"
+	"gopkg.in/yaml.v2"
+)
+
+// Sections containing structured settings.
+const (
+	// webhooksKey is the section containing the webhook configuration.
+	webhooksKey = "webhooks"
+	// sessionPoliciesKey is the section containing the session policies.
+	sessionPoliciesKey = "session_policies"
+)
+
+// File is a YAML configuration file. Top-level keys are the names of flags,
+// e.g. http-address, except for the sections containing structured settings.
+//
+// File is a kong.Resolver. Its values are only used for flags which were not
+// set on the command line or by an environment variable.
+type File struct {
+	// Flags are the values of flags, by name.
+	Flags map[string]interface{}
+	// Webhooks is the webhook configuration, in the same format as the file
+	// passed to --webhook-config. It is nil if the section is missing.
+	Webhooks *webhook.Config
+	// SessionPolicies is the session policy configuration, in the same format
+	// as the file passed to --session-policy-config. It is nil if the section
+	// is missing.
+	SessionPolicies *session.Config
+}
+
+// Load reads and parses a File.
+func Load(path string) (*File, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(b)
+}
+
+// Parse parses a File.
+func Parse(b []byte) (*File, error) {
+	values := map[string]interface{}{}
+	err := yaml.Unmarshal(b, &values)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{Flags: map[string]interface{}{}}
+	for k, v := range values {
+		switch k {
+		case webhooksKey, sessionPoliciesKey:
+			section, err := yaml.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			if k == webhooksKey {
+				f.Webhooks, err = webhook.ParseConfig(section)
+			} else {
+				f.SessionPolicies, err = session.ParseConfig(section)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			continue
+		}
+
+		f.Flags[k], err = normalize(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+	}
+
+	return f, nil
+}
+
+// normalize converts the maps decoded from YAML to the JSON-like values
+// expected by kong.
+func normalize(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, mv := range v {
+			nv, err := normalize(mv)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(k)] = nv
+		}
+		return m, nil
+	case []interface{}:
+		// Lists are passed to kong as a comma separated value.
+		parts := make([]string, len(v))
+		for i, lv := range v {
+			switch lv.(type) {
+			case map[interface{}]interface{}, []interface{}:
+				return nil, fmt.Errorf("lists may only contain scalar values")
+			}
+			parts[i] = fmt.Sprint(lv)
+		}
+		return strings.Join(parts, ","), nil
+	default:
+		return v, nil
+	}
+}
+
+// Validate returns an error if the File contains values for unknown flags.
+func (f *File) Validate(app *kong.Application) error {
+	known := map[string]bool{}
+	err := kong.Visit(app, func(node kong.Visitable, next kong.Next) error {
+		if flag, ok := node.(*kong.Flag); ok {
+			known[flag.Name] = true
+		}
+		return next(nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	var unknown []string
+	for k := range f.Flags {
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown flags in config file: %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// Resolve returns the value of a flag, unless it was set by an environment
+// variable.
+func (f *File) Resolve(context *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+	if flag.Tag.Env != "" && os.Getenv(flag.Tag.Env) != "" {
+		return nil, nil
+	}
+
+	return f.Flags[flag.Name], nil
+}
@@ -0,0 +1,121 @@
+package config_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/config"
+	"github.com/alecthomas/kong"
+)
+
+const testConfig = `
+address: ":9090"
+timeout: 5m
+size: 10
+enabled: true
+names: [a, b]
+labels:
+  job: test
+  env: dev
+webhooks:
+  targets:
+    - name: test
+      url: http://localhost/hook
+      rules:
+        - event: end
+session_policies:
+  rules:
+    - dashboard_uid: wallboard
+      timeout: 1h
+`
+
+type testFlags struct {
+	Address string            `env:"TEST_CONFIG_ADDRESS" default:":8080"`
+	Timeout time.Duration     `type:"time.Duration"`
+	Size    int               `default:"1"`
+	Enabled bool              ``
+	Names   []string          ``
+	Labels  map[string]string ``
+	Other   string            `default:"default"`
+}
+
+func parse(t *testing.T, file *config.File, args ...string) (*testFlags, error) {
+	var c testFlags
+	parser, err := kong.New(&c, kong.Resolvers(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parser.Parse(args)
+	return &c, err
+}
+
+func TestFile(t *testing.T) {
+	file, err := config.Parse([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Webhooks == nil || len(file.Webhooks.Targets) != 1 || file.Webhooks.Targets[0].Name != "test" {
+		t.Errorf("Unexpected webhooks: %+v", file.Webhooks)
+	}
+	if file.SessionPolicies == nil || len(file.SessionPolicies.Rules) != 1 || file.SessionPolicies.Rules[0].Timeout != time.Hour {
+		t.Errorf("Unexpected session policies: %+v", file.SessionPolicies)
+	}
+
+	c, err := parse(t, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Address != ":9090" || c.Timeout != 5*time.Minute || c.Size != 10 || !c.Enabled || c.Other != "default" {
+		t.Errorf("Unexpected flags: %+v", c)
+	}
+	if strings.Join(c.Names, ",") != "a,b" {
+		t.Errorf("Unexpected list: %v", c.Names)
+	}
+	if len(c.Labels) != 2 || c.Labels["job"] != "test" || c.Labels["env"] != "dev" {
+		t.Errorf("Unexpected map: %v", c.Labels)
+	}
+
+	// Flags and environment variables take precedence.
+	c, err = parse(t, file, "--size=20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Size != 20 {
+		t.Errorf("Expected the flag value '%d', got '%d'", 20, c.Size)
+	}
+
+	os.Setenv("TEST_CONFIG_ADDRESS", ":7070")
+	defer os.Unsetenv("TEST_CONFIG_ADDRESS")
+	c, err = parse(t, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Address != ":7070" {
+		t.Errorf("Expected the environment value '%s', got '%s'", ":7070", c.Address)
+	}
+}
+
+func TestFileErrors(t *testing.T) {
+	file, err := config.Parse([]byte("unknown: 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parse(t, file)
+	if err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Errorf("Expected an error for an unknown flag, got %v", err)
+	}
+
+	for _, c := range []string{
+		"size: [\n",
+		"webhooks:\n  targets:\n    - name: test\n",
+		"session_policies:\n  rules:\n    - timeout: -1m\n",
+		"names: [[a]]\n",
+	} {
+		_, err := config.Parse([]byte(c))
+		if err == nil {
+			t.Errorf("Expected an error for:\n%s", c)
+		}
+	}
+}
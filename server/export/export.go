@@ -0,0 +1,163 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Type is the type of a column. Values of each type are string, int64,
+// float64, bool and time.Time respectively.
+type Type int
+
+const (
+	String Type = iota
+	Int
+	Float
+	Bool
+	Time
+)
+
+// Column is a named, typed column.
+type Column struct {
+	Name string
+	Type Type
+}
+
+// Writer writes rows in a file format.
+type Writer interface {
+	// WriteRow writes a row, which has a value for every column.
+	WriteRow(values []interface{}) error
+	// Close writes anything that is pending. It does not close the underlying writer.
+	Close() error
+}
+
+// Formats are the supported formats.
+var Formats = []string{"csv", "ndjson", "parquet"}
+
+// NewWriter creates a Writer for a format.
+func NewWriter(format string, w io.Writer, columns []Column) (Writer, error) {
+	switch format {
+	case "csv":
+		return NewCSVWriter(w, columns)
+	case "ndjson":
+		return NewNDJSONWriter(w, columns), nil
+	case "parquet":
+		return NewParquetWriter(w, columns, DefaultRowGroupSize), nil
+	}
+
+	return nil, fmt.Errorf("unsupported export format '%s'", format)
+}
+
+// ContentType returns the media type of a format.
+func ContentType(format string) string {
+	switch format {
+	case "csv":
+		return "text/csv; charset=utf-8"
+	case "ndjson":
+		return "application/x-ndjson"
+	}
+
+	return "application/octet-stream"
+}
+
+// CSVWriter writes rows as CSV, with a header. Times are formatted as RFC 3339.
+type CSVWriter struct {
+	w *csv.Writer
+}
+
+// NewCSVWriter creates a CSVWriter and writes the header.
+func NewCSVWriter(w io.Writer, columns []Column) (*CSVWriter, error) {
+	c := &CSVWriter{w: csv.NewWriter(w)}
+
+	header := make([]string, len(columns))
+	for i, col := range columns {
+		header[i] = col.Name
+	}
+	err := c.w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// WriteRow writes a row.
+func (c *CSVWriter) WriteRow(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case string:
+			record[i] = v
+		case int64:
+			record[i] = strconv.FormatInt(v, 10)
+		case float64:
+			record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			record[i] = strconv.FormatBool(v)
+		case time.Time:
+			record[i] = v.UTC().Format(time.RFC3339Nano)
+		default:
+			return fmt.Errorf("unsupported value %T", v)
+		}
+	}
+
+	return c.w.Write(record)
+}
+
+// Close flushes any buffered rows.
+func (c *CSVWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// NDJSONWriter writes rows as JSON objects, one per line, with the keys in
+// column order.
+type NDJSONWriter struct {
+	w       io.Writer
+	columns []Column
+	buf     bytes.Buffer
+}
+
+// NewNDJSONWriter creates an NDJSONWriter.
+func NewNDJSONWriter(w io.Writer, columns []Column) *NDJSONWriter {
+	return &NDJSONWriter{
+		w:       w,
+		columns: columns,
+	}
+}
+
+// WriteRow writes a row.
+func (n *NDJSONWriter) WriteRow(values []interface{}) error {
+	n.buf.Reset()
+	n.buf.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			n.buf.WriteByte(',')
+		}
+		key, err := json.Marshal(n.columns[i].Name)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		n.buf.Write(key)
+		n.buf.WriteByte(':')
+		n.buf.Write(value)
+	}
+	n.buf.WriteString("}\n")
+
+	_, err := n.w.Write(n.buf.Bytes())
+	return err
+}
+
+// Close does nothing, since rows are written immediately.
+func (n *NDJSONWriter) Close() error {
+	return nil
+}
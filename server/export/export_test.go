@@ -0,0 +1,211 @@
+package export_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/export"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/go-kit/kit/log"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+var (
+	logger  = log.NewNopLogger()
+	columns = []export.Column{
+		{Name: "name", Type: export.String},
+		{Name: "count", Type: export.Int},
+		{Name: "ratio", Type: export.Float},
+		{Name: "ok", Type: export.Bool},
+		{Name: "time", Type: export.Time},
+	}
+	rows = [][]interface{}{
+		{"a", int64(1), 0.5, true, time.Unix(1600000000, 0).UTC()},
+		{"b, \"quoted\"", int64(-2), 1.25, false, time.Unix(1600000001, 0).UTC()},
+		{"", int64(3), 0.0, true, time.Unix(1600000002, 0).UTC()},
+	}
+)
+
+func write(t *testing.T, format string) string {
+	var b bytes.Buffer
+	w, err := export.NewWriter(format, &b, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		err := w.WriteRow(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b.String()
+}
+
+func TestCSV(t *testing.T) {
+	expected := `name,count,ratio,ok,time
+a,1,0.5,true,2020-09-13T12:26:40Z
+"b, ""quoted""",-2,1.25,false,2020-09-13T12:26:41Z
+,3,0,true,2020-09-13T12:26:42Z
+`
+	if got := write(t, "csv"); got != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	expected := `{"name":"a","count":1,"ratio":0.5,"ok":true,"time":"2020-09-13T12:26:40Z"}
+{"name":"b, \"quoted\"","count":-2,"ratio":1.25,"ok":false,"time":"2020-09-13T12:26:41Z"}
+{"name":"","count":3,"ratio":0,"ok":true,"time":"2020-09-13T12:26:42Z"}
+`
+	if got := write(t, "ndjson"); got != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestParquet(t *testing.T) {
+	var b bytes.Buffer
+	w := export.NewParquetWriter(&b, columns, 2)
+	for _, row := range rows {
+		err := w.WriteRow(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := b.Bytes()
+	if !bytes.HasPrefix(file, []byte("PAR1")) || !bytes.HasSuffix(file, []byte("PAR1")) {
+		t.Fatalf("Expected the file to start and end with PAR1")
+	}
+	footerLen := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	if footerLen <= 0 || footerLen > len(file)-12 {
+		t.Fatalf("Invalid footer length %d", footerLen)
+	}
+	footer := file[len(file)-8-footerLen : len(file)-8]
+	for _, col := range columns {
+		if !bytes.Contains(footer, []byte(col.Name)) {
+			t.Errorf("Expected the footer to contain column %s", col.Name)
+		}
+	}
+	// The string values are stored with plain encoding.
+	if !bytes.Contains(file, []byte("\x0b\x00\x00\x00b, \"quoted\"")) {
+		t.Errorf("Expected the file to contain the plain encoded strings")
+	}
+
+	if err := w.WriteRow([]interface{}{1, 2, 3, 4, 5}); err == nil {
+		t.Error("Expected an error for values of the wrong type")
+	}
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	w := export.NewParquetWriter(&b, columns, 2)
+	for _, row := range rows {
+		err := w.WriteRow(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := buffer.NewBufferFile(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := reader.NewParquetColumnReader(f, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.ReadStop()
+
+	if n := r.GetNumRows(); n != int64(len(rows)) {
+		t.Fatalf("Expected %d rows, got %d", len(rows), n)
+	}
+	for i, col := range columns {
+		values, _, _, err := r.ReadColumnByIndex(int64(i), int64(len(rows)))
+		if err != nil {
+			t.Fatalf("%s: %v", col.Name, err)
+		}
+		if len(values) != len(rows) {
+			t.Fatalf("Expected %d values of %s, got %d", len(rows), col.Name, len(values))
+		}
+		for j, row := range rows {
+			expected := row[i]
+			if ts, ok := expected.(time.Time); ok {
+				// Times are stored as milliseconds.
+				expected = ts.UnixNano() / int64(time.Millisecond)
+			}
+			if values[j] != expected {
+				t.Errorf("Expected %s of row %d to be %#v, got %#v", col.Name, j, expected, values[j])
+			}
+		}
+	}
+}
+
+func TestSessionRow(t *testing.T) {
+	r := &payloadtest.Recorder{}
+	handler := payload.NewHandler(cacher.NewCache(), 10, nil, []payload.Observer{r}, logger)
+	testserver := httptest.NewServer(handler)
+	defer testserver.Close()
+
+	request := payloadtest.GetPayload(t)
+	request.UUID = "test"
+	request.Type = "start"
+	request.Time = 1600000000
+	payloadtest.SendPayload(t, testserver.URL, request)
+	request.Type = "heartbeat"
+	request.Time = 1600000060
+	payloadtest.SendPayload(t, testserver.URL, request)
+	handler.Close()
+
+	payloads := r.Payloads()
+	variables := []string{"constant", "customMultiAll", "customSingle", "license", "textBox"}
+
+	columns := export.SessionColumns(variables)
+	row := export.SessionRow(payloads[1], variables, time.Duration(0))
+	if len(row) != len(columns) {
+		t.Fatalf("Expected %d values, got %d", len(columns), len(row))
+	}
+
+	values := make(map[string]interface{})
+	for i, col := range columns {
+		values[col.Name] = row[i]
+	}
+	expected := map[string]interface{}{
+		"uuid":                    "test",
+		"grafana_host":            "localhost:3000",
+		"dashboard_uid":           "b_1UbypGz",
+		"start_time":              time.Unix(1600000000, 0).UTC(),
+		"time_from":               time.Unix(1599964000, 0).UTC(),
+		"ended":                   false,
+		"heartbeats":              int64(1),
+		"session_kind":            "interactive",
+		"interactions":            int64(0),
+		"duration_seconds":        60.0,
+		"variable_constant":       "constantValue",
+		"variable_customMultiAll": "$__all",
+		"variable_license":        "",
+	}
+	for k, v := range expected {
+		if values[k] != v {
+			t.Errorf("Expected %s to be %v, got %v", k, v, values[k])
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// DefaultRowGroupSize is the number of rows buffered before they are written
+// as a Parquet row group.
+const DefaultRowGroupSize = 10000
+
+// Parquet physical types, converted types, encodings and field repetitions,
+// from https://github.com/apache/parquet-format/blob/master/src/main/thrift/parquet.thrift.
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetRequired = 0
+)
+
+// ParquetWriter writes rows as a Parquet file. Every column is required and
+// written with plain encoding and no compression. Rows are buffered until a
+// row group is complete, so memory usage is bounded by the row group size.
+type ParquetWriter struct {
+	w            *countingWriter
+	columns      []Column
+	rowGroupSize int
+
+	// values holds the plain encoded values of each column in the row group.
+	values    []bytes.Buffer
+	rows      int
+	bools     []bool
+	rowGroups [][]byte
+	totalRows int64
+	started   bool
+}
+
+// NewParquetWriter creates a ParquetWriter.
+func NewParquetWriter(w io.Writer, columns []Column, rowGroupSize int) *ParquetWriter {
+	return &ParquetWriter{
+		w:            &countingWriter{w: w},
+		columns:      columns,
+		rowGroupSize: rowGroupSize,
+		values:       make([]bytes.Buffer, len(columns)),
+	}
+}
+
+// WriteRow adds a row to the row group, and writes the row group if it is full.
+func (p *ParquetWriter) WriteRow(values []interface{}) error {
+	if !p.started {
+		_, err := p.w.Write([]byte("PAR1"))
+		if err != nil {
+			return err
+		}
+		p.started = true
+	}
+
+	for i, v := range values {
+		buf := &p.values[i]
+		switch p.columns[i].Type {
+		case String:
+			s, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("column %s: unsupported value %T", p.columns[i].Name, v)
+			}
+			binary.Write(buf, binary.LittleEndian, uint32(len(s)))
+			buf.WriteString(s)
+		case Int:
+			n, ok := v.(int64)
+			if !ok {
+				return fmt.Errorf("column %s: unsupported value %T", p.columns[i].Name, v)
+			}
+			binary.Write(buf, binary.LittleEndian, n)
+		case Float:
+			f, ok := v.(float64)
+			if !ok {
+				return fmt.Errorf("column %s: unsupported value %T", p.columns[i].Name, v)
+			}
+			binary.Write(buf, binary.LittleEndian, math.Float64bits(f))
+		case Bool:
+			b, ok := v.(bool)
+			if !ok {
+				return fmt.Errorf("column %s: unsupported value %T", p.columns[i].Name, v)
+			}
+			// Booleans are bit-packed, so they are packed when the row group is written.
+			var bit byte
+			if b {
+				bit = 1
+			}
+			buf.WriteByte(bit)
+		case Time:
+			t, ok := v.(time.Time)
+			if !ok {
+				return fmt.Errorf("column %s: unsupported value %T", p.columns[i].Name, v)
+			}
+			binary.Write(buf, binary.LittleEndian, t.UnixNano()/int64(time.Millisecond))
+		}
+	}
+	p.rows++
+
+	if p.rows >= p.rowGroupSize {
+		return p.writeRowGroup()
+	}
+
+	return nil
+}
+
+// writeRowGroup writes a data page for each column, and records the RowGroup
+// metadata for the footer.
+func (p *ParquetWriter) writeRowGroup() error {
+	if p.rows == 0 {
+		return nil
+	}
+
+	var chunks [][]byte
+	var totalSize int64
+	for i, col := range p.columns {
+		data := p.values[i].Bytes()
+		if col.Type == Bool {
+			data = packBits(data)
+		}
+
+		var dataPage thrift
+		dataPage.i32(1, int32(p.rows))
+		dataPage.i32(2, parquetPlain)
+		dataPage.i32(3, parquetRLE)
+		dataPage.i32(4, parquetRLE)
+		dataPage.stop()
+
+		var header thrift
+		header.i32(1, 0)
+		header.i32(2, int32(len(data)))
+		header.i32(3, int32(len(data)))
+		header.structField(5, dataPage)
+		header.stop()
+
+		offset := p.w.n
+		_, err := p.w.Write(header.b)
+		if err != nil {
+			return err
+		}
+		_, err = p.w.Write(data)
+		if err != nil {
+			return err
+		}
+		size := p.w.n - offset
+		totalSize += size
+
+		var meta thrift
+		meta.i32(1, physicalType(col.Type))
+		meta.listI32(2, []int32{parquetPlain, parquetRLE})
+		meta.listString(3, []string{col.Name})
+		meta.i32(4, 0)
+		meta.i64(5, int64(p.rows))
+		meta.i64(6, size)
+		meta.i64(7, size)
+		meta.i64(9, offset)
+		meta.stop()
+
+		var chunk thrift
+		chunk.i64(2, offset)
+		chunk.structField(3, meta)
+		chunk.stop()
+		chunks = append(chunks, chunk.b)
+
+		p.values[i].Reset()
+	}
+
+	var rowGroup thrift
+	rowGroup.listStruct(1, chunks)
+	rowGroup.i64(2, totalSize)
+	rowGroup.i64(3, int64(p.rows))
+	rowGroup.stop()
+	p.rowGroups = append(p.rowGroups, rowGroup.b)
+
+	p.totalRows += int64(p.rows)
+	p.rows = 0
+
+	return nil
+}
+
+// Close writes the last row group and the file footer.
+func (p *ParquetWriter) Close() error {
+	if !p.started {
+		_, err := p.w.Write([]byte("PAR1"))
+		if err != nil {
+			return err
+		}
+		p.started = true
+	}
+
+	err := p.writeRowGroup()
+	if err != nil {
+		return err
+	}
+
+	var root thrift
+	root.str(4, "schema")
+	root.i32(5, int32(len(p.columns)))
+	root.stop()
+	schema := [][]byte{root.b}
+	for _, col := range p.columns {
+		var element thrift
+		element.i32(1, physicalType(col.Type))
+		element.i32(3, parquetRequired)
+		element.str(4, col.Name)
+		switch col.Type {
+		case String:
+			element.i32(6, parquetUTF8)
+		case Time:
+			element.i32(6, parquetTimestampMillis)
+		}
+		element.stop()
+		schema = append(schema, element.b)
+	}
+
+	var meta thrift
+	meta.i32(1, 1)
+	meta.listStruct(2, schema)
+	meta.i64(3, p.totalRows)
+	meta.listStruct(4, p.rowGroups)
+	meta.str(6, "macropower_analytics_panel_server")
+	meta.stop()
+
+	footer := meta.b
+	footer = append(footer, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(footer[len(footer)-4:], uint32(len(meta.b)))
+	footer = append(footer, "PAR1"...)
+
+	_, err = p.w.Write(footer)
+	return err
+}
+
+func physicalType(t Type) int32 {
+	switch t {
+	case Int, Time:
+		return parquetInt64
+	case Float:
+		return parquetDouble
+	case Bool:
+		return parquetBoolean
+	}
+
+	return parquetByteArray
+}
+
+// packBits packs one bit per byte into bytes, least significant bit first.
+func packBits(bits []byte) []byte {
+	packed := make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		packed[i/8] |= bit << (uint(i) % 8)
+	}
+
+	return packed
+}
+
+// countingWriter counts the bytes written, to find the offsets of pages.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// thrift encodes a struct with the Thrift compact protocol, which is used for
+// Parquet metadata. Fields must be added in increasing order.
+type thrift struct {
+	b    []byte
+	last int16
+}
+
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+func (t *thrift) field(id int16, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.b = append(t.b, byte(delta)<<4|typ)
+	} else {
+		t.b = append(t.b, typ)
+		t.varint(uint64(zigzag(int64(id))))
+	}
+	t.last = id
+}
+
+func (t *thrift) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	t.b = append(t.b, buf[:n]...)
+}
+
+func (t *thrift) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thrift) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thrift) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.varint(uint64(len(s)))
+	t.b = append(t.b, s...)
+}
+
+func (t *thrift) structField(id int16, s thrift) {
+	t.field(id, thriftStruct)
+	t.b = append(t.b, s.b...)
+}
+
+func (t *thrift) listHeader(id int16, size int, elemType byte) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.b = append(t.b, byte(size)<<4|elemType)
+	} else {
+		t.b = append(t.b, 0xf0|elemType)
+		t.varint(uint64(size))
+	}
+}
+
+func (t *thrift) listI32(id int16, values []int32) {
+	t.listHeader(id, len(values), thriftI32)
+	for _, v := range values {
+		t.varint(zigzag(int64(v)))
+	}
+}
+
+func (t *thrift) listString(id int16, values []string) {
+	t.listHeader(id, len(values), thriftBinary)
+	for _, v := range values {
+		t.varint(uint64(len(v)))
+		t.b = append(t.b, v...)
+	}
+}
+
+// listStruct adds a list of encoded structs, each ending with a stop field.
+func (t *thrift) listStruct(id int16, values [][]byte) {
+	t.listHeader(id, len(values), thriftStruct)
+	for _, v := range values {
+		t.b = append(t.b, v...)
+	}
+}
+
+func (t *thrift) stop() {
+	t.b = append(t.b, 0)
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
@@ -0,0 +1,137 @@
+package export
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+)
+
+// VariablePrefix is the prefix of the columns holding variable values.
+const VariablePrefix = "variable_"
+
+// sessionColumns are the columns of every session.
+var sessionColumns = []Column{
+	{"uuid", String},
+	{"grafana_host", String},
+	{"grafana_protocol", String},
+	{"grafana_version", String},
+	{"grafana_commit", String},
+	{"grafana_edition", String},
+	{"grafana_env", String},
+	{"license_state", String},
+	{"license_expiry", Int},
+	{"license_has_license", Bool},
+	{"dashboard_uid", String},
+	{"dashboard_name", String},
+	{"dashboard_timezone", String},
+	{"user_id", Int},
+	{"user_login", String},
+	{"user_email", String},
+	{"user_name", String},
+	{"user_org_id", Int},
+	{"user_org_name", String},
+	{"user_org_role", String},
+	{"user_grafana_admin", Bool},
+	{"user_light_theme", Bool},
+	{"user_timezone", String},
+	{"user_locale", String},
+	{"time_from", Time},
+	{"time_to", Time},
+	{"time_from_raw", String},
+	{"time_to_raw", String},
+	{"start_time", Time},
+	{"last_seen", Time},
+	{"ended", Bool},
+	{"heartbeats", Int},
+	{"session_kind", String},
+	{"interactions", Int},
+	{"duration_seconds", Float},
+	{"focused_duration_seconds", Float},
+}
+
+// SessionColumns returns the columns of sessions, with a column for each of
+// the variables.
+func SessionColumns(variables []string) []Column {
+	columns := make([]Column, len(sessionColumns), len(sessionColumns)+len(variables))
+	copy(columns, sessionColumns)
+	for _, v := range variables {
+		columns = append(columns, Column{VariablePrefix + v, String})
+	}
+
+	return columns
+}
+
+// SessionRow returns the values of the SessionColumns of a Payload. Multiple
+// values of a variable are joined with commas. The timeout is used to
+// calculate session durations, as in collector.NewExporter.
+func SessionRow(p payload.Payload, variables []string, timeout time.Duration) []interface{} {
+	h := p.Host
+	u := p.User
+
+	var start time.Time
+	heartbeats := int64(0)
+	for i, ev := range p.Events() {
+		if i == 0 {
+			start = ev.Time
+		}
+		if ev.Type == "heartbeat" {
+			heartbeats++
+		}
+	}
+	_, _, ended := p.IsTimeSet()
+
+	row := []interface{}{
+		p.UUID,
+		p.HostLabel(),
+		h.Protocol,
+		h.BuildInfo.Version,
+		h.BuildInfo.Commit,
+		h.BuildInfo.Edition,
+		h.BuildInfo.Env,
+		h.LicenseInfo.StateInfo,
+		int64(h.LicenseInfo.Expiry),
+		h.LicenseInfo.HasLicense,
+		p.Dashboard.UID,
+		p.Dashboard.Name,
+		p.TimeZone,
+		int64(u.ID),
+		u.Login,
+		u.Email,
+		u.Name,
+		int64(u.OrgID),
+		u.OrgName,
+		u.OrgRole,
+		u.IsGrafanaAdmin,
+		u.LightTheme,
+		u.Timezone,
+		u.Locale,
+		time.Unix(int64(p.TimeRange.From), 0).UTC(),
+		time.Unix(int64(p.TimeRange.To), 0).UTC(),
+		p.TimeRange.Raw.From,
+		p.TimeRange.Raw.To,
+		start.UTC(),
+		p.LastSeen().UTC(),
+		ended,
+		heartbeats,
+		p.Kind(),
+		int64(p.Interactions()),
+		p.GetDuration(timeout).Seconds(),
+		p.GetFocusedDuration(timeout).Seconds(),
+	}
+
+	values := make(map[string]string, len(p.Variables))
+	for _, v := range p.Variables {
+		s := make([]string, len(v.Values))
+		for i, value := range v.Values {
+			s[i] = fmt.Sprint(value)
+		}
+		values[v.Name] = strings.Join(s, ",")
+	}
+	for _, v := range variables {
+		row = append(row, values[v])
+	}
+
+	return row
+}
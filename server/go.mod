@@ -3,9 +3,22 @@ module github.com/MacroPower/macropower-analytics-panel/server
 go 1.16
 
 require (
-	github.com/alecthomas/kong v0.2.16
+	github.com/alecthomas/kong v0.2.18
+	github.com/cespare/xxhash/v2 v2.1.1
 	github.com/go-kit/kit v0.10.0
+	github.com/golang/snappy v0.0.3
+	github.com/lib/pq v1.10.0
+	github.com/nats-io/nats-server/v2 v2.2.6
+	github.com/nats-io/nats.go v1.11.0
+	github.com/nats-io/nkeys v0.3.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/prometheus/client_golang v1.10.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/common v0.20.0
+	github.com/xitongsys/parquet-go v1.6.2
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
+	google.golang.org/protobuf v1.23.0
+	gopkg.in/yaml.v2 v2.3.0
+	modernc.org/sqlite v1.10.8
 )
@@ -0,0 +1,173 @@
+package hostinfo
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "grafana"
+	subsystem = "analytics"
+)
+
+// retention is how long a host is exported after it was last seen.
+const retention = 7 * 24 * time.Hour
+
+// host is the most recently seen build and license information of a host.
+type host struct {
+	version  string
+	commit   string
+	edition  string
+	env      string
+	licensed bool
+	state    string
+	expiry   int
+	lastSeen time.Time
+}
+
+// Collector exports the Grafana version, edition and license of each host.
+type Collector struct {
+	mu    sync.Mutex
+	hosts map[string]*host
+
+	buildInfo     *prometheus.Desc
+	versionNumber *prometheus.Desc
+	licenseInfo   *prometheus.Desc
+	licenseExpiry *prometheus.Desc
+	lastSeen      *prometheus.Desc
+}
+
+// NewCollector creates a Collector.
+func NewCollector() *Collector {
+	return &Collector{
+		hosts: make(map[string]*host),
+		buildInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "host_build_info"),
+			"The Grafana build most recently seen on a host, always 1.",
+			[]string{"grafana_host", "version", "commit", "edition", "grafana_env"},
+			nil,
+		),
+		versionNumber: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "host_version_number"),
+			"The Grafana version most recently seen on a host, as major*1000000 + minor*1000 + patch.",
+			[]string{"grafana_host"},
+			nil,
+		),
+		licenseInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "host_license_info"),
+			"Whether the host most recently had a license, with its state.",
+			[]string{"grafana_host", "state"},
+			nil,
+		),
+		licenseExpiry: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "host_license_expiry_timestamp_seconds"),
+			"The expiry of the license most recently seen on a host.",
+			[]string{"grafana_host"},
+			nil,
+		),
+		lastSeen: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "host_last_seen_timestamp_seconds"),
+			"The time a payload was last received from a host.",
+			[]string{"grafana_host"},
+			nil,
+		),
+	}
+}
+
+// Observe records the build and license information of a Payload.
+func (c *Collector) Observe(p payload.Payload) {
+	bi := p.Host.BuildInfo
+	li := p.Host.LicenseInfo
+	key := p.HostLabel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hosts[key] = &host{
+		version:  bi.Version,
+		commit:   bi.Commit,
+		edition:  bi.Edition,
+		env:      bi.Env,
+		licensed: li.HasLicense,
+		state:    li.StateInfo,
+		expiry:   li.Expiry,
+		lastSeen: time.Now(),
+	}
+}
+
+// Describe describes all metrics.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.buildInfo
+	ch <- c.versionNumber
+	ch <- c.licenseInfo
+	ch <- c.licenseExpiry
+	ch <- c.lastSeen
+}
+
+// Collect collects all metrics, and forgets hosts which have not been seen
+// within the retention.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	for key, h := range c.hosts {
+		if now.Sub(h.lastSeen) > retention {
+			delete(c.hosts, key)
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.buildInfo, prometheus.GaugeValue, 1, key, h.version, h.commit, h.edition, h.env)
+		if v, ok := VersionNumber(h.version); ok {
+			ch <- prometheus.MustNewConstMetric(c.versionNumber, prometheus.GaugeValue, float64(v), key)
+		}
+
+		licensed := float64(0)
+		if h.licensed {
+			licensed = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.licenseInfo, prometheus.GaugeValue, licensed, key, h.state)
+		if h.expiry > 0 {
+			ch <- prometheus.MustNewConstMetric(c.licenseExpiry, prometheus.GaugeValue, float64(h.expiry), key)
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.lastSeen, prometheus.GaugeValue, float64(h.lastSeen.Unix()), key)
+	}
+}
+
+// VersionNumber returns a Grafana version as major*1000000 + minor*1000 +
+// patch, e.g. 7002002 for 7.2.2, so that versions can be compared. Pre-release
+// suffixes, e.g. -beta1, are ignored. It returns false if the version cannot
+// be parsed.
+func VersionNumber(version string) (int, bool) {
+	version = strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(version, "-+ "); i >= 0 {
+		version = version[:i]
+	}
+
+	parts := strings.Split(version, ".")
+	if len(parts) > 3 {
+		return 0, false
+	}
+
+	var n int
+	for i := 0; i < 3; i++ {
+		n *= 1000
+		if i >= len(parts) {
+			continue
+		}
+		v, err := strconv.Atoi(parts[i])
+		if err != nil || v < 0 || v >= 1000 {
+			return 0, false
+		}
+		n += v
+	}
+
+	return n, true
+}
@@ -0,0 +1,80 @@
+package hostinfo_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/hostinfo"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	c := hostinfo.NewCollector()
+
+	p := payloadtest.GetPayload(t)
+	c.Observe(p)
+
+	// The most recent payload of a host replaces its information.
+	p.Host.Hostname = "grafana.example.com"
+	p.Host.BuildInfo.Version = "7.5.0-beta1"
+	p.Host.BuildInfo.Edition = "Enterprise"
+	p.Host.LicenseInfo.HasLicense = false
+	c.Observe(p)
+	p.Host.BuildInfo.Version = "7.5.1"
+	p.Host.LicenseInfo.HasLicense = true
+	p.Host.LicenseInfo.StateInfo = "Valid"
+	p.Host.LicenseInfo.Expiry = 1640995200
+	c.Observe(p)
+
+	expected := `
+# HELP grafana_analytics_host_build_info The Grafana build most recently seen on a host, always 1.
+# TYPE grafana_analytics_host_build_info gauge
+grafana_analytics_host_build_info{commit="ad9d408ac2",edition="Enterprise",grafana_env="production",grafana_host="grafana.example.com:3000",version="7.5.1"} 1
+grafana_analytics_host_build_info{commit="ad9d408ac2",edition="Open Source",grafana_env="production",grafana_host="localhost:3000",version="7.2.2"} 1
+# HELP grafana_analytics_host_license_expiry_timestamp_seconds The expiry of the license most recently seen on a host.
+# TYPE grafana_analytics_host_license_expiry_timestamp_seconds gauge
+grafana_analytics_host_license_expiry_timestamp_seconds{grafana_host="grafana.example.com:3000"} 1.6409952e+09
+# HELP grafana_analytics_host_license_info Whether the host most recently had a license, with its state.
+# TYPE grafana_analytics_host_license_info gauge
+grafana_analytics_host_license_info{grafana_host="grafana.example.com:3000",state="Valid"} 1
+grafana_analytics_host_license_info{grafana_host="localhost:3000",state=""} 0
+# HELP grafana_analytics_host_version_number The Grafana version most recently seen on a host, as major*1000000 + minor*1000 + patch.
+# TYPE grafana_analytics_host_version_number gauge
+grafana_analytics_host_version_number{grafana_host="grafana.example.com:3000"} 7.005001e+06
+grafana_analytics_host_version_number{grafana_host="localhost:3000"} 7.002002e+06
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected),
+		"grafana_analytics_host_build_info",
+		"grafana_analytics_host_license_expiry_timestamp_seconds",
+		"grafana_analytics_host_license_info",
+		"grafana_analytics_host_version_number",
+	)
+	if err != nil {
+		t.Error(err)
+	}
+	if n := testutil.CollectAndCount(c, "grafana_analytics_host_last_seen_timestamp_seconds"); n != 2 {
+		t.Errorf("Expected '%d' last seen times, got '%d'", 2, n)
+	}
+}
+
+func TestVersionNumber(t *testing.T) {
+	for version, expected := range map[string]int{
+		"7.2.2":            7002002,
+		"v10.1.0":          10001000,
+		"8.0.0-beta3":      8000000,
+		"9.4":              9004000,
+		"7.5.7+enterprise": 7005007,
+	} {
+		actual, ok := hostinfo.VersionNumber(version)
+		if !ok || actual != expected {
+			t.Errorf("Expected '%s' to be '%d', got '%d'", version, expected, actual)
+		}
+	}
+
+	for _, version := range []string{"", "dev", "1.2.3.4", "1.2000.0"} {
+		if _, ok := hostinfo.VersionNumber(version); ok {
+			t.Errorf("Expected '%s' to be invalid", version)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package hosts
+
+import (
+	"strings"
+)
+
+// defaultPorts are the ports implied by each protocol.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Normalize returns the canonical label of a Grafana host, as reported by the
+// browser location. The hostname is lowercased, and the port is omitted if it
+// is empty or the default port of the protocol, e.g. localhost:3000 or
+// grafana.example.com.
+func Normalize(hostname, port, protocol string) string {
+	label, _ := normalize(hostname, port, protocol)
+	return label
+}
+
+// normalize returns the canonical label of a host, and the label including
+// the default port if it was omitted, or an empty string if there is no
+// default port.
+func normalize(hostname, port, protocol string) (string, string) {
+	hostname = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(hostname)), ".")
+	port = strings.TrimSpace(port)
+	protocol = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(protocol)), ":")
+
+	defaultPort, known := defaultPorts[protocol]
+	if known && (port == "" || port == defaultPort) {
+		return hostname, hostname + ":" + defaultPort
+	}
+	if port == "" {
+		return hostname, ""
+	}
+
+	return hostname + ":" + port, ""
+}
+
+// Normalizer returns the canonical labels of hosts, replacing aliases of the
+// same Grafana instance with a single name.
+type Normalizer struct {
+	aliases map[string]string
+}
+
+// NewNormalizer creates a new Normalizer. The keys of aliases are host labels,
+// e.g. 10.0.0.1:3000 or grafana.corp, which are replaced with their values.
+// Keys may include the default port of the protocol.
+func NewNormalizer(aliases map[string]string) *Normalizer {
+	n := &Normalizer{aliases: make(map[string]string, len(aliases))}
+	for k, v := range aliases {
+		n.aliases[strings.TrimSuffix(strings.ToLower(strings.TrimSpace(k)), ".")] = strings.TrimSpace(v)
+	}
+
+	return n
+}
+
+// Label returns the canonical label of a host, or its alias.
+func (n *Normalizer) Label(hostname, port, protocol string) string {
+	label, withPort := normalize(hostname, port, protocol)
+	if alias, ok := n.aliases[label]; ok {
+		return alias
+	}
+	if withPort != "" {
+		if alias, ok := n.aliases[withPort]; ok {
+			return alias
+		}
+	}
+
+	return label
+}
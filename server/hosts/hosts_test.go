@@ -0,0 +1,50 @@
+package hosts_test
+
+import (
+	"testing"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/hosts"
+)
+
+func TestNormalize(t *testing.T) {
+	for _, tc := range []struct {
+		hostname, port, protocol string
+		expected                 string
+	}{
+		{"localhost", "3000", "http:", "localhost:3000"},
+		{"Grafana.Example.com.", "", "https:", "grafana.example.com"},
+		{"grafana.example.com", "443", "https:", "grafana.example.com"},
+		{"grafana.example.com", "443", "http:", "grafana.example.com:443"},
+		{"grafana.example.com", "80", "http:", "grafana.example.com"},
+		{"10.0.0.1", "", "", "10.0.0.1"},
+		{"[::1]", "3000", "http:", "[::1]:3000"},
+	} {
+		if actual := hosts.Normalize(tc.hostname, tc.port, tc.protocol); actual != tc.expected {
+			t.Errorf("Expected '%s', got '%s'", tc.expected, actual)
+		}
+	}
+}
+
+func TestNormalizer(t *testing.T) {
+	n := hosts.NewNormalizer(map[string]string{
+		"grafana.corp":   "grafana.example.com",
+		"10.0.0.1:443":   "grafana.example.com",
+		"LOCALHOST:3000": "grafana.example.com",
+	})
+
+	for _, tc := range []struct {
+		hostname, port, protocol string
+		expected                 string
+	}{
+		{"grafana.corp", "", "https:", "grafana.example.com"},
+		{"grafana.corp", "8443", "https:", "grafana.corp:8443"},
+		{"10.0.0.1", "", "https:", "grafana.example.com"},
+		{"10.0.0.1", "", "http:", "10.0.0.1"},
+		{"localhost", "3000", "http:", "grafana.example.com"},
+		{"other", "3000", "http:", "other:3000"},
+	} {
+		if actual := n.Label(tc.hostname, tc.port, tc.protocol); actual != tc.expected {
+			t.Errorf("Expected '%s:%s' to be '%s', got '%s'", tc.hostname, tc.port, tc.expected, actual)
+		}
+	}
+}
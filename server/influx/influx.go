@@ -0,0 +1,168 @@
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+)
+
+// Writer is a Sink which writes line protocol to an InfluxDB write endpoint
+// in batches. Both the v1 (/write) and v2 (/api/v2/write) endpoints are
+// supported, since they accept the same body.
+type Writer struct {
+	url       string
+	token     string
+	batchSize int
+	encoder   *Encoder
+	client    *http.Client
+
+	batch bytes.Buffer
+	lines int
+}
+
+// NewWriter creates a new Writer. If token is set, it is sent in the
+// Authorization header. The batch is sent once it contains batchSize
+// payloads, or when it is flushed.
+func NewWriter(url string, token string, batchSize int, encoder *Encoder, client *http.Client) *Writer {
+	return &Writer{
+		url:       url,
+		token:     token,
+		batchSize: batchSize,
+		encoder:   encoder,
+		client:    client,
+	}
+}
+
+// Name returns the name of the Sink.
+func (w *Writer) Name() string {
+	return "influx"
+}
+
+// Write adds the Payload to the batch, and sends the batch if it is full.
+func (w *Writer) Write(p payload.Payload) error {
+	lines, err := w.encoder.Encode(p)
+	if err != nil {
+		return err
+	}
+	w.batch.Write(lines)
+	w.lines++
+
+	if w.lines >= w.batchSize {
+		return w.Flush()
+	}
+
+	return nil
+}
+
+// Flush sends the batch. The batch is discarded even if it could not be sent.
+func (w *Writer) Flush() error {
+	if w.lines == 0 {
+		return nil
+	}
+
+	body := make([]byte, w.batch.Len())
+	copy(body, w.batch.Bytes())
+	w.batch.Reset()
+	w.lines = 0
+
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("influx returned status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+// Close sends any pending lines.
+func (w *Writer) Close() error {
+	return w.Flush()
+}
+
+// Buffer is a Sink which holds line protocol until it is pulled over HTTP,
+// e.g. by the Telegraf http input. Each request returns and removes all
+// buffered lines, so there should only be a single consumer.
+type Buffer struct {
+	mu       sync.Mutex
+	maxBytes int
+	encoder  *Encoder
+	buf      bytes.Buffer
+}
+
+// NewBuffer creates a new Buffer, which discards the oldest lines once it
+// holds more than maxBytes.
+func NewBuffer(maxBytes int, encoder *Encoder) *Buffer {
+	return &Buffer{
+		maxBytes: maxBytes,
+		encoder:  encoder,
+	}
+}
+
+// Name returns the name of the Sink.
+func (b *Buffer) Name() string {
+	return "influx_pull"
+}
+
+// Write adds the Payload to the buffer.
+func (b *Buffer) Write(p payload.Payload) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	lines, err := b.encoder.Encode(p)
+	if err != nil {
+		return err
+	}
+	b.buf.Write(lines)
+
+	if b.buf.Len() > b.maxBytes {
+		data := b.buf.Bytes()
+		excess := len(data) - b.maxBytes
+		// Only discard whole lines.
+		i := bytes.IndexByte(data[excess:], '\n')
+		b.buf.Next(excess + i + 1)
+		return fmt.Errorf("buffer exceeded %d bytes, discarded %d bytes", b.maxBytes, excess+i+1)
+	}
+
+	return nil
+}
+
+// Close does nothing, buffered lines can still be pulled.
+func (b *Buffer) Close() error {
+	return nil
+}
+
+func (b *Buffer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b.mu.Lock()
+	data := make([]byte, b.buf.Len())
+	copy(data, b.buf.Bytes())
+	b.buf.Reset()
+	b.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(data)
+}
@@ -0,0 +1,156 @@
+package influx_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/influx"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	logger = log.NewNopLogger()
+)
+
+// getSession sends a session to a Handler, and returns the stored payloads.
+func getSession(t *testing.T) []payload.Payload {
+	r := &payloadtest.Recorder{}
+	handler := payload.NewHandler(cacher.NewCache(), 10, nil, []payload.Observer{r}, logger)
+	testserver := httptest.NewServer(handler)
+	defer testserver.Close()
+
+	request := payloadtest.GetPayload(t)
+	request.UUID = "test"
+	request.Type = "start"
+	request.Dashboard.Name = "My Dashboard, v2"
+	request.Time = 1600000000
+	payloadtest.SendPayload(t, testserver.URL, request)
+
+	request.Type = "end"
+	request.Time = 1600000300
+	payloadtest.SendPayload(t, testserver.URL, request)
+	time.Sleep(100 * time.Millisecond)
+
+	return r.Payloads()
+}
+
+func TestEncode(t *testing.T) {
+	payloads := getSession(t)
+	encoder := influx.NewEncoder(time.Duration(0), false)
+
+	start, err := encoder.Encode(payloads[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedStart := `grafana_analytics_payload,grafana_host=localhost:3000,grafana_env=production,dashboard_name=My\ Dashboard\,\ v2,dashboard_uid=b_1UbypGz,dashboard_timezone=utc,user_theme=dark,user_timezone=browser,user_locale=en-US,user_role=admin,session_kind=interactive uuid="test",type="start",has_focus=true,time_from=1599964000i,time_to=1600007200i,variables=5i 1600000000000000000` + "\n"
+	if string(start) != expectedStart {
+		t.Errorf("Expected the lines:\n%s\ngot:\n%s", expectedStart, start)
+	}
+
+	end, err := encoder.Encode(payloads[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(end)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected '%d' lines, got:\n%s", 2, end)
+	}
+	expectedSession := ` uuid="test",duration_seconds=300,focused_duration_seconds=300,heartbeats=0i 1600000300000000000`
+	if !strings.HasPrefix(lines[1], influx.SessionMeasurement+",") || !strings.HasSuffix(lines[1], expectedSession) {
+		t.Errorf("Unexpected session line: %s", lines[1])
+	}
+
+	// Another session of the same series in the same second must not
+	// overwrite the first point.
+	p := payloads[0]
+	p.UUID = "other"
+	other, err := encoder.Encode(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(other), " 1600000000000000001\n") {
+		t.Errorf("Expected a distinct timestamp, got: %s", other)
+	}
+
+	p.UUID = ""
+	_, err = encoder.Encode(p)
+	if err == nil {
+		t.Error("Expected an error for a payload without a uuid")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	payloads := getSession(t)
+	w := influx.NewWriter(server.URL, "secret", 10, influx.NewEncoder(time.Duration(0), true), server.Client())
+	for _, p := range payloads {
+		err := w.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 1 || strings.Count(bodies[0], "\n") != 3 {
+		t.Fatalf("Expected a single request with '%d' lines, got %v", 3, bodies)
+	}
+	if !strings.Contains(bodies[0], "user_login=admin") {
+		t.Errorf("Expected user tags, got:\n%s", bodies[0])
+	}
+}
+
+func TestBuffer(t *testing.T) {
+	payloads := getSession(t)
+	b := influx.NewBuffer(1024*1024, influx.NewEncoder(time.Duration(0), false))
+	testserver := httptest.NewServer(b)
+	defer testserver.Close()
+
+	for _, p := range payloads {
+		err := b.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, expected := range []int{3, 0} {
+		resp, err := http.Get(testserver.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := strings.Count(string(body), "\n"); actual != expected {
+			t.Errorf("Expected '%d' lines, got '%d'", expected, actual)
+		}
+	}
+}
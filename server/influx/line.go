@@ -0,0 +1,165 @@
+package influx
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/collector"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+)
+
+const (
+	// PayloadMeasurement is the measurement of lines describing a single payload.
+	PayloadMeasurement = "grafana_analytics_payload"
+	// SessionMeasurement is the measurement of lines describing a completed session.
+	SessionMeasurement = "grafana_analytics_session"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// pruneInterval is how long the Encoder keeps track of the points written to
+// a series in a given second.
+const pruneInterval = time.Hour
+
+// Encoder encodes payloads as InfluxDB line protocol. Tags are the labels
+// used by collector.Exporter, and the session UUID is written as a field to
+// keep series cardinality bounded. Since points of the same series and
+// timestamp overwrite each other, points written to a series in the same
+// second are offset by a nanosecond each. Encoder is not safe for concurrent
+// use, and each output should use its own Encoder.
+type Encoder struct {
+	timeout     time.Duration
+	userMetrics bool
+
+	points map[point]*pointCount
+	pruned time.Time
+}
+
+type point struct {
+	series string
+	second int64
+}
+
+type pointCount struct {
+	n    int64
+	seen time.Time
+}
+
+// NewEncoder creates a new Encoder. The timeout is used to calculate session
+// durations, as in collector.NewExporter.
+func NewEncoder(timeout time.Duration, userMetrics bool) *Encoder {
+	return &Encoder{
+		timeout:     timeout,
+		userMetrics: userMetrics,
+		points:      make(map[point]*pointCount),
+		pruned:      time.Now(),
+	}
+}
+
+// Encode returns the lines describing a Payload. A line is added for the
+// session if the Payload ended it. An error is returned if the Payload is not
+// valid.
+func (e *Encoder) Encode(p payload.Payload) ([]byte, error) {
+	err := p.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if now.Sub(e.pruned) > pruneInterval {
+		for k, c := range e.points {
+			if now.Sub(c.seen) > pruneInterval {
+				delete(e.points, k)
+			}
+		}
+		e.pruned = now
+	}
+
+	var b strings.Builder
+
+	e.writeLine(&b, PayloadMeasurement, p, [][2]string{
+		{"uuid", quote(p.UUID)},
+		{"type", quote(p.Type)},
+		{"has_focus", strconv.FormatBool(p.HasFocus)},
+		{"time_from", strconv.Itoa(p.TimeRange.From) + "i"},
+		{"time_to", strconv.Itoa(p.TimeRange.To) + "i"},
+		{"variables", strconv.Itoa(len(p.Variables)) + "i"},
+	}, time.Unix(int64(p.Time), 0), now)
+
+	if p.Type == "end" {
+		events := p.Events()
+		heartbeats := 0
+		for _, ev := range events {
+			if ev.Type == "heartbeat" {
+				heartbeats++
+			}
+		}
+
+		e.writeLine(&b, SessionMeasurement, p, [][2]string{
+			{"uuid", quote(p.UUID)},
+			{"duration_seconds", formatFloat(p.GetDuration(e.timeout).Seconds())},
+			{"focused_duration_seconds", formatFloat(p.GetFocusedDuration(e.timeout).Seconds())},
+			{"heartbeats", strconv.Itoa(heartbeats) + "i"},
+		}, p.LastSeen(), now)
+	}
+
+	return []byte(b.String()), nil
+}
+
+func (e *Encoder) writeLine(b *strings.Builder, measurement string, p payload.Payload, fields [][2]string, ts time.Time, now time.Time) {
+	start := b.Len()
+	b.WriteString(measurementEscaper.Replace(measurement))
+
+	names := collector.LabelNames(e.userMetrics)
+	values := collector.LabelValues(p, e.userMetrics)
+	for i, name := range names {
+		// Line protocol does not allow empty tag values.
+		if values[i] == "" {
+			continue
+		}
+		b.WriteByte(',')
+		b.WriteString(tagEscaper.Replace(name))
+		b.WriteByte('=')
+		b.WriteString(tagEscaper.Replace(values[i]))
+	}
+
+	// Offset the timestamp by the number of points already written to the
+	// series in the same second, so that they are not overwritten.
+	k := point{series: b.String()[start:], second: ts.Unix()}
+	c, ok := e.points[k]
+	if !ok {
+		c = &pointCount{}
+		e.points[k] = c
+	}
+	ts = ts.Add(time.Duration(c.n))
+	c.n++
+	c.seen = now
+
+	for i, f := range fields {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(tagEscaper.Replace(f[0]))
+		b.WriteByte('=')
+		b.WriteString(f[1])
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(ts.UnixNano(), 10))
+	b.WriteByte('\n')
+}
+
+func quote(s string) string {
+	return `"` + stringEscaper.Replace(s) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,182 @@
+package journey
+
+import (
+	"sync"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "grafana"
+	subsystem = "analytics"
+)
+
+// userKey identifies the user of a session.
+type userKey struct {
+	host  string
+	id    int
+	login string
+}
+
+// session is a session which may be followed by another session of the user.
+type session struct {
+	dashboardUID  string
+	dashboardName string
+	timeOrigin    int
+	lastSeen      time.Time
+	ended         bool
+	// next is true once the session was linked to a following session.
+	next bool
+	// updated is when the session was last observed.
+	updated time.Time
+}
+
+// Tracker links consecutive sessions of a user into journeys, and counts the
+// transitions between dashboards. A session is linked to the previous session
+// of the same user and host, if the previous session was last seen at most
+// maxGap before it started, and it either ended or was in the same page load
+// (i.e. browser tab). A session which is still open in another tab was not
+// left by the user. If several sessions could be linked, a session of the same
+// page load is preferred, and then the most recently seen session.
+type Tracker struct {
+	maxGap time.Duration
+
+	mu        sync.Mutex
+	sessions  map[userKey]map[string]*session
+	lastPrune time.Time
+
+	transitions *prometheus.CounterVec
+}
+
+// NewTracker creates a Tracker.
+func NewTracker(maxGap time.Duration) *Tracker {
+	return &Tracker{
+		maxGap:   maxGap,
+		sessions: make(map[userKey]map[string]*session),
+		transitions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "dashboard_transitions_total",
+				Help:      "Number of times users went from one dashboard to another.",
+			},
+			[]string{"grafana_host", "from_dashboard_uid", "from_dashboard_name", "to_dashboard_uid", "to_dashboard_name"},
+		),
+	}
+}
+
+// Observe links the session of a Payload to the previous session of its user,
+// if the Payload started the session.
+func (t *Tracker) Observe(p payload.Payload) {
+	if p.Dashboard.UID == "new" {
+		return
+	}
+	events := p.Events()
+	if len(events) == 0 {
+		return
+	}
+
+	key := userKey{
+		host:  p.HostLabel(),
+		id:    p.User.ID,
+		login: p.User.Login,
+	}
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(now)
+
+	sessions, exists := t.sessions[key]
+	if !exists {
+		sessions = make(map[string]*session)
+		t.sessions[key] = sessions
+	}
+
+	if len(events) == 1 {
+		if previous := t.previous(sessions, p, events[0].Time); previous != nil {
+			previous.next = true
+			t.transitions.WithLabelValues(
+				key.host,
+				previous.dashboardUID, previous.dashboardName,
+				p.Dashboard.UID, p.Dashboard.Name,
+			).Inc()
+		}
+	}
+
+	s, exists := sessions[p.UUID]
+	if !exists {
+		s = &session{}
+		sessions[p.UUID] = s
+	}
+	s.dashboardUID = p.Dashboard.UID
+	s.dashboardName = p.Dashboard.Name
+	s.timeOrigin = p.TimeOrigin
+	s.lastSeen = p.LastSeen()
+	_, _, s.ended = p.IsTimeSet()
+	s.updated = now
+}
+
+// previous returns the session which the session of p, started at start,
+// follows, or nil if there is none.
+func (t *Tracker) previous(sessions map[string]*session, p payload.Payload, start time.Time) *session {
+	var match *session
+	for uuid, s := range sessions {
+		if uuid == p.UUID || s.next || s.lastSeen.After(start) || start.Sub(s.lastSeen) > t.maxGap {
+			continue
+		}
+		if !s.ended && s.timeOrigin != p.TimeOrigin {
+			continue
+		}
+		if match == nil {
+			match = s
+			continue
+		}
+		sameTab, matchSameTab := s.timeOrigin == p.TimeOrigin, match.timeOrigin == p.TimeOrigin
+		if sameTab != matchSameTab {
+			if sameTab {
+				match = s
+			}
+			continue
+		}
+		if s.lastSeen.After(match.lastSeen) {
+			match = s
+		}
+	}
+
+	return match
+}
+
+// prune forgets sessions which were not observed within twice maxGap, since
+// they can only be linked again once they are observed. It runs at most once
+// per maxGap.
+func (t *Tracker) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < t.maxGap {
+		return
+	}
+	t.lastPrune = now
+
+	for key, sessions := range t.sessions {
+		for uuid, s := range sessions {
+			if now.Sub(s.updated) > 2*t.maxGap {
+				delete(sessions, uuid)
+			}
+		}
+		if len(sessions) == 0 {
+			delete(t.sessions, key)
+		}
+	}
+}
+
+// Describe describes all metrics.
+func (t *Tracker) Describe(ch chan<- *prometheus.Desc) {
+	t.transitions.Describe(ch)
+}
+
+// Collect collects all metrics.
+func (t *Tracker) Collect(ch chan<- prometheus.Metric) {
+	t.transitions.Collect(ch)
+}
@@ -0,0 +1,60 @@
+package journey_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/journey"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := journey.NewTracker(30 * time.Second)
+	handler := payload.NewHandler(cacher.NewCache(), 10, nil, []payload.Observer{tracker}, log.NewNopLogger())
+
+	send := func(uuid, dashboard, login string, timeOrigin int, typ string, ts int) {
+		p := payloadtest.GetPayload(t)
+		p.UUID = uuid
+		p.Dashboard.UID = dashboard
+		p.Dashboard.Name = strings.ToUpper(dashboard)
+		p.User.Login = login
+		p.TimeOrigin = timeOrigin
+		p.Type = typ
+		p.Time = ts
+		handler.Send(p)
+	}
+
+	// a navigates from home to two other dashboards in the same tab, while
+	// another tab shows a wallboard until just before the last navigation.
+	send("a1", "home", "a", 1, "start", 1600000000)
+	send("a2", "wall", "a", 2, "start", 1600000010)
+	send("a1", "home", "a", 1, "end", 1600000060)
+	send("a3", "ops", "a", 1, "start", 1600000061)
+	send("a2", "wall", "a", 2, "heartbeat", 1600000070)
+	send("a3", "ops", "a", 1, "end", 1600000120)
+	send("a2", "wall", "a", 2, "end", 1600000122)
+	send("a4", "db", "a", 1, "start", 1600000125)
+	// b leaves a dashboard open for too long before navigating.
+	send("b1", "home", "b", 1, "start", 1600000000)
+	send("b1", "home", "b", 1, "end", 1600000060)
+	send("b2", "ops", "b", 1, "start", 1600000100)
+	// c starts a session for a different user right after a.
+	send("c1", "ops", "c", 1, "start", 1600000121)
+	handler.Close()
+
+	expected := `
+# HELP grafana_analytics_dashboard_transitions_total Number of times users went from one dashboard to another.
+# TYPE grafana_analytics_dashboard_transitions_total counter
+grafana_analytics_dashboard_transitions_total{from_dashboard_name="HOME",from_dashboard_uid="home",grafana_host="localhost:3000",to_dashboard_name="OPS",to_dashboard_uid="ops"} 1
+grafana_analytics_dashboard_transitions_total{from_dashboard_name="OPS",from_dashboard_uid="ops",grafana_host="localhost:3000",to_dashboard_name="DB",to_dashboard_uid="db"} 1
+`
+	err := testutil.CollectAndCompare(tracker, strings.NewReader(expected))
+	if err != nil {
+		t.Error(err)
+	}
+}
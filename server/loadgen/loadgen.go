@@ -0,0 +1,335 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+)
+
+// variable is the type of a payload.Payload variable.
+type variable = struct {
+	Name   string        `json:"name"`
+	Label  string        `json:"label"`
+	Type   string        `json:"type"`
+	Multi  bool          `json:"multi"`
+	Values []interface{} `json:"values"`
+}
+
+// Config describes the simulated viewers.
+type Config struct {
+	// URL is the /write URL payloads are sent to.
+	URL string
+	// Viewers is the number of concurrent viewers. Each viewer starts a new
+	// session as soon as the previous one ends.
+	Viewers int
+	// Duration is how long load is generated for.
+	Duration time.Duration
+	// Dashboards is the number of distinct dashboards.
+	Dashboards int
+	// Users is the number of distinct users.
+	Users int
+	// Variables is the number of variables on each dashboard.
+	Variables int
+	// VariableValues is the number of distinct values of each variable.
+	VariableValues int
+	// Skew selects dashboards, users and variable values from a Zipf
+	// distribution with this exponent, so that a few are far more popular
+	// than the rest. Values of 1 or less select uniformly.
+	Skew float64
+	// HeartbeatInterval is the interval between heartbeats of a session.
+	// If 0, the interval in the example payload options is used.
+	HeartbeatInterval time.Duration
+	// SessionDuration is the mean duration of a session. Durations are
+	// exponentially distributed.
+	SessionDuration time.Duration
+}
+
+// Report describes the results of a run.
+type Report struct {
+	// Duration is how long the run took.
+	Duration time.Duration
+	// Sessions is the number of sessions which were started.
+	Sessions int
+	// Requests is the number of payloads which were sent, or could not be
+	// encoded.
+	Requests int
+	// Errors is the number of failed requests, by status code, "error" if
+	// no response was received, or "encode" if the payload could not be
+	// encoded.
+	Errors map[string]int
+	// Latencies are the latencies of all requests, sorted.
+	Latencies []time.Duration
+}
+
+// Rate returns the achieved number of requests per second.
+func (r *Report) Rate() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Requests) / r.Duration.Seconds()
+}
+
+// Percentile returns the latency below which q of requests completed, where
+// q is between 0 and 1.
+func (r *Report) Percentile(q float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(q*float64(len(r.Latencies)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return r.Latencies[i]
+}
+
+// ErrorCount returns the total number of failed requests.
+func (r *Report) ErrorCount() int {
+	var n int
+	for _, c := range r.Errors {
+		n += c
+	}
+	return n
+}
+
+// Generator simulates dashboard viewers.
+type Generator struct {
+	config   Config
+	client   *http.Client
+	template payload.Payload
+
+	mu        sync.Mutex
+	report    Report
+	latencies []time.Duration
+}
+
+// NewGenerator creates a new Generator.
+func NewGenerator(config Config, client *http.Client) (*Generator, error) {
+	template, err := payloadtest.Example()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = time.Duration(template.Options.HeartbeatInterval) * time.Second
+	}
+	if config.HeartbeatInterval <= 0 {
+		return nil, fmt.Errorf("invalid heartbeat interval %s", config.HeartbeatInterval)
+	}
+	if config.Viewers <= 0 || config.Dashboards <= 0 || config.Users <= 0 {
+		return nil, fmt.Errorf("viewers, dashboards and users must be positive")
+	}
+	if config.Variables > 0 && config.VariableValues <= 0 {
+		return nil, fmt.Errorf("variable values must be positive")
+	}
+
+	return &Generator{
+		config:   config,
+		client:   client,
+		template: template,
+		report:   Report{Errors: map[string]int{}},
+	}, nil
+}
+
+// Run generates load until the configured duration has elapsed, or ctx is
+// cancelled. Sessions which are in progress are ended before it returns.
+func (g *Generator) Run(ctx context.Context) *Report {
+	ctx, cancel := context.WithTimeout(ctx, g.config.Duration)
+	defer cancel()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < g.config.Viewers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			g.view(ctx, rand.New(rand.NewSource(seed)))
+		}(start.UnixNano() + int64(i))
+	}
+	wg.Wait()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	report := g.report
+	report.Duration = time.Since(start)
+	report.Latencies = append([]time.Duration{}, g.latencies...)
+	sort.Slice(report.Latencies, func(i, j int) bool {
+		return report.Latencies[i] < report.Latencies[j]
+	})
+
+	return &report
+}
+
+// view runs sessions one after another until ctx is done.
+func (g *Generator) view(ctx context.Context, r *rand.Rand) {
+	pick := g.picker(r)
+
+	// Stagger viewers, so that heartbeats are spread over the interval.
+	if !sleep(ctx, time.Duration(r.Int63n(int64(g.config.HeartbeatInterval)))) {
+		return
+	}
+
+	for ctx.Err() == nil {
+		g.session(ctx, r, pick)
+	}
+}
+
+// session sends a single session, which is ended early if ctx is done.
+func (g *Generator) session(ctx context.Context, r *rand.Rand, pick func(n int) int) {
+	p := g.newPayload(r, pick)
+	length := time.Duration(r.ExpFloat64() * float64(g.config.SessionDuration))
+	end := time.Now().Add(length)
+
+	g.mu.Lock()
+	g.report.Sessions++
+	g.mu.Unlock()
+
+	g.send(p, "start")
+	for {
+		wait := g.config.HeartbeatInterval
+		last := time.Until(end) <= wait
+		if last {
+			wait = time.Until(end)
+		}
+		if !sleep(ctx, wait) || last {
+			break
+		}
+		// Viewers occasionally switch to another tab.
+		p.HasFocus = r.Float64() < 0.9
+		g.send(p, "heartbeat")
+	}
+	g.send(p, "end")
+}
+
+// newPayload creates the Payload of a new session.
+func (g *Generator) newPayload(r *rand.Rand, pick func(n int) int) payload.Payload {
+	p := g.template
+	p.UUID = newUUID(r)
+	p.HasFocus = true
+	p.Options.HeartbeatInterval = int(g.config.HeartbeatInterval / time.Second)
+
+	d := strconv.Itoa(pick(g.config.Dashboards))
+	p.Dashboard.UID = "loadgen-" + d
+	p.Dashboard.Name = "Load Test " + d
+
+	u := pick(g.config.Users)
+	p.User.ID = u + 1
+	p.User.Login = "user" + strconv.Itoa(u)
+	p.User.Email = p.User.Login + "@example.com"
+	p.User.Name = "User " + strconv.Itoa(u)
+	p.User.IsGrafanaAdmin = false
+	p.User.HasEditPermissionInFolders = u%5 == 0
+
+	p.Variables = make([]variable, g.config.Variables)
+	for i := range p.Variables {
+		p.Variables[i] = variable{
+			Name:   "var" + strconv.Itoa(i),
+			Type:   "custom",
+			Values: []interface{}{"value" + strconv.Itoa(pick(g.config.VariableValues))},
+		}
+	}
+
+	return p
+}
+
+// picker returns a function which selects a number in [0, n).
+func (g *Generator) picker(r *rand.Rand) func(n int) int {
+	if g.config.Skew <= 1 {
+		return r.Intn
+	}
+
+	zipfs := map[int]*rand.Zipf{}
+	return func(n int) int {
+		z, ok := zipfs[n]
+		if !ok {
+			z = rand.NewZipf(r, g.config.Skew, 1, uint64(n-1))
+			zipfs[n] = z
+		}
+		return int(z.Uint64())
+	}
+}
+
+// send sends the Payload with the given type, and records the result.
+func (g *Generator) send(p payload.Payload, typ string) {
+	p.Type = typ
+	p.Time = int(time.Now().Unix())
+	p.TimeRange.To = p.Time
+	p.TimeRange.From = p.Time - 6*60*60
+
+	var failure string
+	var latency time.Duration
+	body, err := json.Marshal(p)
+	if err != nil {
+		failure = "encode"
+	} else {
+		failure, latency = g.post(body)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.report.Requests++
+	if failure != "encode" {
+		g.latencies = append(g.latencies, latency)
+	}
+	if failure != "" {
+		g.report.Errors[failure]++
+	}
+}
+
+// post sends a body, and returns the failure to record, if any, and the
+// latency of the request.
+func (g *Generator) post(body []byte) (string, time.Duration) {
+	start := time.Now()
+	resp, err := g.client.Post(g.config.URL, "application/json", bytes.NewReader(body))
+	latency := time.Since(start)
+
+	var failure string
+	if err != nil {
+		failure = "error"
+	} else {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			failure = strconv.Itoa(resp.StatusCode)
+		}
+	}
+
+	return failure, latency
+}
+
+// sleep waits for d, and returns false if ctx was done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID(r *rand.Rand) string {
+	var b [16]byte
+	r.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,105 @@
+package loadgen_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/loadgen"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	logger = log.NewNopLogger()
+)
+
+func TestGenerator(t *testing.T) {
+	r := &payloadtest.Recorder{}
+	handler := payload.NewHandler(cacher.NewCache(), 10, nil, []payload.Observer{r}, logger)
+	testserver := httptest.NewServer(handler)
+	defer testserver.Close()
+
+	config := loadgen.Config{
+		URL:               testserver.URL,
+		Viewers:           5,
+		Duration:          300 * time.Millisecond,
+		Dashboards:        3,
+		Users:             10,
+		Variables:         2,
+		VariableValues:    4,
+		Skew:              1.5,
+		HeartbeatInterval: 20 * time.Millisecond,
+		SessionDuration:   100 * time.Millisecond,
+	}
+	g, err := loadgen.NewGenerator(config, testserver.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := g.Run(context.Background())
+	handler.Close()
+
+	if report.ErrorCount() != 0 {
+		t.Errorf("Unexpected errors: %v", report.Errors)
+	}
+	if report.Sessions < config.Viewers {
+		t.Errorf("Expected at least '%d' sessions, got '%d'", config.Viewers, report.Sessions)
+	}
+	if report.Rate() <= 0 || report.Percentile(0.5) <= 0 || report.Percentile(0.99) < report.Percentile(0.5) {
+		t.Errorf("Unexpected report: rate=%f p50=%s p99=%s", report.Rate(), report.Percentile(0.5), report.Percentile(0.99))
+	}
+
+	payloads := r.Payloads()
+	if len(payloads) != report.Requests {
+		t.Fatalf("Expected '%d' payloads, got '%d'", report.Requests, len(payloads))
+	}
+
+	// Every session is started and ended, even if the run ended first.
+	types := map[string][]string{}
+	for _, p := range payloads {
+		types[p.UUID] = append(types[p.UUID], p.Type)
+		if len(p.Variables) != config.Variables {
+			t.Errorf("Expected '%d' variables, got '%d'", config.Variables, len(p.Variables))
+		}
+	}
+	if len(types) != report.Sessions {
+		t.Errorf("Expected '%d' sessions, got '%d'", report.Sessions, len(types))
+	}
+	for uuid, ts := range types {
+		if ts[0] != "start" || ts[len(ts)-1] != "end" {
+			t.Errorf("Unexpected session '%s': %v", uuid, ts)
+		}
+	}
+}
+
+func TestGeneratorErrors(t *testing.T) {
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer testserver.Close()
+
+	g, err := loadgen.NewGenerator(loadgen.Config{
+		URL:               testserver.URL,
+		Viewers:           2,
+		Duration:          50 * time.Millisecond,
+		Dashboards:        1,
+		Users:             1,
+		HeartbeatInterval: 10 * time.Millisecond,
+	}, testserver.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := g.Run(context.Background())
+	if report.Requests == 0 {
+		t.Fatal("Expected requests to be sent")
+	}
+	if report.ErrorCount() != report.Requests || report.Errors["503"] != report.Requests {
+		t.Errorf("Expected all '%d' requests to fail, got %v", report.Requests, report.Errors)
+	}
+}
@@ -0,0 +1,176 @@
+package otlp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// scopeName is the name of the instrumentation scope of all exported data.
+const scopeName = "github.com/MacroPower/macropower-analytics-panel/server"
+
+// Protocol is an OTLP transport.
+type Protocol string
+
+const (
+	// HTTP sends protobuf messages over HTTP, usually on port 4318.
+	HTTP Protocol = "http"
+	// GRPC sends protobuf messages over gRPC, usually on port 4317.
+	GRPC Protocol = "grpc"
+)
+
+// Signal is a type of telemetry data.
+type Signal string
+
+const (
+	// Traces are exported to the trace service.
+	Traces Signal = "traces"
+	// Logs are exported to the logs service.
+	Logs Signal = "logs"
+	// Metrics are exported to the metrics service.
+	Metrics Signal = "metrics"
+)
+
+// grpcServices are the gRPC service names of each Signal.
+var grpcServices = map[Signal]string{
+	Traces:  "opentelemetry.proto.collector.trace.v1.TraceService",
+	Logs:    "opentelemetry.proto.collector.logs.v1.LogsService",
+	Metrics: "opentelemetry.proto.collector.metrics.v1.MetricsService",
+}
+
+// Client sends export requests to an OTLP receiver.
+type Client struct {
+	endpoint string
+	protocol Protocol
+	headers  map[string]string
+	client   *http.Client
+}
+
+// NewClient creates a new Client. The endpoint is the base URL of the
+// receiver, e.g. http://otel-collector:4318. For gRPC, plaintext HTTP/2 is
+// used if the scheme is http, and TLS if it is https.
+func NewClient(endpoint string, protocol Protocol, headers map[string]string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported otlp endpoint scheme %q", u.Scheme)
+	}
+
+	client := &http.Client{Timeout: timeout}
+	switch protocol {
+	case HTTP:
+	case GRPC:
+		transport := &http2.Transport{}
+		if u.Scheme == "http" {
+			transport.AllowHTTP = true
+			transport.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			}
+		}
+		client.Transport = transport
+	default:
+		return nil, fmt.Errorf("unsupported otlp protocol %q", protocol)
+	}
+
+	return &Client{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		protocol: protocol,
+		headers:  headers,
+		client:   client,
+	}, nil
+}
+
+// Export sends an encoded export request for the Signal.
+func (c *Client) Export(signal Signal, body []byte) error {
+	if c.protocol == GRPC {
+		return c.exportGRPC(signal, body)
+	}
+
+	return c.exportHTTP(signal, body)
+}
+
+func (c *Client) exportHTTP(signal Signal, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, c.endpoint+"/v1/"+string(signal), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("otlp %s returned status %d: %s", signal, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+func (c *Client) exportGRPC(signal Signal, body []byte) error {
+	// Messages are prefixed with an uncompressed flag and their length.
+	msg := make([]byte, 5, 5+len(body))
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(body)))
+	msg = append(msg, body...)
+
+	req, err := http.NewRequest(http.MethodPost, c.endpoint+"/"+grpcServices[signal]+"/Export", bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The status is sent in the trailers, which are only available once the
+	// body has been read.
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("otlp %s returned http status %d", signal, resp.StatusCode)
+	}
+
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		// Responses without a body send the status in the headers.
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		if m, err := url.PathUnescape(message); err == nil {
+			message = m
+		}
+		return fmt.Errorf("otlp %s returned grpc status %s: %s", signal, status, message)
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package otlp
+
+import (
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+)
+
+const (
+	severityInfo = 9
+)
+
+// LogExporter is a Sink which exports each payload as a log record. Records
+// contain the trace and span ID of the session, so they can be correlated
+// with the spans of a TraceExporter.
+type LogExporter struct {
+	client    *Client
+	batchSize int
+	logVars   bool
+
+	batch *batch
+}
+
+// NewLogExporter creates a new LogExporter. The batch is sent once it
+// contains batchSize records, or when it is flushed.
+func NewLogExporter(client *Client, batchSize int, logVars bool) *LogExporter {
+	return &LogExporter{
+		client:    client,
+		batchSize: batchSize,
+		logVars:   logVars,
+		batch:     newBatch(),
+	}
+}
+
+// Name returns the name of the Sink.
+func (e *LogExporter) Name() string {
+	return "otlp_logs"
+}
+
+// Write adds a log record to the batch, and sends the batch if it is full.
+func (e *LogExporter) Write(p payload.Payload) error {
+	attrs := []attribute{
+		{"event.type", p.Type},
+		{"has_focus", p.HasFocus},
+	}
+	attrs = append(attrs, payloadAttributes(p, e.logVars)...)
+
+	var record []byte
+	record = appendFixed64(record, 1, uint64(time.Unix(int64(p.Time), 0).UnixNano()))
+	record = appendVarint(record, 2, severityInfo)
+	record = appendString(record, 3, "INFO")
+	record = appendAnyValue(record, 5, "Received session data")
+	record = appendAttributes(record, 6, attrs)
+	record = appendBytes(record, 9, traceID(p.UUID))
+	record = appendBytes(record, 10, spanID(p.UUID))
+	record = appendFixed64(record, 11, uint64(time.Now().UnixNano()))
+
+	e.batch.add(p, record)
+	if e.batch.len >= e.batchSize {
+		return e.Flush()
+	}
+
+	return nil
+}
+
+// Flush sends the batch. The batch is discarded even if it could not be sent.
+func (e *LogExporter) Flush() error {
+	if e.batch.len == 0 {
+		return nil
+	}
+
+	body := e.batch.encode()
+	e.batch = newBatch()
+
+	return e.client.Export(Logs, body)
+}
+
+// Close sends any pending records.
+func (e *LogExporter) Close() error {
+	return e.Flush()
+}
@@ -0,0 +1,196 @@
+package otlp
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Temporality is the aggregation temporality of exported counters.
+type Temporality string
+
+const (
+	// Cumulative counters are exported with their current value.
+	Cumulative Temporality = "cumulative"
+	// Delta counters are exported with their increase since the previous export.
+	Delta Temporality = "delta"
+)
+
+const (
+	temporalityDelta      = 1
+	temporalityCumulative = 2
+)
+
+// MetricExporter periodically exports the metrics of a Gatherer. Counters are
+// exported as monotonic sums, and all other metrics as gauges. A counter which
+// decreased since the previous export, e.g. because sessions expired from the
+// cache of collector.Exporter, was reset: cumulative series start again at
+// the previous export, and delta series export the new value.
+type MetricExporter struct {
+	mu          sync.Mutex
+	client      *Client
+	gatherer    prometheus.Gatherer
+	temporality Temporality
+	start       time.Time
+	last        time.Time
+	previous    map[string]float64
+	// starts holds the start time of cumulative series which were reset.
+	starts map[string]time.Time
+}
+
+// NewMetricExporter creates a new MetricExporter.
+func NewMetricExporter(client *Client, gatherer prometheus.Gatherer, temporality Temporality) (*MetricExporter, error) {
+	if temporality != Cumulative && temporality != Delta {
+		return nil, fmt.Errorf("unsupported otlp temporality %q", temporality)
+	}
+
+	now := time.Now()
+	return &MetricExporter{
+		client:      client,
+		gatherer:    gatherer,
+		temporality: temporality,
+		start:       now,
+		last:        now,
+		previous:    make(map[string]float64),
+		starts:      make(map[string]time.Time),
+	}, nil
+}
+
+// Export gathers and exports all metrics.
+func (e *MetricExporter) Export() error {
+	mfs, err := e.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	body := e.encode(mfs, time.Now())
+	e.mu.Unlock()
+
+	return e.client.Export(Metrics, body)
+}
+
+// encode returns an ExportMetricsServiceRequest containing the metric families.
+func (e *MetricExporter) encode(mfs []*dto.MetricFamily, now time.Time) []byte {
+	current := make(map[string]float64)
+
+	var scope []byte
+	scope = appendScope(scope, 1)
+	for _, mf := range mfs {
+		var metric []byte
+		metric = appendString(metric, 1, mf.GetName())
+		metric = appendString(metric, 2, mf.GetHelp())
+
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			var sum []byte
+			for _, m := range mf.GetMetric() {
+				key := seriesKey(mf.GetName(), m)
+				value := m.GetCounter().GetValue()
+				current[key] = value
+				previous, reset := e.previous[key]
+				reset = reset && value < previous
+
+				start := e.start
+				if e.temporality == Delta {
+					start = e.last
+					if !reset {
+						value -= previous
+					}
+				} else {
+					if reset {
+						e.starts[key] = e.last
+					}
+					if t, exists := e.starts[key]; exists {
+						start = t
+					}
+				}
+				sum = appendBytes(sum, 1, encodeDataPoint(m, value, start, now))
+			}
+			if e.temporality == Delta {
+				sum = appendVarint(sum, 2, temporalityDelta)
+			} else {
+				sum = appendVarint(sum, 2, temporalityCumulative)
+			}
+			sum = appendVarint(sum, 3, 1)
+			metric = appendBytes(metric, 7, sum)
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			var gauge []byte
+			for _, m := range mf.GetMetric() {
+				value := m.GetGauge().GetValue()
+				if mf.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+				gauge = appendBytes(gauge, 1, encodeDataPoint(m, value, time.Time{}, now))
+			}
+			metric = appendBytes(metric, 5, gauge)
+		default:
+			continue
+		}
+
+		scope = appendBytes(scope, 2, metric)
+	}
+
+	for key := range e.starts {
+		if _, exists := current[key]; !exists {
+			delete(e.starts, key)
+		}
+	}
+	e.previous = current
+	e.last = now
+
+	var resource []byte
+	resource = appendResource(resource, 1, []attribute{{"service.name", "macropower_analytics_panel_server"}})
+	resource = appendBytes(resource, 2, scope)
+
+	return appendBytes(nil, 1, resource)
+}
+
+// encodeDataPoint returns a NumberDataPoint message. The start time is
+// omitted if it is zero.
+func encodeDataPoint(m *dto.Metric, value float64, start time.Time, now time.Time) []byte {
+	attrs := make([]attribute, 0, len(m.GetLabel()))
+	for _, l := range m.GetLabel() {
+		attrs = append(attrs, attribute{l.GetName(), l.GetValue()})
+	}
+
+	var dp []byte
+	if !start.IsZero() {
+		dp = appendFixed64(dp, 2, uint64(start.UnixNano()))
+	}
+	dp = appendFixed64(dp, 3, uint64(now.UnixNano()))
+	dp = appendFixed64(dp, 4, math.Float64bits(value))
+	dp = appendAttributes(dp, 7, attrs)
+
+	return dp
+}
+
+// seriesKey identifies a series of a metric family.
+func seriesKey(name string, m *dto.Metric) string {
+	parts := []string{name}
+	for _, l := range m.GetLabel() {
+		parts = append(parts, l.GetName()+"="+l.GetValue())
+	}
+	sort.Strings(parts[1:])
+
+	return strings.Join(parts, "\xff")
+}
+
+// StartMetricExporter exports metrics every interval.
+func StartMetricExporter(e *MetricExporter, interval time.Duration, logger log.Logger) {
+	for {
+		time.Sleep(interval)
+		err := e.Export()
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to export otlp metrics", "err", err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package otlp
+
+import (
+	"fmt"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+)
+
+// resourceAttributes returns the attributes of the Grafana host of a Payload,
+// which is the resource that all of its telemetry describes.
+func resourceAttributes(p payload.Payload) []attribute {
+	h := p.Host
+	return []attribute{
+		{"service.name", "grafana"},
+		{"service.instance.id", p.HostLabel()},
+		{"service.version", h.BuildInfo.Version},
+		{"deployment.environment", h.BuildInfo.Env},
+		{"grafana.protocol", h.Protocol},
+		{"grafana.commit", h.BuildInfo.Commit},
+		{"grafana.edition", h.BuildInfo.Edition},
+		{"grafana.license.state", h.LicenseInfo.StateInfo},
+		{"grafana.license.expiry", h.LicenseInfo.Expiry},
+		{"grafana.license.has_license", h.LicenseInfo.HasLicense},
+	}
+}
+
+// payloadAttributes returns the attributes describing the dashboard, user and
+// variables of a Payload.
+func payloadAttributes(p payload.Payload, logVars bool) []attribute {
+	u := p.User
+	attrs := []attribute{
+		{"session.id", p.UUID},
+		{"dashboard.name", p.Dashboard.Name},
+		{"dashboard.uid", p.Dashboard.UID},
+		{"dashboard.timezone", p.TimeZone},
+		{"dashboard.time_range.from", p.TimeRange.Raw.From},
+		{"dashboard.time_range.to", p.TimeRange.Raw.To},
+		{"user.signed_in", u.IsSignedIn},
+		{"user.id", u.ID},
+		{"user.login", u.Login},
+		{"user.email", u.Email},
+		{"user.name", u.Name},
+		{"user.org.id", u.OrgID},
+		{"user.org.name", u.OrgName},
+		{"user.org.role", u.OrgRole},
+		{"user.grafana_admin", u.IsGrafanaAdmin},
+		{"user.light_theme", u.LightTheme},
+		{"user.timezone", u.Timezone},
+		{"user.locale", u.Locale},
+	}
+
+	if logVars {
+		for _, v := range p.Variables {
+			values := make([]string, 0, len(v.Values))
+			for _, value := range v.Values {
+				values = append(values, fmt.Sprint(value))
+			}
+			attrs = append(attrs, attribute{"dashboard.variable." + v.Name, values})
+		}
+	}
+
+	return attrs
+}
+
+// batch holds encoded spans or log records, grouped by the resource of their
+// Grafana host.
+type batch struct {
+	hosts     []string
+	resources map[string][]attribute
+	records   map[string][][]byte
+	len       int
+}
+
+func newBatch() *batch {
+	return &batch{
+		resources: make(map[string][]attribute),
+		records:   make(map[string][][]byte),
+	}
+}
+
+// add adds an encoded record describing the Payload.
+func (b *batch) add(p payload.Payload, record []byte) {
+	host := p.HostLabel()
+	if _, exists := b.resources[host]; !exists {
+		b.hosts = append(b.hosts, host)
+		b.resources[host] = resourceAttributes(p)
+	}
+	b.records[host] = append(b.records[host], record)
+	b.len++
+}
+
+// encode returns the batch as an export request. Traces, logs and metrics
+// requests share the same structure, e.g. ExportTraceServiceRequest contains
+// ResourceSpans, which contain ScopeSpans, which contain Spans.
+func (b *batch) encode() []byte {
+	var req []byte
+	for _, host := range b.hosts {
+		var scope []byte
+		scope = appendScope(scope, 1)
+		for _, r := range b.records[host] {
+			scope = appendBytes(scope, 2, r)
+		}
+
+		var resource []byte
+		resource = appendResource(resource, 1, b.resources[host])
+		resource = appendBytes(resource, 2, scope)
+
+		req = appendBytes(req, 1, resource)
+	}
+
+	return req
+}
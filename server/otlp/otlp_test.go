@@ -0,0 +1,436 @@
+package otlp_test
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/otlp"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	sessionUUID = "0f8fad5b-d9cb-469f-a165-70867728950e"
+)
+
+var (
+	logger = log.NewNopLogger()
+)
+
+// message is a decoded protobuf message. Length-delimited fields are stored
+// as bytes, all other fields as numbers.
+type message map[protowire.Number][]interface{}
+
+func decode(t *testing.T, b []byte) message {
+	m := make(message)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		var v interface{}
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		default:
+			t.Fatalf("Unexpected wire type %d", typ)
+		}
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		m[num] = append(m[num], v)
+		b = b[n:]
+	}
+
+	return m
+}
+
+// messages decodes all messages in a field.
+func (m message) messages(t *testing.T, num protowire.Number) []message {
+	var messages []message
+	for _, v := range m[num] {
+		messages = append(messages, decode(t, v.([]byte)))
+	}
+
+	return messages
+}
+
+// attributes decodes the string values of a KeyValue field.
+func (m message) attributes(t *testing.T, num protowire.Number) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range m.messages(t, num) {
+		value := decode(t, kv[2][0].([]byte))
+		if s, ok := value[1]; ok {
+			attrs[string(kv[1][0].([]byte))] = string(s[0].([]byte))
+		}
+	}
+
+	return attrs
+}
+
+// records returns the spans or log records of an export request.
+func records(t *testing.T, body []byte) []message {
+	var records []message
+	for _, resource := range decode(t, body).messages(t, 1) {
+		attrs := resource.messages(t, 1)[0].attributes(t, 1)
+		if attrs["service.name"] == "grafana" && attrs["service.instance.id"] != "localhost:3000" {
+			t.Errorf("Unexpected resource attributes: %v", attrs)
+		}
+		for _, scope := range resource.messages(t, 2) {
+			records = append(records, scope.messages(t, 2)...)
+		}
+	}
+
+	return records
+}
+
+// sendSession sends a session to a Handler which writes to the Sink.
+func sendSession(t *testing.T, s interface {
+	Write(p payload.Payload) error
+	Close() error
+}) {
+	r := &payloadtest.Recorder{}
+	handler := payload.NewHandler(cacher.NewCache(), 10, nil, []payload.Observer{r}, logger)
+	testserver := httptest.NewServer(handler)
+	defer testserver.Close()
+
+	request := payloadtest.GetPayload(t)
+	request.UUID = sessionUUID
+	request.Type = "start"
+	request.Time = 1600000000
+	payloadtest.SendPayload(t, testserver.URL, request)
+
+	request.Type = "heartbeat"
+	for i := 1; i <= 2; i++ {
+		request.Time = 1600000000 + 60*i
+		payloadtest.SendPayload(t, testserver.URL, request)
+	}
+
+	request.Type = "end"
+	request.Time = 1600000150
+	payloadtest.SendPayload(t, testserver.URL, request)
+	handler.Close()
+
+	for _, p := range r.Payloads() {
+		err := s.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTraceExporter(t *testing.T) {
+	var mu sync.Mutex
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("X-Scope-OrgID") != "tenant" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	client, err := otlp.NewClient(server.URL, otlp.HTTP, map[string]string{"X-Scope-OrgID": "tenant"}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendSession(t, otlp.NewTraceExporter(client, 10, time.Duration(0), time.Hour, true))
+
+	if len(bodies) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(bodies))
+	}
+	spans := records(t, bodies[0])
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+
+	if id := hex.EncodeToString(span[1][0].([]byte)); id != "0f8fad5bd9cb469fa16570867728950e" {
+		t.Errorf("Expected the trace ID to be the session UUID, got %s", id)
+	}
+	if name := string(span[5][0].([]byte)); name != "New Dashboard 1234" {
+		t.Errorf("Unexpected span name %s", name)
+	}
+	start, end := span[7][0].(uint64), span[8][0].(uint64)
+	if time.Duration(end-start) != 150*time.Second {
+		t.Errorf("Expected a span of 150s, got %v", time.Duration(end-start))
+	}
+	if events := span.messages(t, 11); len(events) != 2 {
+		t.Errorf("Expected 2 heartbeat events, got %d", len(events))
+	}
+
+	attrs := span.attributes(t, 9)
+	if attrs["session.id"] != sessionUUID || attrs["dashboard.uid"] != "b_1UbypGz" || attrs["user.login"] != "admin" {
+		t.Errorf("Unexpected span attributes: %v", attrs)
+	}
+}
+
+func TestTraceExporterExpiry(t *testing.T) {
+	var mu sync.Mutex
+	var spans []message
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		spans = append(spans, records(t, body)...)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	client, err := otlp.NewClient(server.URL, otlp.HTTP, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := otlp.NewTraceExporter(client, 10, time.Duration(0), 100*time.Millisecond, false)
+
+	r := &payloadtest.Recorder{}
+	handler := payload.NewHandler(cacher.NewCache(), 10, nil, []payload.Observer{r}, logger)
+	testserver := httptest.NewServer(handler)
+	defer testserver.Close()
+
+	request := payloadtest.GetPayload(t)
+	request.UUID = sessionUUID
+	request.Type = "start"
+	request.Time = 1600000000
+	payloadtest.SendPayload(t, testserver.URL, request)
+	request.Type = "heartbeat"
+	request.Time = 1600000060
+	payloadtest.SendPayload(t, testserver.URL, request)
+	request.Type = "end"
+	request.Time = 1600000090
+	payloadtest.SendPayload(t, testserver.URL, request)
+	handler.Close()
+	payloads := r.Payloads()
+
+	// A session which has not ended is exported once it expires.
+	for _, p := range payloads[:2] {
+		err := e.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) != 0 {
+		t.Fatalf("Expected no spans before the session expired, got %d", len(spans))
+	}
+	time.Sleep(150 * time.Millisecond)
+	err = e.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span once the session expired, got %d", len(spans))
+	}
+	start, end := spans[0][7][0].(uint64), spans[0][8][0].(uint64)
+	if time.Duration(end-start) != 60*time.Second {
+		t.Errorf("Expected a span of 60s, got %v", time.Duration(end-start))
+	}
+
+	// The end of the exported session is ignored.
+	err = e.Write(payloads[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) != 1 {
+		t.Errorf("Expected 1 span for the session, got %d", len(spans))
+	}
+}
+
+func TestLogExporterGRPC(t *testing.T) {
+	var mu sync.Mutex
+	var bodies [][]byte
+	fail := false
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != "/opentelemetry.proto.collector.logs.v1.LogsService/Export" || r.Header.Get("Content-Type") != "application/grpc" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		msg, _ := ioutil.ReadAll(r.Body)
+		if len(msg) < 5 || int(binary.BigEndian.Uint32(msg[1:5])) != len(msg)-5 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		bodies = append(bodies, msg[5:])
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write([]byte{0, 0, 0, 0, 0})
+		if fail {
+			w.Header().Set("Grpc-Status", "8")
+			w.Header().Set("Grpc-Message", "resource%20exhausted")
+			return
+		}
+		w.Header().Set("Grpc-Status", "0")
+	})
+	server := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer server.Close()
+
+	client, err := otlp.NewClient(server.URL, otlp.GRPC, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendSession(t, otlp.NewLogExporter(client, 10, true))
+
+	if len(bodies) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(bodies))
+	}
+	logs := records(t, bodies[0])
+	if len(logs) != 4 {
+		t.Fatalf("Expected 4 log records, got %d", len(logs))
+	}
+	for _, l := range logs {
+		if id := hex.EncodeToString(l[9][0].([]byte)); id != "0f8fad5bd9cb469fa16570867728950e" {
+			t.Errorf("Expected the trace ID to be the session UUID, got %s", id)
+		}
+	}
+	attrs := logs[3].attributes(t, 6)
+	if attrs["event.type"] != "end" || attrs["dashboard.uid"] != "b_1UbypGz" {
+		t.Errorf("Unexpected log attributes: %v", attrs)
+	}
+
+	fail = true
+	err = client.Export(otlp.Logs, nil)
+	if err == nil || err.Error() != "otlp logs returned grpc status 8: resource exhausted" {
+		t.Errorf("Expected a grpc error, got %v", err)
+	}
+}
+
+func TestMetricExporter(t *testing.T) {
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, body)
+	}))
+	defer server.Close()
+
+	client, err := otlp.NewClient(server.URL, otlp.HTTP, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "sessions_total", Help: "Sessions."}, []string{"dashboard_uid"})
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "users", Help: "Users."})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(counter, gauge)
+
+	// sums returns the temporality, data point values and start times of the
+	// counter, and the value of the gauge.
+	sums := func(body []byte) (uint64, map[string]float64, map[string]uint64, float64) {
+		var temporality uint64
+		values := make(map[string]float64)
+		starts := make(map[string]uint64)
+		var gaugeValue float64
+		for _, metric := range records(t, body) {
+			switch string(metric[1][0].([]byte)) {
+			case "sessions_total":
+				sum := metric.messages(t, 7)[0]
+				temporality = sum[2][0].(uint64)
+				for _, dp := range sum.messages(t, 1) {
+					uid := dp.attributes(t, 7)["dashboard_uid"]
+					values[uid] = math.Float64frombits(dp[4][0].(uint64))
+					starts[uid] = dp[2][0].(uint64)
+				}
+			case "users":
+				dp := metric.messages(t, 5)[0].messages(t, 1)[0]
+				gaugeValue = math.Float64frombits(dp[4][0].(uint64))
+			}
+		}
+
+		return temporality, values, starts, gaugeValue
+	}
+
+	for _, test := range []struct {
+		temporality         otlp.Temporality
+		expectedTemporality uint64
+		expectedSecond      map[string]float64
+	}{
+		{otlp.Cumulative, 2, map[string]float64{"a": 3, "b": 1, "c": 4}},
+		{otlp.Delta, 1, map[string]float64{"a": 1, "b": 1, "c": 4}},
+	} {
+		counter.Reset()
+		bodies = nil
+		e, err := otlp.NewMetricExporter(client, registry, test.temporality)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		counter.WithLabelValues("a").Add(2)
+		counter.WithLabelValues("b").Add(3)
+		gauge.Set(5)
+		if err := e.Export(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Sessions of b expired from the cache, which is a reset.
+		counter.WithLabelValues("a").Add(1)
+		counter.DeleteLabelValues("b")
+		counter.WithLabelValues("b").Add(1)
+		counter.WithLabelValues("c").Add(4)
+		if err := e.Export(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(bodies) != 2 {
+			t.Fatalf("Expected 2 requests, got %d", len(bodies))
+		}
+		temporality, first, firstStarts, gaugeValue := sums(bodies[0])
+		if temporality != test.expectedTemporality || first["a"] != 2 || first["b"] != 3 || gaugeValue != 5 {
+			t.Errorf("Unexpected first %s export: temporality=%d values=%v gauge=%v", test.temporality, temporality, first, gaugeValue)
+		}
+		_, second, secondStarts, _ := sums(bodies[1])
+		for k, v := range test.expectedSecond {
+			if second[k] != v {
+				t.Errorf("Expected %s %s to be %v, got %v", test.temporality, k, v, second[k])
+			}
+		}
+		if test.temporality == otlp.Cumulative {
+			if secondStarts["a"] != firstStarts["a"] || secondStarts["b"] <= firstStarts["b"] {
+				t.Errorf("Expected only the start time of b to be reset, got %v and %v", firstStarts, secondStarts)
+			}
+		}
+	}
+
+	_, err = otlp.NewMetricExporter(client, registry, "invalid")
+	if err == nil {
+		t.Error("Expected an error for an invalid temporality")
+	}
+}
@@ -0,0 +1,115 @@
+package otlp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Protobuf messages are encoded by hand, following
+// https://github.com/open-telemetry/opentelemetry-proto, since only a few
+// messages are needed.
+
+// attribute is a KeyValue with a string, bool, int, double or string array value.
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+// appendAnyValue appends an AnyValue message.
+func appendAnyValue(b []byte, num protowire.Number, value interface{}) []byte {
+	var v []byte
+	switch value := value.(type) {
+	case string:
+		v = protowire.AppendTag(v, 1, protowire.BytesType)
+		v = protowire.AppendString(v, value)
+	case bool:
+		v = appendVarint(v, 2, protowire.EncodeBool(value))
+	case int:
+		v = appendVarint(v, 3, uint64(value))
+	case int64:
+		v = appendVarint(v, 3, uint64(value))
+	case float64:
+		v = appendFixed64(v, 4, math.Float64bits(value))
+	case []string:
+		var array []byte
+		for _, s := range value {
+			array = appendAnyValue(array, 1, s)
+		}
+		v = appendBytes(v, 5, array)
+	default:
+		v = protowire.AppendTag(v, 1, protowire.BytesType)
+		v = protowire.AppendString(v, fmt.Sprint(value))
+	}
+
+	return appendBytes(b, num, v)
+}
+
+// appendAttributes appends a repeated KeyValue field.
+func appendAttributes(b []byte, num protowire.Number, attrs []attribute) []byte {
+	for _, a := range attrs {
+		var kv []byte
+		kv = appendString(kv, 1, a.key)
+		kv = appendAnyValue(kv, 2, a.value)
+		b = appendBytes(b, num, kv)
+	}
+
+	return b
+}
+
+// appendResource appends a Resource message.
+func appendResource(b []byte, num protowire.Number, attrs []attribute) []byte {
+	return appendBytes(b, num, appendAttributes(nil, 1, attrs))
+}
+
+// appendScope appends an InstrumentationScope message.
+func appendScope(b []byte, num protowire.Number) []byte {
+	var scope []byte
+	scope = appendString(scope, 1, scopeName)
+	return appendBytes(b, num, scope)
+}
+
+// traceID returns the trace ID of a session. Session UUIDs are used directly,
+// so that sessions can be found by their UUID. Other IDs are hashed.
+func traceID(uuid string) []byte {
+	id, err := hex.DecodeString(strings.ReplaceAll(uuid, "-", ""))
+	if err == nil && len(id) == 16 {
+		return id
+	}
+
+	sum := sha256.Sum256([]byte(uuid))
+	return sum[:16]
+}
+
+// spanID returns the ID of the span describing a session.
+func spanID(uuid string) []byte {
+	sum := sha256.Sum256([]byte(uuid))
+	return sum[16:24]
+}
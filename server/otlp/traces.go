@@ -0,0 +1,172 @@
+package otlp
+
+import (
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+)
+
+const (
+	spanKindInternal = 1
+)
+
+// TraceExporter is a Sink which exports each session as a span, once it ends
+// or once no payload was received for it within the expiry. Heartbeats are
+// added to the span as events. A single span is exported for each session.
+type TraceExporter struct {
+	client    *Client
+	batchSize int
+	timeout   time.Duration
+	expiry    time.Duration
+	logVars   bool
+
+	batch *batch
+	// open holds the sessions whose span has not been exported yet.
+	open map[string]openSession
+	// exported holds the time a payload was last received for the sessions
+	// whose span has been exported, so that later payloads are ignored.
+	exported map[string]time.Time
+}
+
+// openSession is a session whose span has not been exported yet.
+type openSession struct {
+	payload  payload.Payload
+	lastSeen time.Time
+}
+
+// NewTraceExporter creates a new TraceExporter. The timeout is used to
+// calculate session durations, as in collector.NewExporter. Sessions which
+// have not ended are exported by Flush once no payload was received for them
+// within expiry. The batch is sent once it contains batchSize spans, or when
+// it is flushed.
+func NewTraceExporter(client *Client, batchSize int, timeout time.Duration, expiry time.Duration, logVars bool) *TraceExporter {
+	return &TraceExporter{
+		client:    client,
+		batchSize: batchSize,
+		timeout:   timeout,
+		expiry:    expiry,
+		logVars:   logVars,
+		batch:     newBatch(),
+		open:      make(map[string]openSession),
+		exported:  make(map[string]time.Time),
+	}
+}
+
+// Name returns the name of the Sink.
+func (e *TraceExporter) Name() string {
+	return "otlp_traces"
+}
+
+// Write adds a span to the batch if the Payload ended a session, and sends
+// the batch if it is full. Otherwise, the span is added by Flush or Close.
+func (e *TraceExporter) Write(p payload.Payload) error {
+	if len(p.Events()) == 0 {
+		// The payload was not processed, e.g. because the dashboard is new.
+		return nil
+	}
+
+	now := time.Now()
+	if _, ok := e.exported[p.UUID]; ok {
+		e.exported[p.UUID] = now
+		return nil
+	}
+
+	if _, _, ended := p.IsTimeSet(); !ended {
+		e.open[p.UUID] = openSession{payload: p, lastSeen: now}
+		return nil
+	}
+	delete(e.open, p.UUID)
+
+	e.add(p, now)
+	if e.batch.len >= e.batchSize {
+		return e.send()
+	}
+
+	return nil
+}
+
+// add adds the span of a session to the batch.
+func (e *TraceExporter) add(p payload.Payload, now time.Time) {
+	e.exported[p.UUID] = now
+	e.batch.add(p, e.encodeSpan(p))
+}
+
+// encodeSpan returns a Span message describing the session of a Payload.
+func (e *TraceExporter) encodeSpan(p payload.Payload) []byte {
+	events := p.Events()
+	start := p.LastSeen()
+	if len(events) > 0 {
+		start = events[0].Time
+	}
+
+	attrs := payloadAttributes(p, e.logVars)
+	attrs = append(attrs,
+		attribute{"session.duration_seconds", p.GetDuration(e.timeout).Seconds()},
+		attribute{"session.focused_duration_seconds", p.GetFocusedDuration(e.timeout).Seconds()},
+	)
+
+	var span []byte
+	span = appendBytes(span, 1, traceID(p.UUID))
+	span = appendBytes(span, 2, spanID(p.UUID))
+	span = appendString(span, 5, p.Dashboard.Name)
+	span = appendVarint(span, 6, spanKindInternal)
+	span = appendFixed64(span, 7, uint64(start.UnixNano()))
+	span = appendFixed64(span, 8, uint64(p.LastSeen().UnixNano()))
+	span = appendAttributes(span, 9, attrs)
+	for _, ev := range events {
+		if ev.Type != "heartbeat" {
+			continue
+		}
+
+		var event []byte
+		event = appendFixed64(event, 1, uint64(ev.Time.UnixNano()))
+		event = appendString(event, 2, ev.Type)
+		event = appendAttributes(event, 3, []attribute{{"has_focus", ev.HasFocus}})
+		span = appendBytes(span, 11, event)
+	}
+
+	return span
+}
+
+// Flush adds the spans of the sessions which have expired, and sends the
+// batch. The batch is discarded even if it could not be sent.
+func (e *TraceExporter) Flush() error {
+	now := time.Now()
+	for uuid, o := range e.open {
+		if now.Sub(o.lastSeen) > e.expiry {
+			delete(e.open, uuid)
+			e.add(o.payload, now)
+		}
+	}
+	for uuid, t := range e.exported {
+		if now.Sub(t) > e.expiry {
+			delete(e.exported, uuid)
+		}
+	}
+
+	return e.send()
+}
+
+// send sends the batch. The batch is discarded even if it could not be sent.
+func (e *TraceExporter) send() error {
+	if e.batch.len == 0 {
+		return nil
+	}
+
+	body := e.batch.encode()
+	e.batch = newBatch()
+
+	return e.client.Export(Traces, body)
+}
+
+// Close adds the spans of the sessions which have not been exported yet, and
+// sends any pending spans.
+func (e *TraceExporter) Close() error {
+	now := time.Now()
+	for uuid, o := range e.open {
+		delete(e.open, uuid)
+		e.add(o.payload, now)
+	}
+
+	return e.send()
+}
@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/hosts"
+	"github.com/MacroPower/macropower-analytics-panel/server/privacy"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 )
@@ -14,18 +18,132 @@ import (
 // Handler is the handler for incoming payloads.
 type Handler struct {
 	logger log.Logger
-	ch     chan Payload
+	ch     chan request
+	done   chan struct{}
+
+	// sendMu guards sending on ch, which is closed once closed is set.
+	sendMu sync.RWMutex
+	closed bool
+
+	mu     sync.RWMutex
+	config HandlerConfig
+}
+
+// HandlerConfig is the configuration of a Handler, which can be replaced while
+// it is running.
+type HandlerConfig struct {
+	// Policy is applied to every Payload before it is cached or passed to
+	// observers, if it is not nil.
+	Policy *privacy.Policy
+	// Hosts sets the host label of every Payload. If it is nil, hosts are
+	// normalized without aliases.
+	Hosts *hosts.Normalizer
+	// Sessions selects the SessionPolicy of every session. If it is nil,
+	// every session has the default SessionPolicy.
+	Sessions SessionPolicies
+	// Classifier sets the kind of every session. If it is nil, every session
+	// is interactive.
+	Classifier SessionClassifier
+	// Observers are notified of every Payload.
+	Observers []Observer
 }
 
-// NewHandler creates a new Handler.
-func NewHandler(cache *cacher.Cacher, buffer int, sessionLog bool, variableLog bool, raw bool, logger log.Logger) *Handler {
-	ch := make(chan Payload, buffer)
-	go startProcessor(cache, ch, sessionLog, variableLog, raw, logger)
+// request is a Payload to process, or a session to end if expire is set.
+type request struct {
+	payload Payload
+	expire  *expireRequest
+}
+
+// expireRequest asks the processor to end a session.
+type expireRequest struct {
+	uuid   string
+	result chan<- expireResult
+}
 
-	return &Handler{
+// expireResult is the session ended by an expireRequest.
+type expireResult struct {
+	p      Payload
+	exists bool
+}
+
+// Observer is notified of every Payload after it has been processed.
+type Observer interface {
+	Observe(p Payload)
+}
+
+// NewHandler creates a new Handler. If policy is not nil, it is applied to
+// every Payload before it is cached or passed to observers.
+func NewHandler(cache *cacher.Cacher, buffer int, policy *privacy.Policy, observers []Observer, logger log.Logger) *Handler {
+	h := &Handler{
 		logger: logger,
-		ch:     ch,
+		ch:     make(chan request, buffer),
+		done:   make(chan struct{}),
+		config: HandlerConfig{
+			Policy:    policy,
+			Observers: observers,
+		},
+	}
+	go func() {
+		h.startProcessor(cache)
+		close(h.done)
+	}()
+
+	return h
+}
+
+// Reconfigure replaces the HandlerConfig. Queued payloads are processed using
+// the new configuration. Reconfigure returns once no Payload is being
+// processed using the previous configuration, so its observers can be closed.
+func (h *Handler) Reconfigure(config HandlerConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.config = config
+}
+
+// Close stops accepting payloads, and waits for queued payloads to be
+// processed. Payloads sent after the Handler is closed are dropped.
+func (h *Handler) Close() {
+	h.sendMu.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.ch)
+	}
+	h.sendMu.Unlock()
+
+	<-h.done
+}
+
+// send queues a request, and returns false if the Handler is closed.
+func (h *Handler) send(r request) bool {
+	h.sendMu.RLock()
+	defer h.sendMu.RUnlock()
+
+	if h.closed {
+		return false
+	}
+	h.ch <- r
+	return true
+}
+
+// EndSession ends a cached session at the time it was last seen, so that no
+// further duration is inferred for it, and later payloads of the session are
+// ignored. The session is ended after the payloads which are already queued.
+// It returns false if the session does not exist, or the Handler is closed.
+func (h *Handler) EndSession(uuid string) (Payload, bool) {
+	result := make(chan expireResult, 1)
+	if !h.send(request{expire: &expireRequest{uuid: uuid, result: result}}) {
+		return Payload{}, false
 	}
+	r := <-result
+
+	return r.p, r.exists
+}
+
+// Send queues a Payload for processing, as if it had been received. The
+// Payload is dropped if the Handler is closed.
+func (h *Handler) Send(p Payload) {
+	h.send(request{payload: p})
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -37,52 +155,109 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.ch <- p
+	h.Send(p)
 
 	w.WriteHeader(http.StatusCreated)
 	fmt.Fprint(w, "")
 }
 
-// startProcessor starts a receiver and optional logger for the Payload channel.
-func startProcessor(cache *cacher.Cacher, c <-chan Payload, sessionLog bool, variableLog bool, raw bool, logger log.Logger) {
-	for p := range c {
-		if p.Dashboard.UID != "new" {
-			processPayload(cache, p, logger)
-		}
-		if sessionLog {
-			LogPayload(p, variableLog, logger, raw)
+// Redact applies the privacy Policy to the user identity fields of a JSON
+// encoded Payload, and returns the Payload encoded as JSON. The body is
+// returned unchanged if there is no Policy. An error is returned if the body
+// is not a Payload, since it cannot be redacted.
+func (h *Handler) Redact(body []byte) ([]byte, error) {
+	h.mu.RLock()
+	policy := h.config.Policy
+	h.mu.RUnlock()
+
+	if policy == nil {
+		return body, nil
+	}
+
+	p := Payload{}
+	err := json.Unmarshal(body, &p)
+	if err != nil {
+		return nil, err
+	}
+	pseudonymize(&p, policy)
+
+	return json.Marshal(p)
+}
+
+// startProcessor starts a receiver for the Payload channel. Observers receive
+// the Payload as it was stored in the cache, including the session state.
+func (h *Handler) startProcessor(cache *cacher.Cacher) {
+	for r := range h.ch {
+		if r.expire != nil {
+			p, exists := endSession(cache, r.expire.uuid)
+			r.expire.result <- expireResult{p: p, exists: exists}
+			continue
 		}
+		h.process(cache, r.payload)
+	}
+}
+
+// process caches a Payload and notifies the observers.
+func (h *Handler) process(cache *cacher.Cacher, p Payload) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	c := h.config
+	p.received = time.Now()
+	if c.Hosts != nil {
+		p.host = c.Hosts.Label(p.Host.Hostname, p.Host.Port, p.Host.Protocol)
+	}
+	if c.Policy != nil {
+		pseudonymize(&p, c.Policy)
+	}
+	if c.Sessions != nil {
+		p.policy = c.Sessions.Match(p)
+	}
+	sp := p
+	if p.Dashboard.UID != "new" {
+		sp = processPayload(cache, p, c.Classifier, h.logger)
+	}
+	for _, o := range c.Observers {
+		o.Observe(sp)
 	}
 }
 
-// processPayload is a receiver for Payloads.
-func processPayload(cache *cacher.Cacher, p Payload, logger log.Logger) {
+// pseudonymize applies the privacy Policy to the user identity fields.
+func pseudonymize(p *Payload, policy *privacy.Policy) {
+	p.User.ID = policy.ID(p.User.ID)
+	p.User.Login = policy.Login(p.User.Login)
+	p.User.Email = policy.Email(p.User.Email)
+	p.User.Name = policy.Name(p.User.Name)
+}
+
+// processPayload is a receiver for Payloads. It returns the Payload as it
+// was stored in the cache.
+func processPayload(cache *cacher.Cacher, p Payload, classifier SessionClassifier, logger log.Logger) Payload {
 	switch p.Type {
 	case "start":
-		addStart(cache, p)
+		return addStart(cache, p, classifier)
 	case "heartbeat":
-		addHeartbeat(cache, p)
+		return addHeartbeat(cache, p, classifier)
 	case "end":
-		addEnd(cache, p)
+		return addEnd(cache, p, classifier)
 	default:
-		addHeartbeat(cache, p)
 		_ = level.Warn(logger).Log(
 			"msg", "Session has invalid type, defaulted to heartbeat",
 			"uuid", p.UUID,
 			"type", p.Type,
 		)
+		return addHeartbeat(cache, p, classifier)
 	}
 }
 
 // LogPayload writes a log describing the Payload.
-func LogPayload(p Payload, logVars bool, logger log.Logger, raw bool) {
+func LogPayload(p Payload, logVars bool, logger log.Logger, raw bool) error {
 	if !logVars {
 		p.Variables = p.Variables[:0]
 	}
 
 	if raw {
-		level.Info(logger).Log("msg", "Received session data", "data", p)
-		return
+		return level.Info(logger).Log("msg", "Received session data", "data", p)
 	}
 
 	h := p.Host
@@ -112,7 +287,7 @@ func LogPayload(p Payload, logVars bool, logger log.Logger, raw bool) {
 		"uuid", p.UUID,
 		"type", p.Type,
 		"has_focus", p.HasFocus,
-		"host", fmt.Sprintf("%s//%s:%s", h.Protocol, h.Hostname, h.Port),
+		"host", p.HostLabel(),
 		"build", fmt.Sprintf("(commit=%s, edition=%s, env=%s, version=%s)", bi.Commit, bi.Edition, bi.Env, bi.Version),
 		"license", fmt.Sprintf("(state=%s, expiry=%d, license=%t)", li.StateInfo, li.Expiry, li.HasLicense),
 		"dashboard_name", p.Dashboard.Name,
@@ -143,5 +318,5 @@ func LogPayload(p Payload, logVars bool, logger log.Logger, raw bool) {
 		labels = append(labels, v.Name, d)
 	}
 
-	_ = level.Info(logger).Log(labels...)
+	return level.Info(logger).Log(labels...)
 }
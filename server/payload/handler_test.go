@@ -2,12 +2,16 @@ package payload_test
 
 import (
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/hosts"
 	"github.com/MacroPower/macropower-analytics-panel/server/payload"
 	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/MacroPower/macropower-analytics-panel/server/privacy"
+	"github.com/MacroPower/macropower-analytics-panel/server/sink"
 	"github.com/go-kit/kit/log"
 )
 
@@ -15,10 +19,17 @@ var (
 	logBuffer = payloadtest.SafeBuffer{}
 	logger    = log.NewJSONLogger(log.NewSyncWriter(&logBuffer))
 	cache     = cacher.NewCache()
+	metrics   = sink.NewMetrics()
 )
 
+func newObservers() []payload.Observer {
+	return []payload.Observer{
+		sink.NewBuffered(sink.NewStdout(logger, true, true), 10, 0, metrics, logger),
+	}
+}
+
 func newTestServer() *httptest.Server {
-	handler := payload.NewHandler(cache, 10, true, true, true, logger)
+	handler := payload.NewHandler(cache, 10, nil, newObservers(), logger)
 	testserver := httptest.NewServer(handler)
 
 	return testserver
@@ -80,21 +91,21 @@ func TestPayloadHeartbeat(t *testing.T) {
 	heartbeatInterval := 3600
 
 	request = payloadtest.GetPayload(t)
-	request.UUID = "test"
+	request.UUID = "heartbeat"
 	request.Type = "heartbeat"
 	request.Time = 1600000001
 	request.Options.HeartbeatInterval = heartbeatInterval
 	payloadtest.SendPayload(t, testserver.URL, request)
 
 	request = payloadtest.GetPayload(t)
-	request.UUID = "test"
+	request.UUID = "heartbeat"
 	request.Type = "heartbeat"
 	request.Time = 1600000000
 	request.Options.HeartbeatInterval = heartbeatInterval
 	payloadtest.SendPayload(t, testserver.URL, request)
 
 	request = payloadtest.GetPayload(t)
-	request.UUID = "test"
+	request.UUID = "heartbeat"
 	request.Type = "heartbeat"
 	request.Time = 1600007200
 	request.Options.HeartbeatInterval = heartbeatInterval
@@ -102,7 +113,7 @@ func TestPayloadHeartbeat(t *testing.T) {
 
 	time.Sleep(100 * time.Millisecond)
 
-	p1, exists := cache.Get("test")
+	p1, exists := cache.Get("heartbeat")
 	if !exists {
 		t.Fatal("Expected cache to contain item for payload")
 	}
@@ -124,3 +135,290 @@ func TestPayloadHeartbeat(t *testing.T) {
 	t.Log(logBuffer.String())
 	logBuffer.Reset()
 }
+
+func TestPayloadPrivacy(t *testing.T) {
+	policy, err := privacy.NewPolicy("secret", privacy.Hash, privacy.Hash, privacy.Drop, privacy.Keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateCache := cacher.NewCache()
+	handler := payload.NewHandler(privateCache, 10, policy, newObservers(), logger)
+	testserver := httptest.NewServer(handler)
+	defer testserver.Close()
+
+	request := payloadtest.GetPayload(t)
+	request.UUID = "test"
+	request.Type = "start"
+	payloadtest.SendPayload(t, testserver.URL, request)
+	time.Sleep(100 * time.Millisecond)
+
+	p1, exists := privateCache.Get("test")
+	if !exists {
+		t.Fatal("Expected cache to contain item for payload")
+	}
+	p := p1.(payload.Payload)
+	if p.User.Login != policy.Login(request.User.Login) {
+		t.Errorf("Expected the login '%s', got '%s'", policy.Login(request.User.Login), p.User.Login)
+	}
+	if p.User.ID != policy.ID(request.User.ID) {
+		t.Errorf("Expected the ID '%d', got '%d'", policy.ID(request.User.ID), p.User.ID)
+	}
+	if p.User.Email != "" {
+		t.Errorf("Expected the email to be dropped, got '%s'", p.User.Email)
+	}
+	if p.User.Name != request.User.Name {
+		t.Errorf("Expected the name '%s', got '%s'", request.User.Name, p.User.Name)
+	}
+
+	logs := logBuffer.String()
+	if strings.Contains(logs, request.User.Email) {
+		t.Errorf("Expected logs to not contain '%s', got:\n%s", request.User.Email, logs)
+	}
+	logBuffer.Reset()
+}
+
+func TestPayloadState(t *testing.T) {
+	testserver := newTestServer()
+	defer testserver.Close()
+
+	var request payload.Payload
+
+	request = payloadtest.GetPayload(t)
+	request.UUID = "state"
+	request.Type = "start"
+	request.Time = 1600000000
+	payloadtest.SendPayload(t, testserver.URL, request)
+
+	request.Type = "heartbeat"
+	request.Time = 1600000060
+	request.HasFocus = false
+	payloadtest.SendPayload(t, testserver.URL, request)
+
+	time.Sleep(100 * time.Millisecond)
+
+	p1, exists := cache.Get("state")
+	if !exists {
+		t.Fatal("Expected cache to contain item for payload")
+	}
+	codec := payload.StateCodec{}
+	data, err := codec.Marshal(p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := codec.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := p1.(payload.Payload)
+	actual := p2.(payload.Payload)
+	if expected.GetDuration(0) != actual.GetDuration(0) || expected.GetFocusedDuration(0) != actual.GetFocusedDuration(0) {
+		t.Errorf("Expected restored durations to match, got '%s' and '%s'", actual.GetDuration(0), actual.GetFocusedDuration(0))
+	}
+	if expected.Interactions() != actual.Interactions() || len(expected.Views()) != len(actual.Views()) {
+		t.Errorf("Expected '%d' restored views, got '%d'", len(expected.Views()), len(actual.Views()))
+	}
+	if !expected.LastSeen().Equal(actual.LastSeen()) {
+		t.Errorf("Expected the last seen time '%s', got '%s'", expected.LastSeen(), actual.LastSeen())
+	}
+
+	// Version 1 did not include the kind, so sessions are interactive.
+	p3, err := codec.Unmarshal([]byte(`{"version":1,"payload":{"uuid":"state"},"startTime":"2021-04-20T12:00:00Z","endTime":"2021-04-20T12:05:00Z"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p3 := p3.(payload.Payload); p3.Kind() != payload.KindInteractive || !p3.KindFinal() {
+		t.Errorf("Expected a version 1 session to be final '%s', got '%s'", payload.KindInteractive, p3.Kind())
+	}
+
+	_, err = payload.State{Version: payload.StateVersion + 1}.Restore()
+	if err == nil {
+		t.Error("Expected an error for an unsupported state version")
+	}
+
+	t.Log(logBuffer.String())
+	logBuffer.Reset()
+}
+
+func TestHandlerReconfigure(t *testing.T) {
+	before := &payloadtest.Recorder{}
+	after := &payloadtest.Recorder{}
+	handler := payload.NewHandler(cacher.NewCache(), 10, nil, []payload.Observer{before}, logger)
+
+	request := payloadtest.GetPayload(t)
+	request.UUID = "test"
+	request.Type = "start"
+	handler.Send(request)
+
+	policy, err := privacy.NewPolicy("secret", privacy.Keep, privacy.Drop, privacy.Keep, privacy.Keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.Reconfigure(payload.HandlerConfig{Policy: policy, Observers: []payload.Observer{after}})
+
+	request.Type = "end"
+	handler.Send(request)
+	handler.Close()
+
+	// The first payload may have been processed before or after Reconfigure,
+	// but every payload is processed exactly once.
+	b, a := before.Payloads(), after.Payloads()
+	if len(b)+len(a) != 2 || len(a) == 0 {
+		t.Fatalf("Expected '%d' payloads, got '%d' before and '%d' after", 2, len(b), len(a))
+	}
+	last := a[len(a)-1]
+	if last.Type != "end" || last.User.Login != "" {
+		t.Errorf("Expected the new policy to be applied, got type '%s' and login '%s'", last.Type, last.User.Login)
+	}
+}
+
+func TestHandlerEndSession(t *testing.T) {
+	cache := cacher.NewCache()
+	handler := payload.NewHandler(cache, 10, nil, nil, logger)
+
+	request := payloadtest.GetPayload(t)
+	request.UUID = "test"
+	request.Type = "start"
+	request.Time = 1600000000
+	handler.Send(request)
+	request.Type = "heartbeat"
+	request.Time = 1600000060
+	handler.Send(request)
+
+	p, exists := handler.EndSession("test")
+	if !exists {
+		t.Fatal("Expected the session to be ended")
+	}
+	if expected, actual := time.Minute, p.GetDuration(time.Duration(0)); expected != actual {
+		t.Errorf("Expected the duration '%s', got '%s'", expected, actual)
+	}
+	if _, exists := handler.EndSession("unknown"); exists {
+		t.Error("Expected an unknown session not to exist")
+	}
+
+	// Later payloads of the ended session are ignored.
+	request.Time = 1600000600
+	handler.Send(request)
+	request.Type = "end"
+	request.Time = 1600000900
+	handler.Send(request)
+	handler.Close()
+
+	cp, exists := cache.Get("test")
+	if !exists {
+		t.Fatal("Expected cache to contain item for payload")
+	}
+	if expected, actual := time.Minute, cp.(payload.Payload).GetDuration(time.Duration(0)); expected != actual {
+		t.Errorf("Expected the duration '%s', got '%s'", expected, actual)
+	}
+
+	// Requests after the Handler is closed are dropped.
+	handler.Send(request)
+	if _, exists := handler.EndSession("test"); exists {
+		t.Error("Expected no session to be ended after closing")
+	}
+	handler.Close()
+}
+
+type sessionPolicies payload.SessionPolicy
+
+func (s sessionPolicies) Match(p payload.Payload) payload.SessionPolicy {
+	return payload.SessionPolicy(s)
+}
+
+func TestHandlerSessionPolicy(t *testing.T) {
+	cache := cacher.NewCache()
+	handler := payload.NewHandler(cache, 10, nil, nil, logger)
+	handler.Reconfigure(payload.HandlerConfig{
+		Sessions: sessionPolicies{
+			Timeout:     10 * time.Minute,
+			FocusedOnly: true,
+			MaxDuration: 15 * time.Minute,
+		},
+	})
+
+	request := payloadtest.GetPayload(t)
+	request.UUID = "policy"
+	request.HasFocus = true
+	for i, typ := range []string{"start", "heartbeat", "heartbeat", "heartbeat"} {
+		request.Type = typ
+		request.Time = 1600000000 + i*30*60
+		// The time leading up to the second heartbeat is unfocused.
+		request.HasFocus = i != 2
+		handler.Send(request)
+	}
+	handler.Close()
+
+	p1, exists := cache.Get("policy")
+	if !exists {
+		t.Fatal("Expected cache to contain item for payload")
+	}
+	p := p1.(payload.Payload)
+
+	// Two focused gaps of 30m are capped by the timeout, and then by the
+	// maximum duration.
+	expected := 15 * time.Minute
+	if actual := p.GetDuration(time.Hour); actual != expected {
+		t.Errorf("Expected the duration '%s', got '%s'", expected, actual)
+	}
+	if actual := p.GetFocusedDuration(time.Hour); actual != expected {
+		t.Errorf("Expected the focused duration '%s', got '%s'", expected, actual)
+	}
+
+	codec := payload.StateCodec{}
+	data, err := codec.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := codec.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := p2.(payload.Payload).SessionPolicy(); actual != p.SessionPolicy() {
+		t.Errorf("Expected the restored policy '%+v', got '%+v'", p.SessionPolicy(), actual)
+	}
+}
+
+func TestHandlerHosts(t *testing.T) {
+	cache := cacher.NewCache()
+	recorder := &payloadtest.Recorder{}
+	handler := payload.NewHandler(cache, 10, nil, nil, logger)
+	handler.Reconfigure(payload.HandlerConfig{
+		Hosts:     hosts.NewNormalizer(map[string]string{"grafana.corp": "grafana.example.com"}),
+		Observers: []payload.Observer{recorder},
+	})
+
+	request := payloadtest.GetPayload(t)
+	request.UUID = "hosts"
+	request.Type = "start"
+	request.Host.Hostname = "Grafana.corp"
+	request.Host.Port = ""
+	request.Host.Protocol = "https:"
+	handler.Send(request)
+	handler.Close()
+
+	expected := "grafana.example.com"
+	observed := recorder.Payloads()
+	if len(observed) != 1 || observed[0].HostLabel() != expected {
+		t.Fatalf("Expected the host '%s', got %+v", expected, observed)
+	}
+
+	codec := payload.StateCodec{}
+	data, err := codec.Marshal(observed[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := codec.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := p.(payload.Payload).HostLabel(); actual != expected {
+		t.Errorf("Expected the restored host '%s', got '%s'", expected, actual)
+	}
+
+	// Payloads which were not received by a Handler are only normalized.
+	if actual := request.HostLabel(); actual != "grafana.corp" {
+		t.Errorf("Expected the host '%s', got '%s'", "grafana.corp", actual)
+	}
+}
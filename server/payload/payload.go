@@ -1,10 +1,16 @@
 package payload
 
 import (
+	"errors"
+	"fmt"
+	"reflect"
 	"sort"
 	"time"
+	"unicode"
+	"unsafe"
 
 	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/hosts"
 )
 
 // Payload is the body expected on /write.
@@ -77,47 +83,320 @@ type Payload struct {
 	startTime      time.Time
 	heartbeatTimes []time.Time
 	endTime        time.Time
+	blurTimes      []time.Time
+	policy         SessionPolicy
+	views          []View
+	kind           string
+	kindPending    bool
+	host           string
+	// received is when the latest Payload of the session was received.
+	received time.Time
+}
+
+// View is a distinct state of the time range and variables of a dashboard
+// during a session.
+type View struct {
+	// Time is the time of the first Payload with this state.
+	Time    time.Time `json:"time"`
+	RawFrom string    `json:"rawFrom"`
+	RawTo   string    `json:"rawTo"`
+	// Variables are the values of each variable.
+	Variables map[string][]string `json:"variables"`
+}
+
+// newView returns the View of a Payload.
+func newView(p Payload) View {
+	v := View{
+		Time:      time.Unix(int64(p.Time), 0),
+		RawFrom:   p.TimeRange.Raw.From,
+		RawTo:     p.TimeRange.Raw.To,
+		Variables: make(map[string][]string, len(p.Variables)),
+	}
+	for _, variable := range p.Variables {
+		values := make([]string, len(variable.Values))
+		for i, value := range variable.Values {
+			values[i] = fmt.Sprint(value)
+		}
+		v.Variables[variable.Name] = values
+	}
+
+	return v
+}
+
+// sameState returns true if the time range and variables of the Views are
+// equal.
+func (v View) sameState(o View) bool {
+	return v.RawFrom == o.RawFrom && v.RawTo == o.RawTo && reflect.DeepEqual(v.Variables, o.Variables)
+}
+
+// Kinds of sessions.
+const (
+	// KindInteractive is a session of a user viewing a dashboard.
+	KindInteractive = "interactive"
+	// KindKiosk is a session of a dashboard left open on a wallboard or TV.
+	KindKiosk = "kiosk"
+)
+
+// SessionClassifier returns the kind of the session of a Payload, and whether
+// it is final. Once the kind of a session is final, the session is not
+// classified again.
+type SessionClassifier interface {
+	Classify(p Payload) (kind string, final bool)
+}
+
+// SessionPolicy controls how the duration of a session is calculated.
+type SessionPolicy struct {
+	// Timeout is the maximum duration that may be added between events. If
+	// 0, the timeout passed to GetDuration is used.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// FocusedOnly only counts the time leading up to events that were sent
+	// with focus towards the duration.
+	FocusedOnly bool `json:"focusedOnly,omitempty"`
+	// MaxDuration is the maximum duration of the session. 0 = unlimited.
+	MaxDuration time.Duration `json:"maxDuration,omitempty"`
+}
+
+// SessionPolicies selects the SessionPolicy of a Payload.
+type SessionPolicies interface {
+	Match(p Payload) SessionPolicy
+}
+
+// Event is a single event in a session.
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	HasFocus bool      `json:"hasFocus"`
 }
 
 // addStart sets the payload StartTime and adds it to the cache.
-func addStart(cache *cacher.Cacher, p Payload) {
+func addStart(cache *cacher.Cacher, p Payload, classifier SessionClassifier) Payload {
 	ts := time.Unix(int64(p.Time), 0)
 	p.startTime = ts
-	cache.Add(p.UUID, p, cacher.Expiration)
+	p.addBlur(ts)
+	p.addView(nil)
+	p.classify(classifier)
+	err := cache.Add(p.UUID, p, cacher.Expiration)
+	if err != nil {
+		// The session already exists, so it is left unchanged.
+		if cp, exists := cache.Get(p.UUID); exists {
+			return cp.(Payload)
+		}
+	}
+
+	return p
 }
 
-// addHeartbeat sets the payload HeartbeatTime and sets it in the cache.
-func addHeartbeat(cache *cacher.Cacher, p Payload) {
+// addHeartbeat sets the payload HeartbeatTime and sets it in the cache. If the
+// session has ended, it is left unchanged.
+func addHeartbeat(cache *cacher.Cacher, p Payload, classifier SessionClassifier) Payload {
 	ts := time.Unix(int64(p.Time), 0)
 
 	cp, exists := cache.Get(p.UUID)
+	if exists && cp.(Payload).ended() {
+		return p.withState(cp.(Payload))
+	}
 	if exists {
 		p1 := cp.(Payload)
 		p.heartbeatTimes = append(p1.heartbeatTimes, ts)
 		p.startTime = p1.startTime
+		p.blurTimes = p1.blurTimes
+		p.inheritKind(p1)
+		p.addView(p1.views)
 	} else {
 		p.heartbeatTimes = []time.Time{ts}
 		p.startTime = ts
+		p.addView(nil)
 	}
+	p.addBlur(ts)
+	p.classify(classifier)
 
 	cache.Set(p.UUID, p, cacher.Expiration)
+
+	return p
 }
 
-// addEnd sets the payload EndTime and sets it in the cache.
-func addEnd(cache *cacher.Cacher, p Payload) {
+// addEnd sets the payload EndTime and sets it in the cache. If the session has
+// already ended, it is left unchanged.
+func addEnd(cache *cacher.Cacher, p Payload, classifier SessionClassifier) Payload {
 	ts := time.Unix(int64(p.Time), 0)
 	p.endTime = ts
 
 	cp, exists := cache.Get(p.UUID)
+	if exists && cp.(Payload).ended() {
+		return p.withState(cp.(Payload))
+	}
 	if exists {
 		p1 := cp.(Payload)
 		p.heartbeatTimes = p1.heartbeatTimes
 		p.startTime = p1.startTime
+		p.blurTimes = p1.blurTimes
+		p.inheritKind(p1)
+		p.addView(p1.views)
 	} else {
 		p.startTime = ts
+		p.addView(nil)
 	}
+	p.addBlur(ts)
+	p.classify(classifier)
 
 	cache.Set(p.UUID, p, cacher.Expiration)
+
+	return p
+}
+
+// endSession ends a cached session at the time it was last seen, so that no
+// further duration is inferred for it, and its kind is final. It returns false
+// if the session does not exist.
+func endSession(cache *cacher.Cacher, uuid string) (Payload, bool) {
+	cp, exists := cache.Get(uuid)
+	if !exists {
+		return Payload{}, false
+	}
+
+	p := cp.(Payload)
+	if !p.ended() {
+		p.endTime = p.LastSeen()
+		p.kindPending = false
+		cache.Set(p.UUID, p, cacher.Expiration)
+	}
+
+	return p, true
+}
+
+// Validate returns an error if the Payload does not have a UUID, which may only
+// contain printable characters other than spaces, or a known type. Outputs
+// which use the UUID as a key, e.g. in message headers, should only write
+// valid payloads.
+func (p Payload) Validate() error {
+	if p.UUID == "" {
+		return errors.New("payload has no uuid")
+	}
+	for _, r := range p.UUID {
+		if !unicode.IsPrint(r) || unicode.IsSpace(r) {
+			return fmt.Errorf("payload has invalid uuid %q", p.UUID)
+		}
+	}
+
+	switch p.Type {
+	case "start", "heartbeat", "end":
+		return nil
+	default:
+		return fmt.Errorf("payload has invalid type %q", p.Type)
+	}
+}
+
+// ended returns true if the session has ended.
+func (p Payload) ended() bool {
+	return !p.endTime.IsZero()
+}
+
+// withState returns the Payload with the session state of s.
+func (p Payload) withState(s Payload) Payload {
+	p.startTime = s.startTime
+	p.heartbeatTimes = s.heartbeatTimes
+	p.endTime = s.endTime
+	p.blurTimes = s.blurTimes
+	p.views = s.views
+	p.kind = s.kind
+	p.kindPending = s.kindPending
+
+	return p
+}
+
+// addBlur records ts as the time of an event without focus, if the payload
+// did not have focus.
+func (p *Payload) addBlur(ts time.Time) {
+	if !p.HasFocus {
+		p.blurTimes = append(p.blurTimes, ts)
+	}
+}
+
+// addView appends the View of the payload to the previous views of the
+// session, if the time range or variables were changed.
+func (p *Payload) addView(previous []View) {
+	v := newView(*p)
+	p.views = previous
+	if n := len(previous); n == 0 || !previous[n-1].sameState(v) {
+		p.views = append(previous, v)
+	}
+}
+
+// inheritKind sets the kind of the session to the kind of the previous Payload
+// p1. A pending kind becomes final if the session was idle when the Payload
+// was received, since it may already have been counted as interactive.
+func (p *Payload) inheritKind(p1 Payload) {
+	p.kind, p.kindPending = p1.kind, p1.kindPending
+	if p.kindPending && p1.idle(p.received) {
+		p.kindPending = false
+	}
+}
+
+// classify sets the kind of the session, unless it is final. If classifier is
+// nil, the session is interactive.
+func (p *Payload) classify(classifier SessionClassifier) {
+	if p.kind != "" && !p.kindPending {
+		return
+	}
+
+	p.kind, p.kindPending = KindInteractive, false
+	if classifier != nil {
+		var final bool
+		p.kind, final = classifier.Classify(*p)
+		p.kindPending = !final
+	}
+}
+
+// isBlurred returns true if the event at ts was sent without focus.
+func (p Payload) isBlurred(ts time.Time) bool {
+	for _, bt := range p.blurTimes {
+		if bt.Equal(ts) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Size returns the approximate number of bytes used by the Payload.
+func (p Payload) Size() int {
+	size := int(unsafe.Sizeof(p))
+	for _, v := range []string{
+		p.UUID, p.Type,
+		p.Host.Hostname, p.Host.Port, p.Host.Protocol,
+		p.Host.BuildInfo.Version, p.Host.BuildInfo.Commit, p.Host.BuildInfo.Env, p.Host.BuildInfo.Edition,
+		p.Host.LicenseInfo.StateInfo,
+		p.Dashboard.Name, p.Dashboard.UID,
+		p.User.Login, p.User.Email, p.User.Name, p.User.OrgName, p.User.OrgRole, p.User.Timezone, p.User.Locale,
+		p.TimeRange.Raw.From, p.TimeRange.Raw.To,
+		p.TimeZone, p.host,
+	} {
+		size += len(v)
+	}
+
+	for _, v := range p.Variables {
+		size += int(unsafe.Sizeof(v)) + len(v.Name) + len(v.Label) + len(v.Type)
+		for _, value := range v.Values {
+			size += int(unsafe.Sizeof(value))
+			if s, ok := value.(string); ok {
+				size += len(s)
+			}
+		}
+	}
+
+	for _, v := range p.views {
+		size += int(unsafe.Sizeof(v)) + len(v.RawFrom) + len(v.RawTo)
+		for name, values := range v.Variables {
+			size += len(name) + int(unsafe.Sizeof(values))
+			for _, value := range values {
+				size += int(unsafe.Sizeof(value)) + len(value)
+			}
+		}
+	}
+
+	timeSize := int(unsafe.Sizeof(time.Time{}))
+	size += (cap(p.heartbeatTimes) + cap(p.blurTimes)) * timeSize
+
+	return size
 }
 
 // IsTimeSet returns a bool for each time element representing the set status.
@@ -129,13 +408,158 @@ func (p Payload) IsTimeSet() (start bool, heartbeat bool, end bool) {
 	return start, heartbeat, end
 }
 
+// Events returns the events of the session, ordered by time.
+func (p Payload) Events() []Event {
+	startSet, _, endSet := p.IsTimeSet()
+
+	events := make([]Event, 0, len(p.heartbeatTimes)+2)
+	if startSet {
+		events = append(events, Event{Type: "start", Time: p.startTime, HasFocus: !p.isBlurred(p.startTime)})
+	}
+	for _, hb := range p.heartbeatTimes {
+		events = append(events, Event{Type: "heartbeat", Time: hb, HasFocus: !p.isBlurred(hb)})
+	}
+	if endSet {
+		events = append(events, Event{Type: "end", Time: p.endTime, HasFocus: !p.isBlurred(p.endTime)})
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+
+	return events
+}
+
+// LastSeen returns the time of the most recent event in the session.
+func (p Payload) LastSeen() time.Time {
+	last := p.startTime
+	for _, hb := range p.heartbeatTimes {
+		if hb.After(last) {
+			last = hb
+		}
+	}
+	if p.endTime.After(last) {
+		last = p.endTime
+	}
+
+	return last
+}
+
 // GetDuration returns the calculated duration of the session.
 func (p Payload) GetDuration(max time.Duration) time.Duration {
+	duration, _ := p.getDurations(max)
+	return duration
+}
+
+// GetFocusedDuration returns the calculated duration of the session, only
+// counting the time leading up to events that were sent with focus.
+func (p Payload) GetFocusedDuration(max time.Duration) time.Duration {
+	_, focused := p.getDurations(max)
+	return focused
+}
+
+// HostLabel returns the canonical label of the Grafana host, e.g.
+// localhost:3000, which may be an alias set when the Payload was received.
+func (p Payload) HostLabel() string {
+	if p.host != "" {
+		return p.host
+	}
+	return hosts.Normalize(p.Host.Hostname, p.Host.Port, p.Host.Protocol)
+}
+
+// Views returns the distinct states of the time range and variables during the
+// session, in the order they were seen.
+func (p Payload) Views() []View {
+	return p.views
+}
+
+// Interactions returns the number of times the time range or variables were
+// changed during the session.
+func (p Payload) Interactions() int {
+	if len(p.views) == 0 {
+		return 0
+	}
+	return len(p.views) - 1
+}
+
+// Interacted returns true if the time range or variables of the session were
+// changed.
+func (p Payload) Interacted() bool {
+	return p.Interactions() > 0
+}
+
+// Kind returns the kind of the session, e.g. KindInteractive.
+func (p Payload) Kind() string {
+	if p.kind == "" {
+		return KindInteractive
+	}
+	return p.kind
+}
+
+// KindFinal returns true if the kind of the session can no longer change.
+// Sessions should only be counted by kind once KindFinalAt is true, so that
+// they are not moved between series.
+func (p Payload) KindFinal() bool {
+	return !p.kindPending
+}
+
+// KindFinalAt returns true if the kind of the session is final, or if it is
+// pending but the session is idle at now. An idle session stopped sending
+// heartbeats before it could become a kiosk session, so it remains
+// interactive.
+func (p Payload) KindFinalAt(now time.Time) bool {
+	return !p.kindPending || p.idle(now)
+}
+
+// idle returns true if no Payload of the session was received for longer than
+// its timeout, or if it has none, its heartbeat interval. The time payloads
+// were received is used rather than the time they were sent, so that clients
+// with a skewed clock and replayed sessions are not idle.
+func (p Payload) idle(now time.Time) bool {
+	timeout := p.policy.Timeout
+	if timeout == 0 {
+		interval := time.Duration(p.Options.HeartbeatInterval) * time.Second
+		timeout = interval + interval/4
+	}
+
+	return now.Sub(p.received) > timeout
+}
+
+// SessionPolicy returns the SessionPolicy of the session.
+func (p Payload) SessionPolicy() SessionPolicy {
+	return p.policy
+}
+
+// getDurations returns the total and focused duration of the session,
+// according to its SessionPolicy.
+func (p Payload) getDurations(max time.Duration) (time.Duration, time.Duration) {
+	if p.policy.Timeout != 0 {
+		max = p.policy.Timeout
+	}
+
+	duration, focused := p.sumDurations(max)
+	if p.policy.FocusedOnly {
+		duration = focused
+	}
+	if limit := p.policy.MaxDuration; limit > 0 {
+		if duration > limit {
+			duration = limit
+		}
+		if focused > limit {
+			focused = limit
+		}
+	}
+
+	return duration, focused
+}
+
+// sumDurations returns the total and focused duration of the session, adding
+// at most max between events.
+func (p Payload) sumDurations(max time.Duration) (time.Duration, time.Duration) {
 	zeroDuration := time.Duration(0)
 
 	startSet, hbSet, endSet := p.IsTimeSet()
 	if !startSet {
-		return zeroDuration
+		return zeroDuration, zeroDuration
 	}
 
 	if hbSet {
@@ -155,25 +579,31 @@ func (p Payload) GetDuration(max time.Duration) time.Duration {
 		})
 
 		duration := zeroDuration
+		focused := zeroDuration
 		for i, hb := range hbs[1:] {
 			durationDiff := hb.Sub(hbs[i])
-			if durationDiff < max {
-				duration += durationDiff
-			} else {
-				duration += max
+			if durationDiff > max {
+				durationDiff = max
+			}
+			duration += durationDiff
+			if !p.isBlurred(hb) {
+				focused += durationDiff
 			}
 		}
-		return duration
+		return duration, focused
 	}
 
 	if !endSet {
-		return zeroDuration
+		return zeroDuration, zeroDuration
 	}
 
 	totalTime := p.endTime.Sub(p.startTime)
-	if max == zeroDuration || totalTime < max {
-		return totalTime
+	if max != zeroDuration && totalTime > max {
+		totalTime = max
+	}
+	if p.isBlurred(p.endTime) {
+		return totalTime, zeroDuration
 	}
 
-	return max
+	return totalTime, totalTime
 }
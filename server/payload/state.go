@@ -0,0 +1,97 @@
+package payload
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// StateVersion is the current version of the State format. Version 1 did not
+// include the session policy, views, kind, host and receive time, which are
+// restored empty.
+const StateVersion = 2
+
+// State is the serializable form of a Payload, including its session state.
+type State struct {
+	Version        int         `json:"version"`
+	Payload        Payload     `json:"payload"`
+	StartTime      time.Time   `json:"startTime"`
+	HeartbeatTimes []time.Time `json:"heartbeatTimes"`
+	EndTime        time.Time   `json:"endTime"`
+	BlurTimes      []time.Time `json:"blurTimes"`
+	// Policy and the following fields were added in version 2.
+	Policy      SessionPolicy `json:"policy"`
+	Views       []View        `json:"views"`
+	Kind        string        `json:"kind"`
+	KindPending bool          `json:"kindPending"`
+	Host        string        `json:"host"`
+	Received    time.Time     `json:"received"`
+}
+
+// State returns the State of the Payload.
+func (p Payload) State() State {
+	return State{
+		Version:        StateVersion,
+		Payload:        p,
+		StartTime:      p.startTime,
+		HeartbeatTimes: p.heartbeatTimes,
+		EndTime:        p.endTime,
+		BlurTimes:      p.blurTimes,
+		Policy:         p.policy,
+		Views:          p.views,
+		Kind:           p.kind,
+		KindPending:    p.kindPending,
+		Host:           p.host,
+		Received:       p.received,
+	}
+}
+
+// Restore returns the Payload described by the State. Sessions restored from
+// version 1 are interactive, since they may have ended and would not be
+// classified again, and may already have been counted as interactive.
+func (s State) Restore() (Payload, error) {
+	if s.Version < 1 || s.Version > StateVersion {
+		return Payload{}, fmt.Errorf("unsupported state version %d", s.Version)
+	}
+
+	p := s.Payload
+	p.startTime = s.StartTime
+	p.heartbeatTimes = s.HeartbeatTimes
+	p.endTime = s.EndTime
+	p.blurTimes = s.BlurTimes
+	p.policy = s.Policy
+	p.views = s.Views
+	p.kind = s.Kind
+	p.kindPending = s.KindPending
+	p.host = s.Host
+	p.received = s.Received
+	if s.Version == 1 {
+		p.kind, p.kindPending = KindInteractive, false
+	}
+
+	return p, nil
+}
+
+// StateCodec encodes cached Payloads as JSON States.
+type StateCodec struct{}
+
+// Marshal encodes a Payload.
+func (StateCodec) Marshal(v interface{}) ([]byte, error) {
+	p, ok := v.(Payload)
+	if !ok {
+		return nil, fmt.Errorf("unexpected type %T", v)
+	}
+
+	return json.Marshal(p.State())
+}
+
+// Unmarshal decodes a Payload.
+func (StateCodec) Unmarshal(data []byte) (interface{}, error) {
+	var s State
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Restore()
+}
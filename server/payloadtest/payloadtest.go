@@ -2,25 +2,18 @@ package payloadtest
 
 import (
 	"bytes"
+	_ "embed"
 	"encoding/json"
-	"errors"
 	"io/ioutil"
 	"net/http"
-	"path"
-	"runtime"
 	"sync"
 	"testing"
 
 	"github.com/MacroPower/macropower-analytics-panel/server/payload"
 )
 
-func getCallerDir() (string, error) {
-	_, filename, _, ok := runtime.Caller(0)
-	if !ok {
-		return "", errors.New("Could not get the caller for payloadtest")
-	}
-	return path.Dir(filename), nil
-}
+//go:embed testdata/payload.json
+var examplePayload []byte
 
 // SafeBuffer is a concurrency-safe bytes.Buffer
 type SafeBuffer struct {
@@ -49,19 +42,15 @@ func (s *SafeBuffer) String() string {
 	return s.buffer.String()
 }
 
-// GetPayload returns an example Payload to be used for testing
-func GetPayload(t *testing.T) (p payload.Payload) {
-	callerDir, err := getCallerDir()
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	file, err := ioutil.ReadFile(callerDir + "/testdata/payload.json")
-	if err != nil {
-		t.Fatal(err)
-	}
+// Example returns an example Payload, as sent by the panel
+func Example() (p payload.Payload, err error) {
+	err = json.Unmarshal(examplePayload, &p)
+	return p, err
+}
 
-	err = json.Unmarshal([]byte(file), &p)
+// GetPayload returns an example Payload to be used for testing
+func GetPayload(t *testing.T) payload.Payload {
+	p, err := Example()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -91,3 +80,25 @@ func SendPayload(t *testing.T, url string, p payload.Payload) {
 		t.Errorf("Expected the message '%s'\n", expected)
 	}
 }
+
+// Recorder is a payload.Observer which records all observed payloads
+type Recorder struct {
+	payloads []payload.Payload
+	mutex    sync.Mutex
+}
+
+// Observe records p
+func (r *Recorder) Observe(p payload.Payload) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.payloads = append(r.payloads, p)
+}
+
+// Payloads returns all recorded payloads
+func (r *Recorder) Payloads() []payload.Payload {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	payloads := make([]payload.Payload, len(r.payloads))
+	copy(payloads, r.payloads)
+	return payloads
+}
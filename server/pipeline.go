@@ -0,0 +1,489 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/api"
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/collector"
+	"github.com/MacroPower/macropower-analytics-panel/server/config"
+	"github.com/MacroPower/macropower-analytics-panel/server/hostinfo"
+	"github.com/MacroPower/macropower-analytics-panel/server/hosts"
+	"github.com/MacroPower/macropower-analytics-panel/server/influx"
+	"github.com/MacroPower/macropower-analytics-panel/server/journey"
+	"github.com/MacroPower/macropower-analytics-panel/server/otlp"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/privacy"
+	"github.com/MacroPower/macropower-analytics-panel/server/publish"
+	"github.com/MacroPower/macropower-analytics-panel/server/session"
+	"github.com/MacroPower/macropower-analytics-panel/server/sink"
+	"github.com/MacroPower/macropower-analytics-panel/server/store"
+	"github.com/MacroPower/macropower-analytics-panel/server/unique"
+	"github.com/MacroPower/macropower-analytics-panel/server/webhook"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// pipeline processes payloads, and passes them to all enabled observers. The
+// privacy and session policies and sinks can be replaced while it is running.
+type pipeline struct {
+	cache        *cacher.Cacher
+	handler      *payload.Handler
+	snapshotter  *cacher.Snapshotter
+	remoteWriter *collector.RemoteWriter
+	otlpMetrics  *otlp.MetricExporter
+	sinkMetrics  *sink.Metrics
+	webhooks     *webhook.History
+	// observers are the observers which are not replaced by load.
+	observers []payload.Observer
+
+	loadMu sync.Mutex
+	mu     sync.Mutex
+	sinks  []*pipelineSink
+	mux    *http.ServeMux
+}
+
+// newPipeline creates a pipeline configured by c, and registers its metrics
+// with registerer. The file may be nil.
+func newPipeline(c *flags, file *config.File, registerer prometheus.Registerer, logger log.Logger) (*pipeline, error) {
+	p := &pipeline{
+		cache:       cacher.NewCache(),
+		sinkMetrics: sink.NewMetrics(),
+		webhooks:    webhook.NewHistory(),
+	}
+	if c.SnapshotPath != "" {
+		p.snapshotter = cacher.NewSnapshotter(p.cache, c.SnapshotPath, payload.StateCodec{}, logger)
+		err := p.snapshotter.Restore()
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to restore cache snapshot", "err", err)
+		}
+		// The dashboards of restored sessions were already viewed.
+		for _, item := range p.cache.Items() {
+			if session, ok := item.Object.(payload.Payload); ok {
+				p.webhooks.MarkSeen(session)
+			}
+		}
+		go cacher.StartSnapshotter(p.snapshotter, c.SnapshotInterval, logger)
+	}
+	if c.MaxCacheSize != 0 {
+		go cacher.StartFlusher(p.cache, c.MaxCacheSize, logger)
+	}
+
+	uniqueUsers := unique.NewCounter()
+	hostInfo := hostinfo.NewCollector()
+	p.observers = []payload.Observer{uniqueUsers, hostInfo}
+
+	if c.JourneyMaxGap > 0 {
+		journeys := journey.NewTracker(c.JourneyMaxGap)
+		p.observers = append(p.observers, journeys)
+		registerer.MustRegister(journeys)
+	}
+
+	if c.RemoteWriteURL != "" {
+		client := &http.Client{Timeout: 30 * time.Second}
+		p.remoteWriter = collector.NewRemoteWriter(c.RemoteWriteURL, c.RemoteWriteBearerToken, c.RemoteWriteLabels, c.SessionTimeout, !c.DisableUserMetrics, client)
+		p.observers = append(p.observers, p.remoteWriter)
+		registerer.MustRegister(p.remoteWriter)
+		go collector.StartRemoteWriter(p.remoteWriter, c.RemoteWriteInterval, logger)
+	}
+
+	p.handler = payload.NewHandler(p.cache, 10, nil, p.observers, logger)
+	err := p.load(c, file, logger)
+	if err != nil {
+		p.handler.Close()
+		return nil, err
+	}
+
+	metricExporter := collector.NewExporter(p.cache, c.SessionTimeout, !c.DisableUserMetrics, logger)
+	registerer.MustRegister(metricExporter, uniqueUsers, hostInfo, p.sinkMetrics)
+
+	if c.OTLPMetrics {
+		client, err := newOTLPClient(c)
+		if err != nil {
+			return nil, err
+		}
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(metricExporter)
+		p.otlpMetrics, err = otlp.NewMetricExporter(client, registry, otlp.Temporality(c.OTLPMetricsTemporality))
+		if err != nil {
+			return nil, err
+		}
+		go otlp.StartMetricExporter(p.otlpMetrics, c.OTLPMetricsInterval, logger)
+	}
+
+	return p, nil
+}
+
+// load creates the handler configuration and sinks configured by c, and
+// replaces the current ones. Sinks whose configuration is unchanged are kept.
+// If the new ones cannot be created, the current ones are kept. Queued
+// payloads are passed to the new sinks, and the previous sinks are closed once
+// no payload is being passed to them.
+func (p *pipeline) load(c *flags, file *config.File, logger log.Logger) error {
+	p.loadMu.Lock()
+	defer p.loadMu.Unlock()
+
+	policy, err := privacy.NewPolicy(
+		c.PrivacySecret,
+		privacy.Mode(c.PrivacyUserID),
+		privacy.Mode(c.PrivacyUserLogin),
+		privacy.Mode(c.PrivacyUserEmail),
+		privacy.Mode(c.PrivacyUserName),
+	)
+	if err != nil {
+		return err
+	}
+	if !policy.Enabled() {
+		policy = nil
+	}
+
+	sessions, err := newSessionPolicies(c, file)
+	if err != nil {
+		return err
+	}
+
+	specs, err := sinkSpecs(c, file, p.webhooks, logger)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	current := p.sinks
+	p.mu.Unlock()
+	sinks, unused, err := openSinks(specs, current, c.SinkBufferSize, p.sinkMetrics, logger)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	observers := append([]payload.Observer{}, p.observers...)
+	for _, s := range sinks {
+		observers = append(observers, s.buffered)
+		if s.route != "" {
+			mux.Handle(s.route, s.sink.(http.Handler))
+		}
+	}
+	config := payload.HandlerConfig{
+		Policy:    policy,
+		Hosts:     hosts.NewNormalizer(c.HostAliases),
+		Sessions:  sessions,
+		Observers: observers,
+	}
+	if c.KioskMinDuration > 0 || len(c.KioskUsers) > 0 || len(c.KioskHosts) > 0 {
+		config.Classifier = session.NewClassifier(c.KioskMinDuration, c.KioskUsers, c.KioskHosts)
+	}
+	p.handler.Reconfigure(config)
+
+	p.mu.Lock()
+	p.sinks = sinks
+	p.mux = mux
+	p.mu.Unlock()
+
+	closeSinks(unused, logger)
+	return nil
+}
+
+// sessionStore returns the current SQL sink, or nil if sessions are not
+// stored.
+func (p *pipeline) sessionStore() api.SessionStore {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, s := range p.sinks {
+		if sql, ok := s.sink.(*store.SQL); ok {
+			return sql
+		}
+	}
+
+	return nil
+}
+
+// ServeHTTP serves the routes of the current sinks.
+func (p *pipeline) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	mux := p.mux
+	p.mu.Unlock()
+
+	mux.ServeHTTP(w, r)
+}
+
+// close waits for queued payloads to be processed, flushes all observers, and
+// takes a final snapshot.
+func (p *pipeline) close(logger log.Logger) error {
+	p.handler.Close()
+
+	p.mu.Lock()
+	closeSinks(p.sinks, logger)
+	p.sinks = nil
+	p.mu.Unlock()
+
+	if p.remoteWriter != nil {
+		err := p.remoteWriter.Flush()
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to send samples to remote write", "err", err)
+		}
+	}
+
+	if p.otlpMetrics != nil {
+		err := p.otlpMetrics.Export()
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to export otlp metrics", "err", err)
+		}
+	}
+
+	if p.snapshotter != nil {
+		return p.snapshotter.Snapshot()
+	}
+
+	return nil
+}
+
+// closeSinks closes all sinks, logging any errors.
+func closeSinks(sinks []*pipelineSink, logger log.Logger) {
+	for _, s := range sinks {
+		err := s.buffered.Close()
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to close sink", "err", err)
+		}
+	}
+}
+
+// sinkSpec describes an enabled sink.
+type sinkSpec struct {
+	// config holds the values used to create the sink. A sink is kept when
+	// the configuration is reloaded, if its config is unchanged.
+	config        []interface{}
+	flushInterval time.Duration
+	// route is the path the sink is served on, if it is an http.Handler.
+	route string
+	// blocking is true if payloads must not be dropped when the buffer of the
+	// sink is full.
+	blocking bool
+	create   func() (sink.Sink, error)
+}
+
+// pipelineSink is a sink created by the pipeline.
+type pipelineSink struct {
+	key      string
+	route    string
+	sink     sink.Sink
+	buffered *sink.Buffered
+}
+
+// sinkSpecs returns the sinks enabled by c. Sent webhook events are recorded
+// in history.
+func sinkSpecs(c *flags, file *config.File, history *webhook.History, logger log.Logger) ([]sinkSpec, error) {
+	var specs []sinkSpec
+	add := func(config []interface{}, flushInterval time.Duration, create func() (sink.Sink, error)) {
+		specs = append(specs, sinkSpec{config: config, flushInterval: flushInterval, create: create})
+	}
+	variables := !c.DisableVariableLog
+
+	if !c.DisableSessionLog {
+		add([]interface{}{"stdout", variables, c.LogRaw}, 0, func() (sink.Sink, error) {
+			return sink.NewStdout(logger, variables, c.LogRaw), nil
+		})
+		specs[len(specs)-1].blocking = true
+	}
+
+	if c.SinkFilePath != "" {
+		add([]interface{}{"file", c.SinkFilePath, c.SinkFileMaxSize, c.SinkFileMaxBackups, variables, c.LogRaw}, 0, func() (sink.Sink, error) {
+			maxSize := int64(c.SinkFileMaxSize) * 1024 * 1024
+			return sink.NewFile(c.SinkFilePath, maxSize, c.SinkFileMaxBackups, variables, c.LogRaw)
+		})
+	}
+
+	if c.SinkSyslogAddress != "" {
+		add([]interface{}{"syslog", c.SinkSyslogNetwork, c.SinkSyslogAddress, c.SinkSyslogTag, variables, c.LogRaw}, 0, func() (sink.Sink, error) {
+			return sink.NewSyslog(c.SinkSyslogNetwork, c.SinkSyslogAddress, c.SinkSyslogTag, variables, c.LogRaw)
+		})
+	}
+
+	if c.SinkLokiURL != "" {
+		add([]interface{}{"loki", c.SinkLokiURL, c.SinkLokiLabels, c.SinkLokiBatchSize, variables}, c.SinkLokiBatchWait, func() (sink.Sink, error) {
+			client := &http.Client{Timeout: 30 * time.Second}
+			return sink.NewLoki(c.SinkLokiURL, c.SinkLokiLabels, c.SinkLokiBatchSize, variables, client), nil
+		})
+	}
+
+	if c.InfluxURL != "" {
+		add([]interface{}{"influx", c.InfluxURL, c.InfluxToken, c.InfluxBatchSize}, c.InfluxBatchWait, func() (sink.Sink, error) {
+			client := &http.Client{Timeout: 30 * time.Second}
+			encoder := influx.NewEncoder(c.SessionTimeout, !c.DisableUserMetrics)
+			return influx.NewWriter(c.InfluxURL, c.InfluxToken, c.InfluxBatchSize, encoder, client), nil
+		})
+	}
+
+	if c.InfluxPull {
+		add([]interface{}{"influx_pull", c.InfluxPullMaxSize}, 0, func() (sink.Sink, error) {
+			encoder := influx.NewEncoder(c.SessionTimeout, !c.DisableUserMetrics)
+			return influx.NewBuffer(c.InfluxPullMaxSize*1024*1024, encoder), nil
+		})
+		specs[len(specs)-1].route = "/influx"
+	}
+
+	if c.PublishNATSURL != "" {
+		natsOptions := publish.NATSOptions{
+			CredentialsFile: c.PublishNATSCredentials,
+			NkeySeedFile:    c.PublishNATSNkeySeed,
+			RootCAFile:      c.PublishNATSRootCA,
+			Timeout:         10 * time.Second,
+		}
+		add([]interface{}{"nats", c.PublishNATSURL, natsOptions, c.PublishTopic, c.PublishRetries, c.PublishDeadLetterPath}, 0, func() (sink.Sink, error) {
+			publisher, err := publish.NewNATS(c.PublishNATSURL, natsOptions)
+			if err != nil {
+				return nil, err
+			}
+			s, err := publish.NewSink(publisher, c.PublishTopic, c.PublishRetries, 100*time.Millisecond, c.PublishDeadLetterPath)
+			if err != nil {
+				publisher.Close()
+				return nil, err
+			}
+			return s, nil
+		})
+	}
+
+	if c.SQLDSN != "" {
+		add([]interface{}{"sql", c.SQLDriver, c.SQLDSN, c.SQLSessionExpiry}, time.Minute, func() (sink.Sink, error) {
+			return store.NewSQL(c.SQLDriver, c.SQLDSN, c.SessionTimeout, c.SQLSessionExpiry)
+		})
+	}
+
+	var webhooks *webhook.Config
+	if file != nil {
+		webhooks = file.Webhooks
+	}
+	if c.WebhookConfig != "" {
+		if webhooks != nil {
+			return nil, errors.New("webhooks may be configured by webhook-config or the config file, but not both")
+		}
+		var err error
+		webhooks, err = webhook.LoadConfig(c.WebhookConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if webhooks != nil {
+		// The templates of a Config cannot be compared, so it is compared
+		// by its YAML.
+		key, err := yaml.Marshal(webhooks)
+		if err != nil {
+			return nil, err
+		}
+		add([]interface{}{"webhook", string(key)}, 0, func() (sink.Sink, error) {
+			client := &http.Client{Timeout: 30 * time.Second}
+			return webhook.NewSink(webhooks, c.SessionTimeout, history, client), nil
+		})
+	}
+
+	otlpConfig := []interface{}{c.OTLPEndpoint, c.OTLPProtocol, c.OTLPHeaders, c.OTLPBatchSize, variables}
+	if c.OTLPTraces {
+		add(append([]interface{}{"otlp_traces", c.OTLPSessionExpiry}, otlpConfig...), c.OTLPBatchWait, func() (sink.Sink, error) {
+			client, err := newOTLPClient(c)
+			if err != nil {
+				return nil, err
+			}
+			return otlp.NewTraceExporter(client, c.OTLPBatchSize, c.SessionTimeout, c.OTLPSessionExpiry, variables), nil
+		})
+	}
+	if c.OTLPLogs {
+		add(append([]interface{}{"otlp_logs"}, otlpConfig...), c.OTLPBatchWait, func() (sink.Sink, error) {
+			client, err := newOTLPClient(c)
+			if err != nil {
+				return nil, err
+			}
+			return otlp.NewLogExporter(client, c.OTLPBatchSize, variables), nil
+		})
+	}
+
+	return specs, nil
+}
+
+// openSinks returns the sinks described by specs. Current sinks with the same
+// config are reused, and the others are created. The current sinks which are
+// not reused are returned in unused. If a sink cannot be created, the sinks
+// which were already created are closed.
+func openSinks(specs []sinkSpec, current []*pipelineSink, bufferSize int, metrics *sink.Metrics, logger log.Logger) (sinks, unused []*pipelineSink, err error) {
+	reusable := make(map[string]*pipelineSink, len(current))
+	for _, s := range current {
+		reusable[s.key] = s
+	}
+	var created []*pipelineSink
+	defer func() {
+		if err != nil {
+			closeSinks(created, logger)
+		}
+	}()
+
+	for _, spec := range specs {
+		key := fmt.Sprintf("%#v %v %d", spec.config, spec.flushInterval, bufferSize)
+		if s, exists := reusable[key]; exists {
+			delete(reusable, key)
+			sinks = append(sinks, s)
+			continue
+		}
+
+		s, err := spec.create()
+		if err != nil {
+			return nil, nil, err
+		}
+		newBuffered := sink.NewBuffered
+		if spec.blocking {
+			newBuffered = sink.NewBlocking
+		}
+		ps := &pipelineSink{
+			key:      key,
+			route:    spec.route,
+			sink:     s,
+			buffered: newBuffered(s, bufferSize, spec.flushInterval, metrics, logger),
+		}
+		created = append(created, ps)
+		sinks = append(sinks, ps)
+	}
+
+	for _, s := range current {
+		if _, exists := reusable[s.key]; exists {
+			unused = append(unused, s)
+		}
+	}
+
+	return sinks, unused, nil
+}
+
+// newSessionPolicies returns the session policies configured by
+// --session-policy-config or the config file, or nil if there are none.
+func newSessionPolicies(c *flags, file *config.File) (payload.SessionPolicies, error) {
+	var sessions *session.Config
+	if file != nil {
+		sessions = file.SessionPolicies
+	}
+	if c.SessionPolicyConfig != "" {
+		if sessions != nil {
+			return nil, errors.New("session policies may be configured by session-policy-config or the config file, but not both")
+		}
+		var err error
+		sessions, err = session.LoadConfig(c.SessionPolicyConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sessions == nil {
+		return nil, nil
+	}
+
+	return sessions, nil
+}
+
+// newOTLPClient creates a client for the OTLP endpoint.
+func newOTLPClient(c *flags) (*otlp.Client, error) {
+	if c.OTLPEndpoint == "" {
+		return nil, errors.New("otlp-endpoint is required to export traces, logs or metrics")
+	}
+
+	return otlp.NewClient(c.OTLPEndpoint, otlp.Protocol(c.OTLPProtocol), c.OTLPHeaders, 30*time.Second)
+}
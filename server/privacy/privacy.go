@@ -0,0 +1,144 @@
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Mode describes how an identity field is handled.
+type Mode string
+
+const (
+	// Keep leaves the field unchanged.
+	Keep Mode = "keep"
+	// Hash replaces the field with a keyed hash.
+	Hash Mode = "hash"
+	// Drop removes the field.
+	Drop Mode = "drop"
+	// TruncateDomain keeps only the domain of an email address.
+	TruncateDomain Mode = "truncate-domain"
+)
+
+// hashLength is the number of bytes of the HMAC that are kept in string hashes.
+const hashLength = 8
+
+// maxID keeps hashed IDs within the range of integers that JavaScript, and
+// therefore most JSON consumers, can represent exactly.
+const maxID = 1<<53 - 1
+
+// Policy pseudonymizes user identity fields.
+type Policy struct {
+	secret []byte
+
+	id    Mode
+	login Mode
+	email Mode
+	name  Mode
+}
+
+// NewPolicy creates a Policy. A secret is required if any field is hashed.
+func NewPolicy(secret string, id, login, email, name Mode) (*Policy, error) {
+	for field, mode := range map[string]Mode{"id": id, "login": login, "name": name} {
+		if err := validate(mode, false); err != nil {
+			return nil, fmt.Errorf("invalid mode for user %s: %w", field, err)
+		}
+	}
+	if err := validate(email, true); err != nil {
+		return nil, fmt.Errorf("invalid mode for user email: %w", err)
+	}
+
+	hashed := id == Hash || login == Hash || email == Hash || name == Hash
+	if hashed && secret == "" {
+		return nil, errors.New("a secret is required to hash user fields")
+	}
+
+	return &Policy{
+		secret: []byte(secret),
+		id:     id,
+		login:  login,
+		email:  email,
+		name:   name,
+	}, nil
+}
+
+func validate(mode Mode, email bool) error {
+	switch mode {
+	case Keep, Hash, Drop:
+		return nil
+	case TruncateDomain:
+		if email {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unsupported mode '%s'", mode)
+}
+
+// Enabled returns true if the Policy changes any field.
+func (pol *Policy) Enabled() bool {
+	return pol.id != Keep || pol.login != Keep || pol.email != Keep || pol.name != Keep
+}
+
+// ID applies the Policy to a user ID.
+func (pol *Policy) ID(id int) int {
+	if id == 0 {
+		return id
+	}
+
+	switch pol.id {
+	case Hash:
+		sum := pol.sum(fmt.Sprint(id))
+		return int(binary.BigEndian.Uint64(sum) & maxID)
+	case Drop:
+		return 0
+	}
+
+	return id
+}
+
+// Login applies the Policy to a user login.
+func (pol *Policy) Login(login string) string {
+	return pol.apply(pol.login, login)
+}
+
+// Email applies the Policy to a user email.
+func (pol *Policy) Email(email string) string {
+	return pol.apply(pol.email, email)
+}
+
+// Name applies the Policy to a user name.
+func (pol *Policy) Name(name string) string {
+	return pol.apply(pol.name, name)
+}
+
+func (pol *Policy) apply(mode Mode, v string) string {
+	if v == "" {
+		return v
+	}
+
+	switch mode {
+	case Hash:
+		return hex.EncodeToString(pol.sum(v)[:hashLength])
+	case Drop:
+		return ""
+	case TruncateDomain:
+		i := strings.LastIndex(v, "@")
+		if i == -1 {
+			return ""
+		}
+		return v[i+1:]
+	}
+
+	return v
+}
+
+func (pol *Policy) sum(v string) []byte {
+	mac := hmac.New(sha256.New, pol.secret)
+	mac.Write([]byte(v))
+	return mac.Sum(nil)
+}
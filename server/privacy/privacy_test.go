@@ -0,0 +1,64 @@
+package privacy_test
+
+import (
+	"testing"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/privacy"
+)
+
+func TestPolicy(t *testing.T) {
+	policy, err := privacy.NewPolicy("secret", privacy.Hash, privacy.Hash, privacy.TruncateDomain, privacy.Drop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := policy.Login("admin")
+	if login == "admin" || len(login) != 16 {
+		t.Errorf("Expected a 16 character hash, got '%s'", login)
+	}
+	if login != policy.Login("admin") {
+		t.Error("Expected hashes to be stable")
+	}
+	if login == policy.Login("admin2") {
+		t.Error("Expected hashes of different values to differ")
+	}
+
+	id := policy.ID(1)
+	if id == 1 || id <= 0 {
+		t.Errorf("Expected a positive hashed ID, got '%d'", id)
+	}
+	if policy.ID(0) != 0 {
+		t.Error("Expected anonymous user ID to be kept")
+	}
+
+	if email := policy.Email("admin@localhost"); email != "localhost" {
+		t.Errorf("Expected the email domain 'localhost', got '%s'", email)
+	}
+	if name := policy.Name("admin"); name != "" {
+		t.Errorf("Expected the name to be dropped, got '%s'", name)
+	}
+}
+
+func TestPolicySecret(t *testing.T) {
+	other, err := privacy.NewPolicy("other", privacy.Keep, privacy.Hash, privacy.Keep, privacy.Keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := privacy.NewPolicy("secret", privacy.Keep, privacy.Hash, privacy.Keep, privacy.Keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Login("admin") == policy.Login("admin") {
+		t.Error("Expected hashes with different secrets to differ")
+	}
+
+	_, err = privacy.NewPolicy("", privacy.Keep, privacy.Hash, privacy.Keep, privacy.Keep)
+	if err == nil {
+		t.Error("Expected an error when hashing without a secret")
+	}
+
+	_, err = privacy.NewPolicy("secret", privacy.Keep, privacy.TruncateDomain, privacy.Keep, privacy.Keep)
+	if err == nil {
+		t.Error("Expected an error when truncating a non-email field")
+	}
+}
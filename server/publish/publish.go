@@ -0,0 +1,176 @@
+package publish
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+)
+
+// Message is a message published to a topic.
+type Message struct {
+	Topic string
+	// Key identifies the stream of related messages, i.e. the session UUID.
+	Key string
+	// ID uniquely identifies the message, so that retries can be deduplicated.
+	ID   string
+	Data []byte
+}
+
+// Publisher publishes messages to a message broker.
+type Publisher interface {
+	// Publish returns once the broker has received the Message.
+	Publish(m Message) error
+	// Close releases the connection to the broker.
+	Close() error
+}
+
+// Memory is an in-process Publisher, which holds all published messages.
+type Memory struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// Publish adds the Message.
+func (m *Memory) Publish(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns all published messages.
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages := make([]Message, len(m.messages))
+	copy(messages, m.messages)
+	return messages
+}
+
+// Close does nothing.
+func (m *Memory) Close() error {
+	return nil
+}
+
+// deadLetter is a line of the dead-letter file.
+type deadLetter struct {
+	Time    time.Time       `json:"time"`
+	Topic   string          `json:"topic"`
+	Key     string          `json:"key"`
+	ID      string          `json:"id"`
+	Error   string          `json:"error"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Sink is a Sink which publishes each payload as JSON, keyed by its UUID.
+// Payloads which could not be published are appended to a dead-letter file.
+type Sink struct {
+	publisher Publisher
+	topic     string
+	retries   int
+	backoff   time.Duration
+	dead      *os.File
+}
+
+// NewSink creates a new Sink. Failed publishes are retried up to retries
+// times, waiting twice as long as the previous attempt, starting at backoff.
+// If deadLetterPath is empty, payloads which could not be published are
+// dropped.
+func NewSink(publisher Publisher, topic string, retries int, backoff time.Duration, deadLetterPath string) (*Sink, error) {
+	s := &Sink{
+		publisher: publisher,
+		topic:     topic,
+		retries:   retries,
+		backoff:   backoff,
+	}
+
+	if deadLetterPath != "" {
+		f, err := os.OpenFile(deadLetterPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		s.dead = f
+	}
+
+	return s, nil
+}
+
+// Name returns the name of the Sink.
+func (s *Sink) Name() string {
+	return "publish"
+}
+
+// Write publishes the Payload. Payloads which are not valid are not
+// published.
+func (s *Sink) Write(p payload.Payload) error {
+	err := p.Validate()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		Topic: s.topic,
+		Key:   p.UUID,
+		// The number of events distinguishes payloads of the same type sent
+		// in the same second.
+		ID:   p.UUID + ":" + p.Type + ":" + strconv.Itoa(p.Time) + ":" + strconv.Itoa(len(p.Events())),
+		Data: data,
+	}
+
+	backoff := s.backoff
+	for attempt := 0; attempt <= s.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		err = s.publisher.Publish(msg)
+		if err == nil {
+			return nil
+		}
+	}
+
+	if s.dead != nil {
+		line, merr := json.Marshal(deadLetter{
+			Time:    time.Now().UTC(),
+			Topic:   msg.Topic,
+			Key:     msg.Key,
+			ID:      msg.ID,
+			Error:   err.Error(),
+			Payload: data,
+		})
+		if merr != nil {
+			return merr
+		}
+		_, werr := s.dead.Write(append(line, '\n'))
+		if werr != nil {
+			return fmt.Errorf("%v, and writing to the dead-letter file failed: %v", err, werr)
+		}
+	}
+
+	return err
+}
+
+// Close closes the Publisher and the dead-letter file.
+func (s *Sink) Close() error {
+	err := s.publisher.Close()
+	if s.dead != nil {
+		if derr := s.dead.Close(); err == nil {
+			err = derr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,293 @@
+package publish_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/MacroPower/macropower-analytics-panel/server/publish"
+	"github.com/go-kit/kit/log"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// startNATS starts an embedded NATS server with the authentication of opts,
+// listening on opts.Port if it is not 0.
+func startNATS(t *testing.T, opts server.Options) *server.Server {
+	t.Helper()
+
+	if opts.Port == 0 {
+		opts.Port = -1
+	}
+	opts.Host = "127.0.0.1"
+	opts.NoLog = true
+	opts.NoSigs = true
+	s, err := server.NewServer(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+	t.Cleanup(s.Shutdown)
+
+	return s
+}
+
+// subscribe subscribes to a subject of the server.
+func subscribe(t *testing.T, s *server.Server, subject string) *nats.Subscription {
+	t.Helper()
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	sub, err := nc.SubscribeSync(subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nc.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sub
+}
+
+func TestMemory(t *testing.T) {
+	m := &publish.Memory{}
+	s, err := publish.NewSink(m, "analytics", 0, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := payloadtest.GetPayload(t)
+	p.UUID = "test"
+	p.Type = "start"
+	err = s.Write(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := m.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(messages))
+	}
+	msg := messages[0]
+	if msg.Topic != "analytics" || msg.Key != "test" || msg.ID != fmt.Sprintf("test:%s:%d:0", p.Type, p.Time) {
+		t.Errorf("Unexpected message: %+v", msg)
+	}
+	if !strings.Contains(string(msg.Data), `"uuid":"test"`) {
+		t.Errorf("Expected the payload as JSON, got %s", msg.Data)
+	}
+
+	// Heartbeats sent in the same second have distinct IDs.
+	r := &payloadtest.Recorder{}
+	handler := payload.NewHandler(cacher.NewCache(), 10, nil, []payload.Observer{r}, log.NewNopLogger())
+	testserver := httptest.NewServer(handler)
+	defer testserver.Close()
+
+	p.Time = 1600000000
+	payloadtest.SendPayload(t, testserver.URL, p)
+	p.Type = "heartbeat"
+	p.Time = 1600000060
+	payloadtest.SendPayload(t, testserver.URL, p)
+	payloadtest.SendPayload(t, testserver.URL, p)
+	handler.Close()
+
+	for _, p := range r.Payloads() {
+		err = s.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages = m.Messages()
+	if len(messages) != 4 || messages[2].ID == messages[3].ID {
+		t.Errorf("Expected distinct heartbeat IDs, got %+v", messages)
+	}
+}
+
+func TestNATS(t *testing.T) {
+	s := startNATS(t, server.Options{})
+	sub := subscribe(t, s, "grafana.analytics")
+
+	n, err := publish.NewNATS(s.ClientURL(), publish.NATSOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := publish.NewSink(n, "grafana.analytics", 4, 100*time.Millisecond, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	p := payloadtest.GetPayload(t)
+	p.UUID = "test1"
+	p.Type = "start"
+	err = ps.Write(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Key") != "test1" || msg.Header.Get("Nats-Msg-Id") != fmt.Sprintf("test1:%s:%d:0", p.Type, p.Time) {
+		t.Errorf("Unexpected headers: %v", msg.Header)
+	}
+	if !strings.Contains(string(msg.Data), `"uuid":"test1"`) {
+		t.Errorf("Expected the payload as JSON, got %s", msg.Data)
+	}
+
+	// The closed connection is re-established while the publish is retried.
+	port := s.Addr().(*net.TCPAddr).Port
+	s.Shutdown()
+	s = startNATS(t, server.Options{Port: port})
+	sub = subscribe(t, s, "grafana.analytics")
+
+	p.UUID = "test2"
+	err = ps.Write(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Key") != "test2" {
+		t.Errorf("Unexpected headers: %v", msg.Header)
+	}
+
+	// Invalid payloads are not published.
+	p.UUID = "test3\r\nInjected: true"
+	err = ps.Write(p)
+	if err == nil {
+		t.Error("Expected an invalid UUID to be rejected")
+	}
+	_, err = sub.NextMsg(100 * time.Millisecond)
+	if err != nats.ErrTimeout {
+		t.Errorf("Expected no message, got err %v", err)
+	}
+
+	err = n.Publish(publish.Message{Topic: "grafana.analytics", Key: "a\r\nb", ID: "a", Data: []byte("{}")})
+	if err == nil {
+		t.Error("Expected a key containing CR/LF to be rejected")
+	}
+}
+
+func TestNATSAuth(t *testing.T) {
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := user.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := user.Seed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedPath := filepath.Join(t.TempDir(), "user.nk")
+	err = ioutil.WriteFile(seedPath, seed, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		opts    server.Options
+		url     func(s *server.Server) string
+		options publish.NATSOptions
+	}{
+		"token": {
+			opts: server.Options{Authorization: "secret"},
+			url: func(s *server.Server) string {
+				return fmt.Sprintf("nats://secret@%s", s.Addr())
+			},
+		},
+		"nkey": {
+			opts:    server.Options{Nkeys: []*server.NkeyUser{{Nkey: public}}},
+			url:     func(s *server.Server) string { return s.ClientURL() },
+			options: publish.NATSOptions{NkeySeedFile: seedPath},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := startNATS(t, tc.opts)
+
+			tc.options.Timeout = time.Second
+			n, err := publish.NewNATS(tc.url(s), tc.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer n.Close()
+
+			err = n.Publish(publish.Message{Topic: "analytics", Key: "a", ID: "a", Data: []byte("{}")})
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	ns := startNATS(t, server.Options{Users: []*server.User{{
+		Username: "grafana",
+		Password: "secret",
+		Permissions: &server.Permissions{
+			Publish: &server.SubjectPermission{Deny: []string{"analytics"}},
+		},
+	}}})
+
+	n, err := publish.NewNATS(fmt.Sprintf("nats://grafana:secret@%s", ns.Addr()), publish.NATSOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "dead.ndjson")
+	s, err := publish.NewSink(n, "analytics", 2, time.Millisecond, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := payloadtest.GetPayload(t)
+	p.UUID = "test"
+	p.Type = "start"
+	err = s.Write(p)
+	if err == nil {
+		t.Fatal("Expected the publish to fail")
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var line struct {
+		Key     string          `json:"key"`
+		Error   string          `json:"error"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	err = json.Unmarshal(b, &line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line.Key != "test" || !strings.Contains(line.Error, "Permissions Violation") || !strings.Contains(string(line.Payload), `"uuid":"test"`) {
+		t.Errorf("Unexpected dead letter: %s", b)
+	}
+}
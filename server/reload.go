@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/config"
+	"github.com/alecthomas/kong"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// configReloader reloads the flags and config file, and applies them to a
+// pipeline.
+type configReloader struct {
+	// args are the command line arguments.
+	args     []string
+	mu       sync.Mutex
+	current  *flags
+	pipeline *pipeline
+	logger   log.Logger
+}
+
+// Reload parses the command line and config file again, and applies flags
+// tagged with reload. If the configuration is invalid, the current one is kept.
+func (r *configReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, file, err := loadFlags(r.args)
+	if err == nil {
+		err = r.keepStatic(next)
+	}
+	if err == nil {
+		err = r.pipeline.load(next, file, r.logger)
+	}
+	if err != nil {
+		level.Error(r.logger).Log("msg", "Failed to reload configuration", "err", err)
+		return err
+	}
+
+	r.current = next
+	level.Info(r.logger).Log("msg", "Reloaded configuration")
+	return nil
+}
+
+// keepStatic resets flags which are not tagged with reload to their current
+// values, and logs a warning for any which were changed.
+func (r *configReloader) keepStatic(next *flags) error {
+	current, err := flagValues(r.current)
+	if err != nil {
+		return err
+	}
+	values, err := flagValues(next)
+	if err != nil {
+		return err
+	}
+
+	var changed []string
+	for name, v := range values {
+		if v.flag.Tag.Has("reload") {
+			continue
+		}
+		cur := current[name].value
+		if !reflect.DeepEqual(v.value.Interface(), cur.Interface()) {
+			changed = append(changed, name)
+			v.value.Set(cur)
+		}
+	}
+
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		level.Warn(r.logger).Log(
+			"msg", "Ignored changes to flags which require a restart",
+			"flags", strings.Join(changed, ","),
+		)
+	}
+
+	return nil
+}
+
+// flagValue is the value of a flag in a flags struct.
+type flagValue struct {
+	flag  *kong.Flag
+	value reflect.Value
+}
+
+// flagValues returns the global flags of c by name.
+func flagValues(c *flags) (map[string]flagValue, error) {
+	parser, err := kong.New(c, kongOptions()...)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]flagValue{}
+	for _, flag := range parser.Model.Flags {
+		values[flag.Name] = flagValue{flag: flag, value: flag.Target}
+	}
+
+	return values, nil
+}
+
+// loadFlags parses args into new flags, using values from the config file if
+// one is set. The config file may only contain known flags.
+func loadFlags(args []string) (*flags, *config.File, error) {
+	c := &flags{}
+	parser, err := kong.New(c, kongOptions()...)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = parser.Parse(args)
+	if err != nil || c.ConfigFile == "" {
+		return c, nil, err
+	}
+
+	file, err := config.Load(c.ConfigFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = file.Validate(parser.Model)
+	if err != nil {
+		return nil, nil, err
+	}
+	parser, err = kong.New(c, append(kongOptions(), kong.Resolvers(file))...)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = parser.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, file, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func writeConfig(t *testing.T, path string, content string) {
+	t.Helper()
+
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	first, second := filepath.Join(dir, "first.jsonl"), filepath.Join(dir, "second.jsonl")
+	writeConfig(t, path, `
+disable-session-log: true
+session-timeout: 1m
+sink-file-path: `+first+`
+`)
+
+	logs := &payloadtest.SafeBuffer{}
+	logger := log.NewLogfmtLogger(logs)
+	args := []string{"--config-file", path}
+	c, file, err := loadFlags(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newPipeline(c, file, prometheus.NewRegistry(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &configReloader{args: args, current: c, pipeline: p, logger: logger}
+
+	// Unchanged sinks are kept.
+	kept := p.sinks[0]
+	err = r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.sinks[0] != kept {
+		t.Error("Expected an unchanged sink to be kept")
+	}
+
+	// Flags tagged with reload are applied, and others are reset.
+	writeConfig(t, path, `
+disable-session-log: true
+session-timeout: 5m
+sink-file-path: `+second+`
+`)
+	err = r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.current.SinkFilePath != second {
+		t.Errorf("Expected sink-file-path %q, got %q", second, r.current.SinkFilePath)
+	}
+	if r.current.SessionTimeout != time.Minute {
+		t.Errorf("Expected session-timeout to be kept at 1m, got %s", r.current.SessionTimeout)
+	}
+	if !strings.Contains(logs.String(), `flags=session-timeout`) {
+		t.Errorf("Expected a warning about session-timeout, got %s", logs.String())
+	}
+	if len(p.sinks) != 1 || p.sinks[0] == kept {
+		t.Fatal("Expected the changed sink to be replaced")
+	}
+
+	// An invalid configuration is rejected, and the current one is kept.
+	current := p.sinks[0]
+	writeConfig(t, path, `
+disable-session-log: true
+sink-file-path: `+first+`
+privacy-user-id: invalid
+`)
+	err = r.Reload()
+	if err == nil {
+		t.Error("Expected an invalid configuration to be rejected")
+	}
+	if r.current.SinkFilePath != second || p.sinks[0] != current {
+		t.Error("Expected the current configuration to be kept")
+	}
+
+	// Unknown flags are rejected, e.g. misspelled ones.
+	writeConfig(t, path, `
+disable-session-log: true
+sink-file-pth: `+first+`
+`)
+	err = r.Reload()
+	if err == nil || !strings.Contains(err.Error(), "sink-file-pth") {
+		t.Errorf("Expected an unknown flag to be rejected, got %v", err)
+	}
+	if r.current.SinkFilePath != second || p.sinks[0] != current {
+		t.Error("Expected the current configuration to be kept")
+	}
+
+	p.handler.Send(payloadtest.GetPayload(t))
+	err = p.close(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"uuid"`) {
+		t.Errorf("Expected the payload to be written to %s, got %q", second, b)
+	}
+	b, err = ioutil.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 0 {
+		t.Errorf("Expected nothing to be written to %s, got %q", first, b)
+	}
+}
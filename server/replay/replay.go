@@ -0,0 +1,214 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/capture"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+)
+
+// maxLineSize is the maximum size of a line in a recording.
+const maxLineSize = 1024 * 1024
+
+// Record is a recorded payload.
+type Record struct {
+	// Time is when the payload was received.
+	Time time.Time
+	// Body is the payload as it was sent.
+	Body []byte
+}
+
+// Reader reads records from NDJSON. Each line is either a payload, a
+// capture.Record, or a log line of a payload written using --log-raw, which
+// contains it in the data field. Other log lines are skipped.
+type Reader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// NewReader creates a new Reader.
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	return &Reader{scanner: scanner}
+}
+
+// Next returns the next Record, or io.EOF once all records have been read.
+// Empty lines are skipped.
+func (r *Reader) Next() (Record, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var fields struct {
+			capture.Record
+			Msg  string          `json:"msg"`
+			Data json.RawMessage `json:"data"`
+			TS   time.Time       `json:"ts"`
+		}
+		err := json.Unmarshal(line, &fields)
+		if err != nil {
+			return Record{}, fmt.Errorf("line %d: %w", r.line, err)
+		}
+
+		if !fields.Received.IsZero() {
+			return Record{Time: fields.Received, Body: fields.Bytes()}, nil
+		}
+
+		if fields.Msg != "" && len(fields.Data) == 0 {
+			continue
+		}
+
+		rec := Record{Time: fields.TS}
+		if len(fields.Data) > 0 {
+			rec.Body = append([]byte{}, fields.Data...)
+		} else {
+			rec.Body = append([]byte{}, line...)
+		}
+
+		if rec.Time.IsZero() {
+			// Use the time the payload was sent instead.
+			var p struct {
+				Time int64 `json:"time"`
+			}
+			err = json.Unmarshal(rec.Body, &p)
+			if err != nil {
+				return Record{}, fmt.Errorf("line %d: %w", r.line, err)
+			}
+			rec.Time = time.Unix(p.Time, 0)
+		}
+
+		return rec, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return Record{}, err
+	}
+
+	return Record{}, io.EOF
+}
+
+// OpenFile opens a recording. Files with a .gz suffix are decompressed.
+func OpenFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &gzipFile{Reader: gz, file: f}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (f *gzipFile) Close() error {
+	err := f.Reader.Close()
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Target receives replayed payloads.
+type Target func(body []byte) error
+
+// NewHandlerTarget creates a Target which sends payloads to an in-process Handler.
+func NewHandlerTarget(h *payload.Handler) Target {
+	return func(body []byte) error {
+		var p payload.Payload
+		err := json.Unmarshal(body, &p)
+		if err != nil {
+			return err
+		}
+
+		h.Send(p)
+		return nil
+	}
+}
+
+// NewHTTPTarget creates a Target which sends payloads to a /write URL.
+func NewHTTPTarget(url string, client *http.Client) Target {
+	return func(body []byte) error {
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode/100 != 2 {
+			msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+			return fmt.Errorf("write returned status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+		}
+
+		return nil
+	}
+}
+
+// Result describes a replay.
+type Result struct {
+	Sent   int
+	Failed int
+}
+
+// Replay sends all records to the Target. Records are sent with their
+// recorded spacing divided by speed, e.g. 1 is real time, and 60 replays an
+// hour per minute. If speed is 0, records are sent as fast as possible. Records
+// which fail to send are passed to onError, and the replay continues.
+func Replay(r *Reader, target Target, speed float64, onError func(rec Record, err error)) (Result, error) {
+	var res Result
+	var first time.Time
+	start := time.Now()
+
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+
+		if speed > 0 {
+			if first.IsZero() {
+				first = rec.Time
+			}
+			offset := time.Duration(float64(rec.Time.Sub(first)) / speed)
+			if wait := time.Until(start.Add(offset)); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		err = target(rec.Body)
+		if err != nil {
+			res.Failed++
+			onError(rec, err)
+			continue
+		}
+		res.Sent++
+	}
+}
@@ -0,0 +1,181 @@
+package replay_test
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/capture"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/MacroPower/macropower-analytics-panel/server/replay"
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	logger = log.NewNopLogger()
+)
+
+// getRecording returns a recording of a session, with a log line between
+// each payload, as written using --log-raw.
+func getRecording(t *testing.T) string {
+	p := payloadtest.GetPayload(t)
+	p.UUID = "test"
+
+	var b strings.Builder
+	for i, typ := range []string{"start", "heartbeat", "end"} {
+		p.Type = typ
+		p.Time = 1600000000 + i
+		data, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			b.WriteString(`{"level":"info","msg":"Received session data","data":` + string(data) + "}\n")
+		} else {
+			b.Write(data)
+			b.WriteString("\n")
+		}
+		b.WriteString(`{"level":"info","msg":"Build context"}` + "\n\n")
+	}
+
+	return b.String()
+}
+
+func TestReader(t *testing.T) {
+	r := replay.NewReader(strings.NewReader(getRecording(t)))
+
+	var types []string
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var p payload.Payload
+		err = json.Unmarshal(rec.Body, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := time.Unix(int64(p.Time), 0); !rec.Time.Equal(expected) {
+			t.Errorf("Expected time '%s', got '%s'", expected, rec.Time)
+		}
+		types = append(types, p.Type)
+	}
+
+	if strings.Join(types, ",") != "start,heartbeat,end" {
+		t.Errorf("Unexpected records: %v", types)
+	}
+
+	_, err := replay.NewReader(strings.NewReader("{\n")).Next()
+	if err == nil {
+		t.Error("Expected an error for invalid JSON")
+	}
+}
+
+func TestReaderCapture(t *testing.T) {
+	body := "{\"uuid\": \"test\", \"time\": 1}"
+	line, err := json.Marshal(capture.Record{
+		Received:   time.Unix(1600000000, 0).UTC(),
+		RemoteAddr: "127.0.0.1:1234",
+		Body:       body,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "captures.ndjson.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write(append(line, '\n'))
+	gz.Close()
+	f.Close()
+
+	rc, err := replay.OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	rec, err := replay.NewReader(rc).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rec.Body) != body {
+		t.Errorf("Expected body %q, got %q", body, rec.Body)
+	}
+	if rec.Time.Unix() != 1600000000 {
+		t.Errorf("Expected the receive time, got '%s'", rec.Time)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	r := &payloadtest.Recorder{}
+	handler := payload.NewHandler(cacher.NewCache(), 10, nil, []payload.Observer{r}, logger)
+	testserver := httptest.NewServer(handler)
+	defer testserver.Close()
+
+	onError := func(rec replay.Record, err error) {
+		t.Errorf("Failed to replay: %v", err)
+	}
+
+	// The recording spans two seconds, which should take 100ms at speed 20.
+	start := time.Now()
+	target := replay.NewHTTPTarget(testserver.URL, testserver.Client())
+	res, err := replay.Replay(replay.NewReader(strings.NewReader(getRecording(t))), target, 20, onError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected the replay to take 100ms, took %s", elapsed)
+	}
+	if res.Sent != 3 || res.Failed != 0 {
+		t.Errorf("Unexpected result: %+v", res)
+	}
+
+	// In-process and instant.
+	res, err = replay.Replay(replay.NewReader(strings.NewReader(getRecording(t))), replay.NewHandlerTarget(handler), 0, onError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Sent != 3 {
+		t.Errorf("Unexpected result: %+v", res)
+	}
+	handler.Close()
+
+	payloads := r.Payloads()
+	if len(payloads) != 6 {
+		t.Fatalf("Expected '%d' payloads, got '%d'", 6, len(payloads))
+	}
+	if payloads[5].Type != "end" || payloads[5].UUID != "test" {
+		t.Errorf("Unexpected payload: %+v", payloads[5])
+	}
+
+	failing := func(body []byte) error {
+		return errors.New("failed")
+	}
+	var failed int
+	res, err = replay.Replay(replay.NewReader(strings.NewReader(getRecording(t))), failing, 0, func(rec replay.Record, err error) {
+		failed++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Failed != 3 || failed != 3 {
+		t.Errorf("Expected '%d' failures, got %+v", 3, res)
+	}
+}
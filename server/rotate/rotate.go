@@ -0,0 +1,265 @@
+package rotate
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timeFormat is the format of the timestamp added to rotated file names.
+const timeFormat = "2006-01-02T15-04-05.000"
+
+// Writer is an io.WriteCloser which writes to a file, and rotates it once it
+// exceeds a maximum size or age. Rotated files are renamed to include the time
+// of rotation, e.g. sessions-2021-04-20T12-00-00.000.log, and optionally gzip
+// compressed in the background, e.g. sessions-2021-04-20T12-00-00.000.log.gz.
+type Writer struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	// compressing serializes the compression of rotated files, which is done
+	// in the background so that writes are not blocked.
+	compressing sync.Mutex
+	wg          sync.WaitGroup
+	// compressErr is the first error of a background compression, returned by
+	// Close.
+	compressErr error
+}
+
+// NewWriter creates a new Writer. A maxSize or maxAge of 0 disables rotation
+// by size or age, and a maxBackups of 0 keeps all rotated files. The age of a
+// file is checked when it is written to, so an idle file is rotated by the
+// next write.
+func NewWriter(path string, maxSize int64, maxAge time.Duration, maxBackups int, compress bool) (*Writer, error) {
+	w := &Writer{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		compress:   compress,
+	}
+
+	err := w.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file = f
+	w.size = info.Size()
+	w.opened = time.Now()
+	if w.size > 0 {
+		// Existing files are as old as their first write, which is unknown.
+		w.opened = info.ModTime()
+	}
+	return nil
+}
+
+// Write writes p to the file, rotating it first if p would exceed the maximum
+// size, or if the file exceeds the maximum age.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	tooLarge := w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize
+	tooOld := w.maxAge > 0 && time.Since(w.opened) > w.maxAge
+	if w.size > 0 && (tooLarge || tooOld) {
+		err := w.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the file immediately.
+func (w *Writer) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.rotate()
+}
+
+func (w *Writer) rotate() error {
+	if w.file != nil {
+		err := w.file.Close()
+		w.file = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	backup := w.backupName(time.Now())
+	err := os.Rename(w.path, backup)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if !w.compress {
+		err = w.prune()
+		if err != nil {
+			return err
+		}
+	} else if err == nil {
+		// Rotated files are pruned once they are compressed, so that a file
+		// which is being compressed is not counted twice.
+		w.wg.Add(1)
+		go w.compressBackup(backup)
+	}
+
+	return w.open()
+}
+
+// compressBackup compresses a rotated file, and prunes the rotated files.
+func (w *Writer) compressBackup(backup string) {
+	defer w.wg.Done()
+
+	w.compressing.Lock()
+	defer w.compressing.Unlock()
+
+	err := compress(backup)
+	if err == nil {
+		err = w.prune()
+	}
+	if err != nil && w.compressErr == nil {
+		w.compressErr = err
+	}
+}
+
+// compress replaces a file with a gzip compressed copy, named with a .gz suffix.
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// backupName returns the name of a file rotated at t.
+func (w *Writer) backupName(t time.Time) string {
+	ext := filepath.Ext(w.path)
+	prefix := strings.TrimSuffix(w.path, ext)
+
+	return fmt.Sprintf("%s-%s%s", prefix, t.UTC().Format(timeFormat), ext)
+}
+
+// backups returns the names of all rotated files, oldest first.
+func (w *Writer) backups() ([]string, error) {
+	ext := filepath.Ext(w.path)
+	prefix := strings.TrimSuffix(w.path, ext)
+
+	matches, err := filepath.Glob(prefix + "-*" + ext + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, m := range matches {
+		ts := strings.TrimPrefix(m, prefix+"-")
+		if len(ts) < len(timeFormat) {
+			continue
+		}
+		if _, err := time.Parse(timeFormat, ts[:len(timeFormat)]); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	sort.Strings(backups)
+
+	return backups, nil
+}
+
+// prune removes the oldest rotated files beyond maxBackups.
+func (w *Writer) prune() error {
+	if w.maxBackups == 0 {
+		return nil
+	}
+
+	backups, err := w.backups()
+	if err != nil {
+		return err
+	}
+
+	for len(backups) > w.maxBackups {
+		err := os.Remove(backups[0])
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// Close closes the file, and waits for rotated files to be compressed.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var err error
+	if w.file != nil {
+		err = w.file.Close()
+		w.file = nil
+	}
+
+	w.wg.Wait()
+	if err == nil {
+		err = w.compressErr
+		w.compressErr = nil
+	}
+	return err
+}
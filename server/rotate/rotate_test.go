@@ -0,0 +1,102 @@
+package rotate_test
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/rotate"
+)
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sessions.log")
+
+	w, err := rotate.NewWriter(path, 10, 0, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 4; i++ {
+		_, err = w.Write([]byte("0123456789"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Ensure each rotated file has a distinct name.
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("Expected '%d' files, got '%d'", 3, len(files))
+	}
+	for _, f := range files {
+		if f.Name() != "sessions.log" && !strings.HasPrefix(f.Name(), "sessions-") {
+			t.Errorf("Unexpected file '%s'", f.Name())
+		}
+		if f.Size() != 10 {
+			t.Errorf("Expected file '%s' to contain '%d' bytes, got '%d'", f.Name(), 10, f.Size())
+		}
+	}
+}
+
+func TestRotateAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "captures.ndjson")
+
+	w, err := rotate.NewWriter(path, 0, 10*time.Millisecond, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"first\n", "second\n"} {
+		_, err = w.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Rotated files are compressed in the background, until Close.
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected '%d' files, got '%d'", 2, len(files))
+	}
+
+	backup := filepath.Join(dir, files[0].Name())
+	if !strings.HasPrefix(files[0].Name(), "captures-") || !strings.HasSuffix(backup, ".ndjson.gz") {
+		t.Fatalf("Unexpected file '%s'", files[0].Name())
+	}
+	f, err := os.Open(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first\n" {
+		t.Errorf("Expected the rotated file to contain %q, got %q", "first\n", data)
+	}
+}
@@ -0,0 +1,59 @@
+package session
+
+import (
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+)
+
+// Classifier detects kiosk sessions, e.g. wallboards or TVs, which are
+// always focused and may send heartbeats for days.
+type Classifier struct {
+	minDuration time.Duration
+	users       map[string]bool
+	hosts       map[string]bool
+}
+
+// NewClassifier creates a new Classifier. Sessions of the given users (logins)
+// or hosts (host labels, e.g. grafana.example.com or localhost:3000) are always
+// kiosk sessions. Other sessions are kiosk sessions once they have lasted
+// minDuration, if the panel always sends heartbeats (heartbeatAlways) and the
+// time range and variables have not been changed. If minDuration is 0, only
+// users and hosts are used.
+func NewClassifier(minDuration time.Duration, users []string, hosts []string) *Classifier {
+	return &Classifier{
+		minDuration: minDuration,
+		users:       set(users),
+		hosts:       set(hosts),
+	}
+}
+
+// Classify returns the kind of the session of the Payload, and whether it is
+// final. A session which may still become a kiosk session is interactive, but
+// its kind is not final until it either becomes a kiosk session or can no
+// longer become one.
+func (c *Classifier) Classify(p payload.Payload) (string, bool) {
+	if c.users[p.User.Login] || c.hosts[p.HostLabel()] {
+		return payload.KindKiosk, true
+	}
+
+	if c.minDuration == 0 || !p.Options.HeartbeatAlways || p.Interacted() {
+		return payload.KindInteractive, true
+	}
+
+	events := p.Events()
+	if len(events) > 0 && p.LastSeen().Sub(events[0].Time) >= c.minDuration {
+		return payload.KindKiosk, true
+	}
+	_, _, ended := p.IsTimeSet()
+
+	return payload.KindInteractive, ended
+}
+
+func set(values []string) map[string]bool {
+	m := make(map[string]bool, len(values))
+	for _, v := range values {
+		m[v] = true
+	}
+	return m
+}
@@ -0,0 +1,142 @@
+package session
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the session policy configuration file.
+type Config struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+// Rule selects the policy of matching sessions. All of the specified filters
+// must match. Regular expressions are anchored.
+type Rule struct {
+	Name string `yaml:"name"`
+	// DashboardUID is a regular expression matching the dashboard UID.
+	DashboardUID string `yaml:"dashboard_uid"`
+	// DashboardName is a regular expression matching the dashboard name.
+	DashboardName string `yaml:"dashboard_name"`
+	// Host is a regular expression matching the Grafana hostname and port,
+	// e.g. grafana.example.com:3000.
+	Host string `yaml:"host"`
+	// Roles are organization roles, e.g. Viewer, Editor or Admin.
+	Roles []string `yaml:"roles"`
+
+	// Timeout is the maximum duration that may be added between heartbeats.
+	// If 0, --session-timeout is used.
+	Timeout time.Duration `yaml:"timeout"`
+	// CountUnfocused counts time without focus towards the session duration.
+	// Defaults to true.
+	CountUnfocused *bool `yaml:"count_unfocused"`
+	// MaxDuration is the maximum duration of a session. 0 = unlimited.
+	MaxDuration time.Duration `yaml:"max_duration"`
+
+	dashboardUID  *regexp.Regexp
+	dashboardName *regexp.Regexp
+	host          *regexp.Regexp
+}
+
+// LoadConfig reads and validates a Config file.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseConfig(b)
+}
+
+// ParseConfig parses and validates a Config.
+func ParseConfig(b []byte) (*Config, error) {
+	c := &Config{}
+	err := yaml.UnmarshalStrict(b, c)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, r := range c.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if r.Timeout < 0 || r.MaxDuration < 0 {
+			return nil, fmt.Errorf("session rule %q has a negative duration", r.Name)
+		}
+
+		r.dashboardUID, err = compile(r.DashboardUID)
+		if err == nil {
+			r.dashboardName, err = compile(r.DashboardName)
+		}
+		if err == nil {
+			r.host, err = compile(r.Host)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("session rule %q has an invalid regular expression: %w", r.Name, err)
+		}
+	}
+
+	return c, nil
+}
+
+// compile compiles an anchored regular expression, or returns nil if expr is
+// empty.
+func compile(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// Match returns the policy of the first Rule matching the Payload, or the
+// default policy if none match.
+func (c *Config) Match(p payload.Payload) payload.SessionPolicy {
+	for _, r := range c.Rules {
+		if r.matches(p) {
+			return r.policy()
+		}
+	}
+
+	return payload.SessionPolicy{}
+}
+
+func (r *Rule) matches(p payload.Payload) bool {
+	if r.dashboardUID != nil && !r.dashboardUID.MatchString(p.Dashboard.UID) {
+		return false
+	}
+	if r.dashboardName != nil && !r.dashboardName.MatchString(p.Dashboard.Name) {
+		return false
+	}
+	if r.host != nil && !r.host.MatchString(p.HostLabel()) {
+		return false
+	}
+	if len(r.Roles) > 0 {
+		var found bool
+		for _, role := range r.Roles {
+			if strings.EqualFold(role, p.User.OrgRole) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *Rule) policy() payload.SessionPolicy {
+	return payload.SessionPolicy{
+		Timeout:     r.Timeout,
+		FocusedOnly: r.CountUnfocused != nil && !*r.CountUnfocused,
+		MaxDuration: r.MaxDuration,
+	}
+}
@@ -0,0 +1,209 @@
+package session_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/collector"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/MacroPower/macropower-analytics-panel/server/session"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const testConfig = `
+rules:
+  - name: wallboards
+    dashboard_name: "(?i).*wallboard.*"
+    timeout: 2h
+  - name: viewers
+    dashboard_uid: "ops-.*"
+    host: "grafana\\.example\\.com:.*"
+    roles: [viewer]
+    count_unfocused: false
+    max_duration: 8h
+`
+
+func TestMatch(t *testing.T) {
+	config, err := session.ParseConfig([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := payloadtest.GetPayload(t)
+	base.Dashboard.UID = "ops-overview"
+	base.Dashboard.Name = "Overview"
+	base.Host.Hostname = "grafana.example.com"
+	base.Host.Port = "3000"
+	base.User.OrgRole = "Viewer"
+
+	tests := map[string]struct {
+		modify   func(p *payload.Payload)
+		expected payload.SessionPolicy
+	}{
+		"all filters": {
+			modify:   func(p *payload.Payload) {},
+			expected: payload.SessionPolicy{FocusedOnly: true, MaxDuration: 8 * time.Hour},
+		},
+		"first match": {
+			modify:   func(p *payload.Payload) { p.Dashboard.Name = "NOC Wallboard" },
+			expected: payload.SessionPolicy{Timeout: 2 * time.Hour},
+		},
+		"anchored": {
+			modify: func(p *payload.Payload) { p.Dashboard.UID = "dev-ops-overview" },
+		},
+		"host": {
+			modify: func(p *payload.Payload) { p.Host.Hostname = "grafana.example.org" },
+		},
+		"role": {
+			modify: func(p *payload.Payload) { p.User.OrgRole = "Editor" },
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := base
+			tc.modify(&p)
+			if actual := config.Match(p); actual != tc.expected {
+				t.Errorf("Expected the policy '%+v', got '%+v'", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for name, config := range map[string]string{
+		"unknown key":    "rules:\n  - dashboard: foo\n",
+		"invalid regexp": "rules:\n  - dashboard_uid: \"(\"\n",
+		"negative":       "rules:\n  - timeout: -1m\n",
+	} {
+		if _, err := session.ParseConfig([]byte(config)); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	cache := cacher.NewCache()
+	handler := payload.NewHandler(cache, 10, nil, nil, log.NewNopLogger())
+	handler.Reconfigure(payload.HandlerConfig{Classifier: session.NewClassifier(time.Hour, []string{"tv"}, nil)})
+
+	send := func(uuid string, modify func(p *payload.Payload)) {
+		p := payloadtest.GetPayload(t)
+		p.UUID = uuid
+		p.User.Login = "viewer"
+		p.Options.HeartbeatAlways = true
+		for i, typ := range []string{"start", "heartbeat", "heartbeat"} {
+			p.Type = typ
+			p.Time = 1600000000 + i*45*60
+			if i == 2 {
+				modify(&p)
+			}
+			handler.Send(p)
+		}
+	}
+	send("kiosk", func(p *payload.Payload) {})
+	send("allowlist", func(p *payload.Payload) { p.User.Login = "tv"; p.Options.HeartbeatAlways = false })
+	send("time-range", func(p *payload.Payload) { p.TimeRange.Raw.From = "now-1h" })
+	send("variables", func(p *payload.Payload) { p.Variables = p.Variables[:0] })
+	send("focus", func(p *payload.Payload) { p.Options.HeartbeatAlways = false })
+	send("short", func(p *payload.Payload) { p.Time -= 45 * 60 })
+
+	// Kiosk sessions remain kiosk sessions after an interaction.
+	p := payloadtest.GetPayload(t)
+	p.UUID = "kiosk"
+	p.Type = "heartbeat"
+	p.Time = 1600000000 + 3*45*60
+	p.TimeRange.Raw.From = "now-1h"
+	handler.Send(p)
+	handler.Close()
+
+	for uuid, expected := range map[string]string{
+		"kiosk":      payload.KindKiosk,
+		"allowlist":  payload.KindKiosk,
+		"time-range": payload.KindInteractive,
+		"variables":  payload.KindInteractive,
+		"focus":      payload.KindInteractive,
+		"short":      payload.KindInteractive,
+	} {
+		cp, exists := cache.Get(uuid)
+		if !exists {
+			t.Fatalf("Expected cache to contain item for payload '%s'", uuid)
+		}
+		if actual := cp.(payload.Payload).Kind(); actual != expected {
+			t.Errorf("Expected session '%s' to be '%s', got '%s'", uuid, expected, actual)
+		}
+		// Only the short session may still become a kiosk session.
+		if expected, actual := uuid != "short", cp.(payload.Payload).KindFinal(); expected != actual {
+			t.Errorf("Expected the kind of session '%s' to be final '%t', got '%t'", uuid, expected, actual)
+		}
+	}
+}
+
+func TestClassifyIdle(t *testing.T) {
+	cache := cacher.NewCache()
+	handler := payload.NewHandler(cache, 10, nil, nil, log.NewNopLogger())
+	handler.Reconfigure(payload.HandlerConfig{Classifier: session.NewClassifier(time.Hour, nil, nil)})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector.NewExporter(cache, 0, false, log.NewNopLogger()))
+	// sessions returns the number of sessions counted by the exporter.
+	sessions := func() float64 {
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total float64
+		for _, mf := range mfs {
+			if mf.GetName() == "grafana_analytics_sessions_total" {
+				for _, m := range mf.GetMetric() {
+					total += m.GetCounter().GetValue()
+				}
+			}
+		}
+		return total
+	}
+
+	// A short kiosk session which never sends an end.
+	p := payloadtest.GetPayload(t)
+	p.UUID = "short"
+	p.Options.HeartbeatAlways = true
+	p.Options.HeartbeatInterval = 1
+	for i, typ := range []string{"start", "heartbeat"} {
+		p.Type = typ
+		p.Time = 1600000000 + i
+		handler.Send(p)
+	}
+	p.UUID = "expired"
+	p.Type = "start"
+	handler.Send(p)
+	if _, exists := handler.EndSession("expired"); !exists {
+		t.Fatal("Expected the session to exist")
+	}
+
+	cp, _ := cache.Get("short")
+	if cp.(payload.Payload).KindFinalAt(time.Now()) {
+		t.Error("Expected the kind of a recent session to be pending")
+	}
+	if n := sessions(); n != 1 {
+		t.Errorf("Expected '%d' counted sessions, got '%v'", 1, n)
+	}
+
+	// Once it is idle, the session is counted as interactive, and remains
+	// interactive even if it lasts long enough to be a kiosk session.
+	time.Sleep(1500 * time.Millisecond)
+	if n := sessions(); n != 2 {
+		t.Errorf("Expected '%d' counted sessions, got '%v'", 2, n)
+	}
+
+	p.UUID = "short"
+	p.Type = "heartbeat"
+	p.Time = 1600000000 + 2*60*60
+	handler.Send(p)
+	handler.Close()
+
+	cp, _ = cache.Get("short")
+	if actual := cp.(payload.Payload); actual.Kind() != payload.KindInteractive || !actual.KindFinal() {
+		t.Errorf("Expected the session to remain interactive, got '%s'", actual.Kind())
+	}
+}
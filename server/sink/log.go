@@ -0,0 +1,76 @@
+package sink
+
+import (
+	"io"
+	"os"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/rotate"
+	"github.com/go-kit/kit/log"
+)
+
+// Log is a Sink which writes payloads to a Logger using payload.LogPayload.
+type Log struct {
+	name    string
+	logger  log.Logger
+	logVars bool
+	raw     bool
+	closer  io.Closer
+}
+
+// NewLog creates a new Log Sink. If closer is not nil, it is closed with the Sink.
+func NewLog(name string, logger log.Logger, logVars bool, raw bool, closer io.Closer) *Log {
+	return &Log{
+		name:    name,
+		logger:  logger,
+		logVars: logVars,
+		raw:     raw,
+		closer:  closer,
+	}
+}
+
+// NewStdout creates a Log Sink which writes to the server log.
+func NewStdout(logger log.Logger, logVars bool, raw bool) *Log {
+	return NewLog("stdout", logger, logVars, raw, nil)
+}
+
+// NewFile creates a Log Sink which writes JSON lines to a file, rotating it
+// once it exceeds maxSize bytes.
+func NewFile(path string, maxSize int64, maxBackups int, logVars bool, raw bool) (*Log, error) {
+	w, err := rotate.NewWriter(path, maxSize, 0, maxBackups, false)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := log.NewJSONLogger(w)
+	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+
+	return NewLog("file", logger, logVars, raw, w), nil
+}
+
+// Name returns the name of the Sink.
+func (l *Log) Name() string {
+	return l.name
+}
+
+// Write logs the Payload.
+func (l *Log) Write(p payload.Payload) error {
+	return payload.LogPayload(p, l.logVars, l.logger, l.raw)
+}
+
+// Close closes the underlying writer, if any.
+func (l *Log) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// hostname returns the hostname reported in outputs which require one.
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil || h == "" {
+		return "-"
+	}
+	return h
+}
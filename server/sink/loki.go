@@ -0,0 +1,140 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/go-kit/kit/log"
+)
+
+// lokiStream is a stream in the Loki push API.
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// Loki is a Sink which sends logfmt lines to the Loki push API in batches.
+// Each batch is grouped into streams by Grafana host. Lines are timestamped
+// with the time the payload was sent, and ordered by it within each stream.
+type Loki struct {
+	url       string
+	labels    map[string]string
+	batchSize int
+	logVars   bool
+	client    *http.Client
+
+	streams map[string]*lokiStream
+	pending int
+}
+
+// NewLoki creates a new Loki Sink. The batch is sent once it contains
+// batchSize lines, or when it is flushed.
+func NewLoki(url string, labels map[string]string, batchSize int, logVars bool, client *http.Client) *Loki {
+	return &Loki{
+		url:       url,
+		labels:    labels,
+		batchSize: batchSize,
+		logVars:   logVars,
+		client:    client,
+		streams:   make(map[string]*lokiStream),
+	}
+}
+
+// Name returns the name of the Sink.
+func (l *Loki) Name() string {
+	return "loki"
+}
+
+// Write adds the Payload to the batch, and sends the batch if it is full.
+func (l *Loki) Write(p payload.Payload) error {
+	var line bytes.Buffer
+	err := payload.LogPayload(p, l.logVars, log.NewLogfmtLogger(&line), false)
+	if err != nil {
+		return err
+	}
+
+	host := p.HostLabel()
+	s, exists := l.streams[host]
+	if !exists {
+		labels := map[string]string{"grafana_host": host}
+		for k, v := range l.labels {
+			labels[k] = v
+		}
+		s = &lokiStream{Stream: labels}
+		l.streams[host] = s
+	}
+	s.Values = append(s.Values, [2]string{
+		strconv.FormatInt(time.Unix(int64(p.Time), 0).UnixNano(), 10),
+		strings.TrimRight(line.String(), "\n"),
+	})
+	l.pending++
+
+	if l.pending >= l.batchSize {
+		return l.Flush()
+	}
+
+	return nil
+}
+
+// Flush sends the batch. The batch is discarded even if it could not be sent,
+// so that a failing Loki does not cause unbounded memory usage.
+func (l *Loki) Flush() error {
+	if l.pending == 0 {
+		return nil
+	}
+
+	hosts := make([]string, 0, len(l.streams))
+	for host := range l.streams {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	streams := make([]*lokiStream, 0, len(hosts))
+	for _, host := range hosts {
+		s := l.streams[host]
+		sort.SliceStable(s.Values, func(i, j int) bool {
+			a, b := s.Values[i][0], s.Values[j][0]
+			if len(a) != len(b) {
+				return len(a) < len(b)
+			}
+			return a < b
+		})
+		streams = append(streams, s)
+	}
+	l.streams = make(map[string]*lokiStream)
+	l.pending = 0
+
+	body, err := json.Marshal(struct {
+		Streams []*lokiStream `json:"streams"`
+	}{streams})
+	if err != nil {
+		return err
+	}
+
+	resp, err := l.client.Post(l.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("loki returned status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+// Close sends any pending lines.
+func (l *Loki) Close() error {
+	return l.Flush()
+}
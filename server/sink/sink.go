@@ -0,0 +1,200 @@
+package sink
+
+import (
+	"sync"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "grafana"
+	subsystem = "analytics"
+)
+
+// Sink is an output for processed payloads.
+type Sink interface {
+	// Name identifies the Sink in logs and metrics.
+	Name() string
+	// Write writes a Payload to the output.
+	Write(p payload.Payload) error
+	// Close flushes any pending writes and releases the output.
+	Close() error
+}
+
+// Flusher is implemented by Sinks which batch writes.
+type Flusher interface {
+	// Flush writes all pending payloads to the output.
+	Flush() error
+}
+
+// Metrics are the metrics of all Buffered sinks.
+type Metrics struct {
+	written  *prometheus.CounterVec
+	failures *prometheus.CounterVec
+	dropped  *prometheus.CounterVec
+}
+
+// NewMetrics creates Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		written: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "sink_written_total",
+				Help:      "Number of payloads written to a sink.",
+			},
+			[]string{"sink"},
+		),
+		failures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "sink_failures_total",
+				Help:      "Number of failed writes or flushes of a sink.",
+			},
+			[]string{"sink"},
+		),
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "sink_dropped_total",
+				Help:      "Number of payloads dropped because the buffer of a sink was full.",
+			},
+			[]string{"sink"},
+		),
+	}
+}
+
+// Describe describes all metrics.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.written.Describe(ch)
+	m.failures.Describe(ch)
+	m.dropped.Describe(ch)
+}
+
+// Collect collects all metrics.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.written.Collect(ch)
+	m.failures.Collect(ch)
+	m.dropped.Collect(ch)
+}
+
+// Buffered writes payloads to a Sink in the background, so that slow outputs
+// do not block processing. Payloads are dropped if the buffer is full, unless
+// the Buffered is blocking.
+type Buffered struct {
+	sink     Sink
+	blocking bool
+	logger   log.Logger
+
+	mu     sync.RWMutex
+	closed bool
+	ch     chan payload.Payload
+	done   chan error
+
+	written  prometheus.Counter
+	failures prometheus.Counter
+	dropped  prometheus.Counter
+}
+
+// NewBuffered creates a Buffered Sink which holds up to size payloads. If the
+// Sink is a Flusher, it is flushed every flushInterval.
+func NewBuffered(s Sink, size int, flushInterval time.Duration, metrics *Metrics, logger log.Logger) *Buffered {
+	b := &Buffered{
+		sink:     s,
+		logger:   log.With(logger, "sink", s.Name()),
+		ch:       make(chan payload.Payload, size),
+		done:     make(chan error),
+		written:  metrics.written.WithLabelValues(s.Name()),
+		failures: metrics.failures.WithLabelValues(s.Name()),
+		dropped:  metrics.dropped.WithLabelValues(s.Name()),
+	}
+	go b.run(flushInterval)
+
+	return b
+}
+
+// NewBlocking creates a Buffered Sink which waits for space in the buffer
+// instead of dropping payloads, for outputs which must be lossless.
+func NewBlocking(s Sink, size int, flushInterval time.Duration, metrics *Metrics, logger log.Logger) *Buffered {
+	b := NewBuffered(s, size, flushInterval, metrics, logger)
+	b.blocking = true
+
+	return b
+}
+
+// Observe queues a Payload to be written.
+func (b *Buffered) Observe(p payload.Payload) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		b.dropped.Inc()
+		return
+	}
+
+	if b.blocking {
+		b.ch <- p
+		return
+	}
+
+	select {
+	case b.ch <- p:
+	default:
+		b.dropped.Inc()
+	}
+}
+
+func (b *Buffered) run(flushInterval time.Duration) {
+	flusher, isFlusher := b.sink.(Flusher)
+
+	var tick <-chan time.Time
+	if isFlusher && flushInterval > 0 {
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case p, ok := <-b.ch:
+			if !ok {
+				b.done <- b.sink.Close()
+				return
+			}
+			err := b.sink.Write(p)
+			if err != nil {
+				b.failures.Inc()
+				level.Error(b.logger).Log("msg", "Failed to write payload to sink", "uuid", p.UUID, "err", err)
+				continue
+			}
+			b.written.Inc()
+		case <-tick:
+			err := flusher.Flush()
+			if err != nil {
+				b.failures.Inc()
+				level.Error(b.logger).Log("msg", "Failed to flush sink", "err", err)
+			}
+		}
+	}
+}
+
+// Close writes all queued payloads and closes the Sink.
+func (b *Buffered) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.ch)
+	b.mu.Unlock()
+
+	return <-b.done
+}
@@ -0,0 +1,236 @@
+package sink_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/MacroPower/macropower-analytics-panel/server/sink"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var (
+	logger = log.NewNopLogger()
+)
+
+// testSink records written payloads, and fails for payloads without a UUID.
+type testSink struct {
+	mu     sync.Mutex
+	uuids  []string
+	closed bool
+}
+
+func (s *testSink) Name() string {
+	return "test"
+}
+
+func (s *testSink) Write(p payload.Payload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p.UUID == "" {
+		return errors.New("missing uuid")
+	}
+	s.uuids = append(s.uuids, p.UUID)
+	return nil
+}
+
+func (s *testSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	return nil
+}
+
+func TestBuffered(t *testing.T) {
+	metrics := sink.NewMetrics()
+	s := &testSink{}
+	b := sink.NewBuffered(s, 10, 0, metrics, logger)
+
+	p := payloadtest.GetPayload(t)
+	for _, uuid := range []string{"a", "", "b"} {
+		p.UUID = uuid
+		b.Observe(p)
+	}
+
+	err := b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Observe(p)
+
+	if strings.Join(s.uuids, ",") != "a,b" || !s.closed {
+		t.Errorf("Unexpected sink state: %+v", s)
+	}
+
+	expected := `
+# HELP grafana_analytics_sink_dropped_total Number of payloads dropped because the buffer of a sink was full.
+# TYPE grafana_analytics_sink_dropped_total counter
+grafana_analytics_sink_dropped_total{sink="test"} 1
+# HELP grafana_analytics_sink_failures_total Number of failed writes or flushes of a sink.
+# TYPE grafana_analytics_sink_failures_total counter
+grafana_analytics_sink_failures_total{sink="test"} 1
+# HELP grafana_analytics_sink_written_total Number of payloads written to a sink.
+# TYPE grafana_analytics_sink_written_total counter
+grafana_analytics_sink_written_total{sink="test"} 2
+`
+	err = testutil.CollectAndCompare(metrics, strings.NewReader(expected))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBlocking(t *testing.T) {
+	metrics := sink.NewMetrics()
+	s := &testSink{}
+	b := sink.NewBlocking(s, 1, 0, metrics, logger)
+
+	p := payloadtest.GetPayload(t)
+	for i := 0; i < 100; i++ {
+		p.UUID = strconv.Itoa(i)
+		b.Observe(p)
+	}
+
+	err := b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.uuids) != 100 {
+		t.Errorf("Expected '%d' payloads to be written, got '%d'", 100, len(s.uuids))
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	s, err := sink.NewFile(path, 0, 0, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := payloadtest.GetPayload(t)
+	p.UUID = "test"
+	err = s.Write(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := map[string]interface{}{}
+	err = json.Unmarshal(data, &line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line["uuid"] != "test" || line["customSingle"] == nil {
+		t.Errorf("Unexpected line: %s", data)
+	}
+}
+
+func TestSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := sink.NewSyslog("udp", conn.LocalAddr().String(), "test", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	p := payloadtest.GetPayload(t)
+	p.UUID = "test"
+	err = s.Write(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<134>1 ") || !strings.Contains(msg, " test ") || !strings.Contains(msg, "uuid=test") {
+		t.Errorf("Unexpected syslog message: %s", msg)
+	}
+}
+
+func TestLoki(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	s := sink.NewLoki(server.URL, map[string]string{"job": "test"}, 2, false, server.Client())
+
+	p := payloadtest.GetPayload(t)
+	for i, uuid := range []string{"b", "a", "c"} {
+		p.UUID = uuid
+		p.Time = 1600000000 - i
+		err := s.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 2 {
+		t.Fatalf("Expected '%d' requests, got '%d'", 2, len(bodies))
+	}
+
+	var push struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	err = json.Unmarshal([]byte(bodies[0]), &push)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(push.Streams) != 1 || len(push.Streams[0].Values) != 2 {
+		t.Fatalf("Unexpected push request: %s", bodies[0])
+	}
+	if push.Streams[0].Stream["job"] != "test" || push.Streams[0].Stream["grafana_host"] != "localhost:3000" {
+		t.Errorf("Unexpected stream labels: %v", push.Streams[0].Stream)
+	}
+	// Lines are timestamped with the payload time, and sorted.
+	if push.Streams[0].Values[1][0] != "1600000000000000000" || !strings.Contains(push.Streams[0].Values[1][1], "uuid=b") {
+		t.Errorf("Unexpected line: %v", push.Streams[0].Values[1])
+	}
+}
@@ -0,0 +1,103 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	// syslogPriority is the facility local0 with the severity informational.
+	syslogPriority = 16*8 + 6
+	// syslogTimeout is the timeout for connecting to and writing to a syslog server.
+	syslogTimeout = 10 * time.Second
+)
+
+// syslogWriter sends each write as an RFC 5424 syslog message. Messages sent
+// over TCP use octet counting to delimit them, as described in RFC 6587.
+type syslogWriter struct {
+	mu       sync.Mutex
+	network  string
+	address  string
+	tag      string
+	hostname string
+	conn     net.Conn
+}
+
+// NewSyslog creates a Log Sink which sends logfmt messages to a syslog server
+// over UDP or TCP.
+func NewSyslog(network string, address string, tag string, logVars bool, raw bool) (*Log, error) {
+	switch network {
+	case "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network '%s'", network)
+	}
+
+	w := &syslogWriter{
+		network:  network,
+		address:  address,
+		tag:      tag,
+		hostname: hostname(),
+	}
+
+	return NewLog("syslog", log.NewLogfmtLogger(w), logVars, raw, w), nil
+}
+
+// Write sends p as a single syslog message. If the connection fails, it is
+// re-established on the next write.
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn == nil {
+		conn, err := net.DialTimeout(w.network, w.address, syslogTimeout)
+		if err != nil {
+			return 0, err
+		}
+		w.conn = conn
+	}
+
+	msg := fmt.Sprintf(
+		"<%d>1 %s %s %s %d - - %s",
+		syslogPriority,
+		time.Now().UTC().Format(time.RFC3339Nano),
+		w.hostname,
+		w.tag,
+		os.Getpid(),
+		bytes.TrimRight(p, "\n"),
+	)
+	if w.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	err := w.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	if err == nil {
+		_, err = w.conn.Write([]byte(msg))
+	}
+	if err != nil {
+		w.conn.Close()
+		w.conn = nil
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close closes the connection.
+func (w *syslogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn == nil {
+		return nil
+	}
+
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
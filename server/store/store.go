@@ -0,0 +1,436 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+
+	// Register the postgres and sqlite drivers.
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// schema creates the tables, using types supported by both SQLite and Postgres.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS sessions (
+		uuid TEXT PRIMARY KEY,
+		grafana_host TEXT NOT NULL,
+		dashboard_uid TEXT NOT NULL,
+		dashboard_name TEXT NOT NULL,
+		user_id BIGINT NOT NULL,
+		user_login TEXT NOT NULL,
+		user_name TEXT NOT NULL,
+		user_org_role TEXT NOT NULL,
+		start_time TIMESTAMP NOT NULL,
+		end_time TIMESTAMP NULL,
+		last_seen TIMESTAMP NOT NULL,
+		duration_seconds DOUBLE PRECISION NOT NULL,
+		focused_duration_seconds DOUBLE PRECISION NOT NULL,
+		state TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS sessions_start_time ON sessions (start_time)`,
+	`CREATE INDEX IF NOT EXISTS sessions_dashboard_uid ON sessions (dashboard_uid)`,
+	`CREATE TABLE IF NOT EXISTS session_variables (
+		session_uuid TEXT NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS session_variables_session_uuid ON session_variables (session_uuid)`,
+}
+
+// sessionColumns are the columns of the sessions table, in insert order.
+var sessionColumns = []string{
+	"uuid",
+	"grafana_host",
+	"dashboard_uid",
+	"dashboard_name",
+	"user_id",
+	"user_login",
+	"user_name",
+	"user_org_role",
+	"start_time",
+	"end_time",
+	"last_seen",
+	"duration_seconds",
+	"focused_duration_seconds",
+	"state",
+}
+
+// SQL is a Sink which stores sessions in a SQL database. Sessions are stored
+// once they end, or once no payload was received for them within the expiry,
+// in which case they have a NULL end_time. The variables of a session are its
+// most recent selection.
+type SQL struct {
+	db      *sql.DB
+	driver  string
+	timeout time.Duration
+	expiry  time.Duration
+
+	upsertSession   string
+	deleteVariables string
+	insertVariable  string
+
+	mu sync.Mutex
+	// open holds the sessions which have not been stored yet.
+	open map[string]openSession
+}
+
+// openSession is a session which has not been stored yet.
+type openSession struct {
+	payload  payload.Payload
+	lastSeen time.Time
+}
+
+// NewSQL opens a database and creates the tables if they do not exist. The
+// driver is sqlite or postgres. The timeout is used to calculate session
+// durations, as in collector.NewExporter. Sessions which have not ended are
+// stored by Flush once no payload was received for them within expiry.
+func NewSQL(driver string, dsn string, timeout time.Duration, expiry time.Duration) (*SQL, error) {
+	switch driver {
+	case "sqlite", "postgres":
+	default:
+		return nil, fmt.Errorf("unsupported sql driver '%s'", driver)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite" {
+		// SQLite only supports a single writer.
+		db.SetMaxOpenConns(1)
+	}
+
+	for _, stmt := range schema {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	s := &SQL{
+		db:      db,
+		driver:  driver,
+		timeout: timeout,
+		expiry:  expiry,
+		open:    make(map[string]openSession),
+	}
+
+	placeholders := make([]string, len(sessionColumns))
+	updates := make([]string, 0, len(sessionColumns)-1)
+	for i, c := range sessionColumns {
+		placeholders[i] = s.placeholder(i + 1)
+		if c != "uuid" {
+			updates = append(updates, c+" = excluded."+c)
+		}
+	}
+	s.upsertSession = fmt.Sprintf(
+		"INSERT INTO sessions (%s) VALUES (%s) ON CONFLICT (uuid) DO UPDATE SET %s",
+		strings.Join(sessionColumns, ", "),
+		strings.Join(placeholders, ", "),
+		strings.Join(updates, ", "),
+	)
+	s.deleteVariables = "DELETE FROM session_variables WHERE session_uuid = " + s.placeholder(1)
+	s.insertVariable = fmt.Sprintf(
+		"INSERT INTO session_variables (session_uuid, name, value) VALUES (%s, %s, %s)",
+		s.placeholder(1), s.placeholder(2), s.placeholder(3),
+	)
+
+	return s, nil
+}
+
+// placeholder returns the nth bind parameter of the driver.
+func (s *SQL) placeholder(n int) string {
+	if s.driver == "postgres" {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// Name returns the name of the Sink.
+func (s *SQL) Name() string {
+	return "sql"
+}
+
+// Write stores the session of the Payload if it has ended. Otherwise, it is
+// stored by Flush or Close.
+func (s *SQL) Write(p payload.Payload) error {
+	if len(p.Events()) == 0 {
+		// The payload was not processed, e.g. because the dashboard is new.
+		return nil
+	}
+
+	s.mu.Lock()
+	if _, _, ended := p.IsTimeSet(); !ended {
+		s.open[p.UUID] = openSession{payload: p, lastSeen: time.Now()}
+		s.mu.Unlock()
+		return nil
+	}
+	delete(s.open, p.UUID)
+	s.mu.Unlock()
+
+	return s.store(p)
+}
+
+// Flush stores the sessions which have expired.
+func (s *SQL) Flush() error {
+	now := time.Now()
+
+	var expired []payload.Payload
+	s.mu.Lock()
+	for uuid, o := range s.open {
+		if now.Sub(o.lastSeen) > s.expiry {
+			expired = append(expired, o.payload)
+			delete(s.open, uuid)
+		}
+	}
+	s.mu.Unlock()
+
+	return s.storeAll(expired)
+}
+
+// storeAll stores sessions, and returns the first error.
+func (s *SQL) storeAll(payloads []payload.Payload) error {
+	var firstErr error
+	for _, p := range payloads {
+		err := s.store(p)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// store writes the row and variables of a session.
+func (s *SQL) store(p payload.Payload) error {
+	events := p.Events()
+
+	var endTime interface{}
+	for _, ev := range events {
+		if ev.Type == "end" {
+			endTime = ev.Time.UTC()
+		}
+	}
+
+	state, err := payload.StateCodec{}.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(s.upsertSession,
+		p.UUID,
+		p.HostLabel(),
+		p.Dashboard.UID,
+		p.Dashboard.Name,
+		p.User.ID,
+		p.User.Login,
+		p.User.Name,
+		p.User.OrgRole,
+		events[0].Time.UTC(),
+		endTime,
+		p.LastSeen().UTC(),
+		p.GetDuration(s.timeout).Seconds(),
+		p.GetFocusedDuration(s.timeout).Seconds(),
+		string(state),
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(s.deleteVariables, p.UUID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, v := range p.Variables {
+		for _, value := range v.Values {
+			_, err = tx.Exec(s.insertVariable, p.UUID, v.Name, fmt.Sprint(value))
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Query selects stored sessions. Empty fields match anything.
+type Query struct {
+	// From and To select sessions which were seen within the time range.
+	From time.Time
+	To   time.Time
+	Host string
+	// Dashboard is the UID or name of the dashboard.
+	Dashboard string
+	User      string
+	// State is active for sessions which expired without ending, or ended.
+	State string
+}
+
+// where returns the WHERE clause selecting the sessions of the Query, and its
+// arguments. Columns of the sessions table are prefixed with s.
+func (s *SQL) where(q Query) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	// add adds a condition, with a %s verb for each of the values.
+	add := func(condition string, values ...interface{}) {
+		placeholders := make([]interface{}, len(values))
+		for i, v := range values {
+			args = append(args, v)
+			placeholders[i] = s.placeholder(len(args))
+		}
+		conditions = append(conditions, fmt.Sprintf(condition, placeholders...))
+	}
+
+	if !q.From.IsZero() {
+		add("s.last_seen >= %s", q.From.UTC())
+	}
+	if !q.To.IsZero() {
+		add("s.start_time <= %s", q.To.UTC())
+	}
+	if q.Host != "" {
+		add("s.grafana_host = %s", q.Host)
+	}
+	if q.Dashboard != "" {
+		add("(s.dashboard_uid = %s OR s.dashboard_name = %s)", q.Dashboard, q.Dashboard)
+	}
+	if q.User != "" {
+		add("s.user_login = %s", q.User)
+	}
+	switch q.State {
+	case "active":
+		add("s.end_time IS NULL")
+	case "ended":
+		add("s.end_time IS NOT NULL")
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// VariableNames returns the sorted names of the variables of the sessions
+// selected by the Query.
+func (s *SQL) VariableNames(q Query) ([]string, error) {
+	where, args := s.where(q)
+	rows, err := s.db.Query("SELECT DISTINCT v.name FROM session_variables v JOIN sessions s ON s.uuid = v.session_uuid"+where+" ORDER BY v.name", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// sessionsPageSize is the number of sessions read by each query of Sessions.
+const sessionsPageSize = 100
+
+// Sessions calls fn with each session selected by the Query, ordered by start
+// time and uuid. Sessions are read from the database in pages, which are
+// closed before fn is called, so that a slow fn does not hold a connection
+// needed to store sessions. If fn returns an error, it is returned.
+func (s *SQL) Sessions(q Query, fn func(p payload.Payload) error) error {
+	var after *payload.Payload
+	for {
+		page, err := s.sessionsPage(q, after)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range page {
+			err = fn(p)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(page) < sessionsPageSize {
+			return nil
+		}
+		after = &page[len(page)-1]
+	}
+}
+
+// sessionsPage returns the next page of the sessions selected by the Query,
+// which are ordered after the given session, if any.
+func (s *SQL) sessionsPage(q Query, after *payload.Payload) ([]payload.Payload, error) {
+	where, args := s.where(q)
+	if after != nil {
+		// The start time is stored as the time of the first event.
+		start := after.Events()[0].Time.UTC()
+		args = append(args, start, start, after.UUID)
+		keyset := fmt.Sprintf("(s.start_time > %s OR (s.start_time = %s AND s.uuid > %s))",
+			s.placeholder(len(args)-2), s.placeholder(len(args)-1), s.placeholder(len(args)))
+		if where == "" {
+			where = " WHERE " + keyset
+		} else {
+			where += " AND " + keyset
+		}
+	}
+
+	query := fmt.Sprintf("SELECT s.state FROM sessions s%s ORDER BY s.start_time, s.uuid LIMIT %d", where, sessionsPageSize)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var page []payload.Payload
+	for rows.Next() {
+		var state []byte
+		err := rows.Scan(&state)
+		if err != nil {
+			return nil, err
+		}
+		v, err := payload.StateCodec{}.Unmarshal(state)
+		if err != nil {
+			return nil, err
+		}
+		page = append(page, v.(payload.Payload))
+	}
+
+	return page, rows.Err()
+}
+
+// Close stores the sessions which have not been stored yet, and closes the
+// database.
+func (s *SQL) Close() error {
+	s.mu.Lock()
+	var open []payload.Payload
+	for _, o := range s.open {
+		open = append(open, o.payload)
+	}
+	s.open = make(map[string]openSession)
+	s.mu.Unlock()
+
+	err := s.storeAll(open)
+	if closeErr := s.db.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,207 @@
+package store_test
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/MacroPower/macropower-analytics-panel/server/store"
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	logger = log.NewNopLogger()
+)
+
+func TestSQL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.db")
+	s, err := store.NewSQL("sqlite", path, time.Duration(0), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &payloadtest.Recorder{}
+	handler := payload.NewHandler(cacher.NewCache(), 10, nil, []payload.Observer{r}, logger)
+	testserver := httptest.NewServer(handler)
+	defer testserver.Close()
+
+	request := payloadtest.GetPayload(t)
+	request.UUID = "a"
+	request.User.OrgRole = "Viewer"
+	request.Type = "start"
+	request.Time = 1600000000
+	payloadtest.SendPayload(t, testserver.URL, request)
+	request.Type = "heartbeat"
+	request.Time = 1600000060
+	payloadtest.SendPayload(t, testserver.URL, request)
+	request.Type = "end"
+	request.Time = 1600000090
+	request.Variables = request.Variables[:1]
+	payloadtest.SendPayload(t, testserver.URL, request)
+
+	request.UUID = "b"
+	request.Type = "start"
+	payloadtest.SendPayload(t, testserver.URL, request)
+
+	request.UUID = "c"
+	request.Dashboard.UID = "new"
+	payloadtest.SendPayload(t, testserver.URL, request)
+	handler.Close()
+
+	for _, p := range r.Payloads() {
+		err := s.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Only the ended session is stored, until the others expire or the
+	// store is closed.
+	err = s.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored int
+	err = db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != 1 {
+		t.Errorf("Expected 1 stored session before closing, got %d", stored)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The database can be reopened.
+	s, err = store.NewSQL("sqlite", path, time.Duration(0), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	rows, err := db.Query("SELECT uuid, grafana_host, dashboard_uid, user_login, user_org_role, start_time, end_time, duration_seconds, focused_duration_seconds FROM sessions ORDER BY uuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var sessions []string
+	for rows.Next() {
+		var (
+			uuid, host, dashboard, login, role string
+			start                              time.Time
+			end                                sql.NullTime
+			duration, focused                  float64
+		)
+		err := rows.Scan(&uuid, &host, &dashboard, &login, &role, &start, &end, &duration, &focused)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, strings.Join([]string{
+			uuid, host, dashboard, login, role,
+			start.UTC().Format(time.RFC3339),
+			end.Time.UTC().Format(time.RFC3339),
+			time.Duration(duration * float64(time.Second)).String(),
+			time.Duration(focused * float64(time.Second)).String(),
+		}, " "))
+	}
+
+	expected := []string{
+		"a localhost:3000 b_1UbypGz admin Viewer 2020-09-13T12:26:40Z 2020-09-13T12:28:10Z 1m30s 1m30s",
+		"b localhost:3000 b_1UbypGz admin Viewer 2020-09-13T12:28:10Z 0001-01-01T00:00:00Z 0s 0s",
+	}
+	if strings.Join(sessions, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected sessions:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(sessions, "\n"))
+	}
+
+	var variables int
+	err = db.QueryRow("SELECT COUNT(*) FROM session_variables WHERE session_uuid = 'a'").Scan(&variables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variables != len(request.Variables[0].Values) {
+		t.Errorf("Expected %d variable values, got %d", len(request.Variables[0].Values), variables)
+	}
+
+	_, err = store.NewSQL("mysql", "", time.Duration(0), time.Hour)
+	if err == nil {
+		t.Error("Expected an error for an unsupported driver")
+	}
+}
+
+func TestSQLSessions(t *testing.T) {
+	s, err := store.NewSQL("sqlite", filepath.Join(t.TempDir(), "analytics.db"), time.Duration(0), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	r := &payloadtest.Recorder{}
+	handler := payload.NewHandler(cacher.NewCache(), 10, nil, []payload.Observer{r}, logger)
+	testserver := httptest.NewServer(handler)
+	defer testserver.Close()
+
+	// More sessions than fit in a page, with pairs sharing a start time.
+	const n = 250
+	request := payloadtest.GetPayload(t)
+	for i := 0; i < n; i++ {
+		request.UUID = fmt.Sprintf("%03d", n-i)
+		request.Type = "start"
+		request.Time = 1600000000 + i/2
+		payloadtest.SendPayload(t, testserver.URL, request)
+		request.Type = "end"
+		request.Time += 60
+		payloadtest.SendPayload(t, testserver.URL, request)
+	}
+	handler.Close()
+
+	payloads := r.Payloads()
+	for _, p := range payloads {
+		err := s.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Sessions can be stored while they are read.
+	var uuids []string
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Sessions(store.Query{}, func(p payload.Payload) error {
+			uuids = append(uuids, p.UUID)
+			return s.Write(payloads[len(payloads)-1])
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out reading sessions")
+	}
+
+	var expected []string
+	for i := 0; i < n; i += 2 {
+		expected = append(expected, fmt.Sprintf("%03d", n-i-1), fmt.Sprintf("%03d", n-i))
+	}
+	if strings.Join(uuids, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected sessions:\n%s\ngot:\n%s", strings.Join(expected, ","), strings.Join(uuids, ","))
+	}
+}
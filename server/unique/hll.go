@@ -0,0 +1,118 @@
+package unique
+
+import (
+	"math"
+	"math/bits"
+)
+
+const (
+	// precision is the number of hash bits used to select a register.
+	precision = 12
+	// registers is the number of registers in a dense Sketch.
+	registers = 1 << precision
+	// sparseLimit is the number of sparse entries kept before a Sketch is
+	// converted to its dense representation.
+	sparseLimit = registers / 16
+)
+
+// Sketch is a HyperLogLog sketch for estimating the number of distinct
+// hashes added to it. Sketches start out sparse, since most only ever see a
+// handful of users, and become dense once they grow.
+type Sketch struct {
+	sparse []uint32
+	dense  []uint8
+}
+
+// NewSketch creates an empty Sketch.
+func NewSketch() *Sketch {
+	return &Sketch{}
+}
+
+// Add adds a 64-bit hash to the Sketch.
+func (s *Sketch) Add(hash uint64) {
+	idx := uint32(hash >> (64 - precision))
+	rho := uint8(bits.LeadingZeros64(hash<<precision|1<<(precision-1)) + 1)
+	s.set(idx, rho)
+}
+
+func (s *Sketch) set(idx uint32, rho uint8) {
+	if s.dense != nil {
+		if rho > s.dense[idx] {
+			s.dense[idx] = rho
+		}
+		return
+	}
+
+	for i, e := range s.sparse {
+		if e>>8 == idx {
+			if rho > uint8(e) {
+				s.sparse[i] = idx<<8 | uint32(rho)
+			}
+			return
+		}
+	}
+
+	if len(s.sparse) < sparseLimit {
+		s.sparse = append(s.sparse, idx<<8|uint32(rho))
+		return
+	}
+
+	s.dense = make([]uint8, registers)
+	for _, e := range s.sparse {
+		s.dense[e>>8] = uint8(e)
+	}
+	s.sparse = nil
+	s.set(idx, rho)
+}
+
+// Merge adds all hashes from o to the Sketch.
+func (s *Sketch) Merge(o *Sketch) {
+	if o.dense != nil {
+		for idx, rho := range o.dense {
+			if rho != 0 {
+				s.set(uint32(idx), rho)
+			}
+		}
+		return
+	}
+
+	for _, e := range o.sparse {
+		s.set(e>>8, uint8(e))
+	}
+}
+
+// Estimate returns the estimated number of distinct hashes in the Sketch.
+func (s *Sketch) Estimate() uint64 {
+	if s.dense == nil {
+		// Sparse sketches have too few entries to collide meaningfully, so
+		// linear counting is used directly.
+		return linearCounting(registers - len(s.sparse))
+	}
+
+	sum := 0.0
+	zeros := 0
+	for _, rho := range s.dense {
+		sum += math.Ldexp(1, -int(rho))
+		if rho == 0 {
+			zeros++
+		}
+	}
+
+	m := float64(registers)
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros != 0 {
+		return linearCounting(zeros)
+	}
+
+	return uint64(estimate + 0.5)
+}
+
+func linearCounting(zeros int) uint64 {
+	if zeros == registers {
+		return 0
+	}
+
+	m := float64(registers)
+	return uint64(m*math.Log(m/float64(zeros)) + 0.5)
+}
@@ -0,0 +1,161 @@
+package unique
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/cespare/xxhash/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "grafana"
+	subsystem = "analytics"
+)
+
+// windowSizes are the rolling durations that unique users are counted over,
+// keyed by their label value.
+var windowSizes = []struct {
+	label string
+	size  time.Duration
+}{
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+}
+
+type dashboardKey struct {
+	host string
+	uid  string
+}
+
+type dashboardWindows struct {
+	name    string
+	windows []*Window
+}
+
+// Counter counts approximate unique users per dashboard and per host.
+type Counter struct {
+	mu         sync.Mutex
+	dashboards map[dashboardKey]*dashboardWindows
+	hosts      map[string][]*Window
+
+	dashboardUsers *prometheus.Desc
+	hostUsers      *prometheus.Desc
+}
+
+// NewCounter creates a Counter.
+func NewCounter() *Counter {
+	return &Counter{
+		dashboards: make(map[dashboardKey]*dashboardWindows),
+		hosts:      make(map[string][]*Window),
+		dashboardUsers: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "unique_users"),
+			"Approximate number of unique users of a dashboard over a rolling window.",
+			[]string{"grafana_host", "dashboard_name", "dashboard_uid", "window"},
+			nil,
+		),
+		hostUsers: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "host_unique_users"),
+			"Approximate number of unique users of a host over a rolling window.",
+			[]string{"grafana_host", "window"},
+			nil,
+		),
+	}
+}
+
+func newWindows() []*Window {
+	windows := make([]*Window, len(windowSizes))
+	for i, ws := range windowSizes {
+		windows[i] = NewWindow(ws.size)
+	}
+	return windows
+}
+
+// Observe adds the user of a Payload to the Counter, at the time the Payload
+// was sent. Anonymous users, i.e. without an ID or login, are not counted,
+// since they cannot be told apart.
+func (c *Counter) Observe(p payload.Payload) {
+	if p.Dashboard.UID == "new" || (p.User.ID == 0 && p.User.Login == "") {
+		return
+	}
+
+	hash := xxhash.Sum64String(strconv.Itoa(p.User.ID) + ":" + p.User.Login)
+	host := p.HostLabel()
+	key := dashboardKey{host: host, uid: p.Dashboard.UID}
+
+	// Payloads from clients with a clock ahead of the server are counted now.
+	now := time.Now()
+	if t := time.Unix(int64(p.Time), 0); t.Before(now) {
+		now = t
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d, exists := c.dashboards[key]
+	if !exists {
+		d = &dashboardWindows{windows: newWindows()}
+		c.dashboards[key] = d
+	}
+	d.name = p.Dashboard.Name
+	for _, w := range d.windows {
+		w.Add(now, hash)
+	}
+
+	h, exists := c.hosts[host]
+	if !exists {
+		h = newWindows()
+		c.hosts[host] = h
+	}
+	for _, w := range h {
+		w.Add(now, hash)
+	}
+}
+
+// Describe describes all metrics.
+func (c *Counter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.dashboardUsers
+	ch <- c.hostUsers
+}
+
+// Collect collects all metrics, and forgets dashboards and hosts that have
+// not been seen within the largest window.
+func (c *Counter) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	for key, d := range c.dashboards {
+		if d.windows[len(d.windows)-1].Empty(now) {
+			delete(c.dashboards, key)
+			continue
+		}
+		for i, w := range d.windows {
+			ch <- prometheus.MustNewConstMetric(
+				c.dashboardUsers,
+				prometheus.GaugeValue,
+				float64(w.Estimate(now)),
+				key.host, d.name, key.uid, windowSizes[i].label,
+			)
+		}
+	}
+
+	for host, h := range c.hosts {
+		if h[len(h)-1].Empty(now) {
+			delete(c.hosts, host)
+			continue
+		}
+		for i, w := range h {
+			ch <- prometheus.MustNewConstMetric(
+				c.hostUsers,
+				prometheus.GaugeValue,
+				float64(w.Estimate(now)),
+				host, windowSizes[i].label,
+			)
+		}
+	}
+}
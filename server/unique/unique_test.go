@@ -0,0 +1,116 @@
+package unique_test
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/MacroPower/macropower-analytics-panel/server/unique"
+	"github.com/cespare/xxhash/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSketchEstimate(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 1000, 100000} {
+		s := unique.NewSketch()
+		for i := 0; i < n; i++ {
+			s.Add(xxhash.Sum64String(strconv.Itoa(i) + "user"))
+			s.Add(xxhash.Sum64String(strconv.Itoa(i) + "user"))
+		}
+
+		actual := float64(s.Estimate())
+		if math.Abs(actual-float64(n)) > float64(n)*0.05 {
+			t.Errorf("Expected an estimate close to '%d', got '%f'", n, actual)
+		}
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	a := unique.NewSketch()
+	b := unique.NewSketch()
+	for i := 0; i < 2000; i++ {
+		a.Add(xxhash.Sum64String(strconv.Itoa(i)))
+		b.Add(xxhash.Sum64String(strconv.Itoa(i + 1000)))
+	}
+	a.Merge(b)
+
+	actual := float64(a.Estimate())
+	if math.Abs(actual-3000) > 3000*0.05 {
+		t.Errorf("Expected an estimate close to '%d', got '%f'", 3000, actual)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	w := unique.NewWindow(time.Hour)
+	start := time.Unix(1600000000, 0)
+
+	w.Add(start, xxhash.Sum64String("a"))
+	w.Add(start.Add(10*time.Minute), xxhash.Sum64String("b"))
+	w.Add(start.Add(10*time.Minute), xxhash.Sum64String("b"))
+
+	if actual := w.Estimate(start.Add(10 * time.Minute)); actual != 2 {
+		t.Errorf("Expected '%d' users, got '%d'", 2, actual)
+	}
+	if actual := w.Estimate(start.Add(65 * time.Minute)); actual != 1 {
+		t.Errorf("Expected '%d' users, got '%d'", 1, actual)
+	}
+	if !w.Empty(start.Add(2 * time.Hour)) {
+		t.Error("Expected window to be empty")
+	}
+
+	// Hashes older than the window do not replace newer slots.
+	w.Add(start.Add(2*time.Hour), xxhash.Sum64String("c"))
+	w.Add(start.Add(time.Hour), xxhash.Sum64String("d"))
+	if actual := w.Estimate(start.Add(2 * time.Hour)); actual != 1 {
+		t.Errorf("Expected '%d' users, got '%d'", 1, actual)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	c := unique.NewCounter()
+
+	now := int(time.Now().Unix())
+	for _, login := range []string{"a", "b", "b", "c"} {
+		p := payloadtest.GetPayload(t)
+		p.User.Login = login
+		p.Time = now
+		c.Observe(p)
+	}
+
+	p := payloadtest.GetPayload(t)
+	p.Dashboard.UID = "other"
+	p.Time = now
+	c.Observe(p)
+
+	// Anonymous users, and users seen before the largest window, are not
+	// counted.
+	p.User.ID, p.User.Login = 0, ""
+	c.Observe(p)
+	p = payloadtest.GetPayload(t)
+	p.User.Login = "d"
+	p.Time = now - 8*24*60*60
+	c.Observe(p)
+
+	expected := `
+# HELP grafana_analytics_host_unique_users Approximate number of unique users of a host over a rolling window.
+# TYPE grafana_analytics_host_unique_users gauge
+grafana_analytics_host_unique_users{grafana_host="localhost:3000",window="24h"} 4
+grafana_analytics_host_unique_users{grafana_host="localhost:3000",window="1h"} 4
+grafana_analytics_host_unique_users{grafana_host="localhost:3000",window="7d"} 4
+# HELP grafana_analytics_unique_users Approximate number of unique users of a dashboard over a rolling window.
+# TYPE grafana_analytics_unique_users gauge
+grafana_analytics_unique_users{dashboard_name="New Dashboard 1234",dashboard_uid="b_1UbypGz",grafana_host="localhost:3000",window="24h"} 3
+grafana_analytics_unique_users{dashboard_name="New Dashboard 1234",dashboard_uid="b_1UbypGz",grafana_host="localhost:3000",window="1h"} 3
+grafana_analytics_unique_users{dashboard_name="New Dashboard 1234",dashboard_uid="b_1UbypGz",grafana_host="localhost:3000",window="7d"} 3
+grafana_analytics_unique_users{dashboard_name="New Dashboard 1234",dashboard_uid="other",grafana_host="localhost:3000",window="24h"} 1
+grafana_analytics_unique_users{dashboard_name="New Dashboard 1234",dashboard_uid="other",grafana_host="localhost:3000",window="1h"} 1
+grafana_analytics_unique_users{dashboard_name="New Dashboard 1234",dashboard_uid="other",grafana_host="localhost:3000",window="7d"} 1
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected))
+	if err != nil {
+		t.Error(err)
+	}
+}
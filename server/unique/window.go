@@ -0,0 +1,65 @@
+package unique
+
+import (
+	"time"
+)
+
+// slots is the number of Sketches kept for each Window.
+const slots = 12
+
+// Window estimates distinct hashes over a rolling duration. The duration is
+// split into slots, and the oldest slot is discarded as time moves on, so
+// estimates cover between size-size/slots and size.
+type Window struct {
+	slot     time.Duration
+	sketches [slots]*Sketch
+	indexes  [slots]int64
+}
+
+// NewWindow creates a Window covering the provided duration.
+func NewWindow(size time.Duration) *Window {
+	return &Window{
+		slot: size / slots,
+	}
+}
+
+// Add adds a hash to the Window at time t. Hashes added at a time which is
+// older than the Window ending at the latest time are ignored.
+func (w *Window) Add(t time.Time, hash uint64) {
+	idx := t.UnixNano() / int64(w.slot)
+	pos := idx % slots
+	if w.sketches[pos] != nil && w.indexes[pos] > idx {
+		return
+	}
+	if w.sketches[pos] == nil || w.indexes[pos] != idx {
+		w.sketches[pos] = NewSketch()
+		w.indexes[pos] = idx
+	}
+	w.sketches[pos].Add(hash)
+}
+
+// Estimate returns the estimated number of distinct hashes added within the
+// Window ending at time t.
+func (w *Window) Estimate(t time.Time) uint64 {
+	idx := t.UnixNano() / int64(w.slot)
+	merged := NewSketch()
+	for pos, s := range w.sketches {
+		if s != nil && w.indexes[pos] > idx-slots && w.indexes[pos] <= idx {
+			merged.Merge(s)
+		}
+	}
+
+	return merged.Estimate()
+}
+
+// Empty returns true if nothing was added within the Window ending at time t.
+func (w *Window) Empty(t time.Time) bool {
+	idx := t.UnixNano() / int64(w.slot)
+	for pos, s := range w.sketches {
+		if s != nil && w.indexes[pos] > idx-slots {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,127 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Events which can trigger a Rule.
+const (
+	// EventStart is a session being started.
+	EventStart = "start"
+	// EventHeartbeat is a heartbeat being received.
+	EventHeartbeat = "heartbeat"
+	// EventEnd is a session being ended.
+	EventEnd = "end"
+	// EventFirstView is the first session of a dashboard since the server started.
+	EventFirstView = "first_view"
+	// EventLongSession is a session exceeding the min_duration of the Rule. It
+	// is only triggered once per session.
+	EventLongSession = "long_session"
+)
+
+// defaultTemplate is used for targets without a template.
+const defaultTemplate = `{"event":{{ json .Event }},"payload":{{ json .Payload }}}`
+
+// Config is the webhook configuration file.
+type Config struct {
+	Targets []*Target `yaml:"targets"`
+}
+
+// Target is a URL which receives a POST for every matching event.
+type Target struct {
+	Name    string            `yaml:"name"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// Template is a text/template executed with Data to create the body.
+	Template string `yaml:"template"`
+	// Retries is the number of times a failed request is retried.
+	Retries int `yaml:"retries"`
+	// Backoff is the wait before the first retry, which doubles for each
+	// subsequent retry.
+	Backoff time.Duration `yaml:"backoff"`
+	// Rules are the events the target receives. The target receives an event
+	// if any of its rules match.
+	Rules []Rule `yaml:"rules"`
+
+	template *template.Template
+}
+
+// Rule matches an event. All of the specified filters must match.
+type Rule struct {
+	Event string `yaml:"event"`
+	// Dashboards are dashboard UIDs.
+	Dashboards []string `yaml:"dashboards"`
+	// Users are user logins.
+	Users []string `yaml:"users"`
+	// Roles are organization roles, e.g. Viewer, Editor or Admin.
+	Roles []string `yaml:"roles"`
+	// MinDuration is the duration a session must exceed for EventLongSession.
+	MinDuration time.Duration `yaml:"min_duration"`
+}
+
+// LoadConfig reads and validates a Config file.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseConfig(b)
+}
+
+// ParseConfig parses and validates a Config.
+func ParseConfig(b []byte) (*Config, error) {
+	c := &Config{}
+	err := yaml.UnmarshalStrict(b, c)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, t := range c.Targets {
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("target-%d", i)
+		}
+		if t.URL == "" {
+			return nil, fmt.Errorf("webhook target %q has no url", t.Name)
+		}
+		if t.Backoff == 0 {
+			t.Backoff = time.Second
+		}
+		if t.Template == "" {
+			t.Template = defaultTemplate
+		}
+
+		t.template, err = template.New(t.Name).Funcs(template.FuncMap{"json": toJSON}).Parse(t.Template)
+		if err != nil {
+			return nil, fmt.Errorf("webhook target %q has an invalid template: %w", t.Name, err)
+		}
+
+		if len(t.Rules) == 0 {
+			return nil, fmt.Errorf("webhook target %q has no rules", t.Name)
+		}
+		for _, r := range t.Rules {
+			switch r.Event {
+			case EventStart, EventHeartbeat, EventEnd, EventFirstView:
+			case EventLongSession:
+				if r.MinDuration <= 0 {
+					return nil, fmt.Errorf("webhook target %q has a %s rule without min_duration", t.Name, r.Event)
+				}
+			default:
+				return nil, fmt.Errorf("webhook target %q has a rule with unknown event %q", t.Name, r.Event)
+			}
+		}
+	}
+
+	return c, nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
@@ -0,0 +1,262 @@
+package webhook
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+)
+
+// sessionRetention is how long sessions are remembered after triggering
+// EventLongSession.
+const sessionRetention = 24 * time.Hour
+
+// Data is the data passed to target templates.
+type Data struct {
+	payload.Payload
+	// Event is the event of the matching Rule.
+	Event string
+	// Duration is the duration of the session.
+	Duration time.Duration
+	// FocusedDuration is the focused duration of the session.
+	FocusedDuration time.Duration
+}
+
+// History holds the events which were already sent. It may be shared by the
+// Sinks which replace each other when the configuration is reloaded, so that
+// events are not sent twice.
+type History struct {
+	mu sync.Mutex
+	// seen holds the dashboards which have had a session.
+	seen map[string]bool
+	// long holds the sessions which triggered EventLongSession for a target.
+	long map[string]time.Time
+}
+
+// NewHistory creates an empty History.
+func NewHistory() *History {
+	return &History{
+		seen: make(map[string]bool),
+		long: make(map[string]time.Time),
+	}
+}
+
+// MarkSeen marks the dashboard of the Payload as seen, e.g. for sessions
+// restored from a snapshot, since the History itself is not persisted.
+func (h *History) MarkSeen(p payload.Payload) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seen[dashboardKey(p)] = true
+}
+
+// firstView marks the dashboard as seen, and returns true if it was not seen
+// before.
+func (h *History) firstView(dashboard string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	seen := h.seen[dashboard]
+	h.seen[dashboard] = true
+	return !seen
+}
+
+// dashboardKey returns the key of the dashboard of a Payload in the History.
+func dashboardKey(p payload.Payload) string {
+	return p.HostLabel() + "/" + p.Dashboard.UID
+}
+
+// longSession marks the session as having triggered EventLongSession, and
+// returns true if it did not trigger it before.
+func (h *History) longSession(key string, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.long[key].IsZero() {
+		return false
+	}
+	h.long[key] = now
+	return true
+}
+
+func (h *History) prune(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for k, t := range h.long {
+		if now.Sub(t) > sessionRetention {
+			delete(h.long, k)
+		}
+	}
+}
+
+// Sink is a Sink which sends a POST to each Target with a Rule matching a
+// Payload.
+type Sink struct {
+	config  *Config
+	timeout time.Duration
+	history *History
+	client  *http.Client
+}
+
+// NewSink creates a new Sink, which records sent events in history. The
+// timeout is used to calculate session durations, as in
+// collector.NewExporter.
+func NewSink(config *Config, timeout time.Duration, history *History, client *http.Client) *Sink {
+	return &Sink{
+		config:  config,
+		timeout: timeout,
+		history: history,
+		client:  client,
+	}
+}
+
+// Name returns the name of the Sink.
+func (s *Sink) Name() string {
+	return "webhook"
+}
+
+// Write sends the Payload to every matching target. An error is returned if
+// any target could not be sent to.
+func (s *Sink) Write(p payload.Payload) error {
+	if p.Dashboard.UID == "new" {
+		return nil
+	}
+
+	// Only the start of a session marks the dashboard as seen.
+	firstView := p.Type == EventStart && s.history.firstView(dashboardKey(p))
+
+	duration := p.GetDuration(s.timeout)
+	focusedDuration := p.GetFocusedDuration(s.timeout)
+	s.history.prune(time.Now())
+
+	var errs []string
+	for _, t := range s.config.Targets {
+		for _, r := range t.Rules {
+			if !r.matches(p) {
+				continue
+			}
+
+			switch r.Event {
+			case EventFirstView:
+				if !firstView {
+					continue
+				}
+			case EventLongSession:
+				if duration <= r.MinDuration || !s.history.longSession(t.Name+"/"+p.UUID, time.Now()) {
+					continue
+				}
+			default:
+				if p.Type != r.Event {
+					continue
+				}
+			}
+
+			err := s.send(t, Data{
+				Payload:         p,
+				Event:           r.Event,
+				Duration:        duration,
+				FocusedDuration: focusedDuration,
+			})
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+
+			// Each target receives a payload at most once.
+			break
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("webhook failed: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// matches returns true if the filters of the Rule match the Payload.
+func (r Rule) matches(p payload.Payload) bool {
+	return matchesAny(r.Dashboards, p.Dashboard.UID, false) &&
+		matchesAny(r.Users, p.User.Login, false) &&
+		matchesAny(r.Roles, p.User.OrgRole, true)
+}
+
+// matchesAny returns true if values is empty or contains v.
+func matchesAny(values []string, v string, fold bool) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if value == v || (fold && strings.EqualFold(value, v)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// send executes the template of the Target, and sends the body. Failed
+// requests are retried with exponential backoff.
+func (s *Sink) send(t *Target, data Data) error {
+	var body bytes.Buffer
+	err := t.template.Execute(&body, data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", t.Name, err)
+	}
+
+	backoff := t.Backoff
+	for attempt := 0; attempt <= t.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var retry bool
+		retry, err = s.post(t, body.Bytes())
+		if err == nil || !retry {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", t.Name, err)
+	}
+
+	return nil
+}
+
+// post sends a request, and returns whether it may be retried if it failed.
+func (s *Sink) post(t *Target, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, t.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("returned status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+		return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+	}
+
+	return false, nil
+}
+
+// Close does nothing, since requests are sent immediately.
+func (s *Sink) Close() error {
+	return nil
+}
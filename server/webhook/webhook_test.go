@@ -0,0 +1,196 @@
+package webhook_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/MacroPower/macropower-analytics-panel/server/webhook"
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	logger = log.NewNopLogger()
+)
+
+func TestParseConfig(t *testing.T) {
+	for _, test := range []struct {
+		config string
+		err    string
+	}{
+		{"targets: [{url: http://a, rules: [{event: start}]}]", ""},
+		{"targets: [{name: a, rules: [{event: start}]}]", `webhook target "a" has no url`},
+		{"targets: [{name: a, url: http://a}]", `webhook target "a" has no rules`},
+		{"targets: [{name: a, url: http://a, rules: [{event: view}]}]", `webhook target "a" has a rule with unknown event "view"`},
+		{"targets: [{name: a, url: http://a, rules: [{event: long_session}]}]", `webhook target "a" has a long_session rule without min_duration`},
+		{"targets: [{name: a, url: http://a, template: '{{ .Foo', rules: [{event: start}]}]", `webhook target "a" has an invalid template`},
+	} {
+		_, err := webhook.ParseConfig([]byte(test.config))
+		if test.err == "" && err != nil {
+			t.Errorf("Unexpected error for %s: %v", test.config, err)
+		}
+		if test.err != "" && (err == nil || !strings.HasPrefix(err.Error(), test.err)) {
+			t.Errorf("Expected error %q for %s, got %v", test.err, test.config, err)
+		}
+	}
+}
+
+func TestSink(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	failed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.URL.Path == "/retry" && !failed {
+			failed = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received[r.URL.Path] = append(received[r.URL.Path], string(body))
+	}))
+	defer server.Close()
+
+	config, err := webhook.ParseConfig([]byte(fmt.Sprintf(`
+targets:
+  - name: first
+    url: %[1]s/first
+    rules:
+      - event: first_view
+  - name: admin
+    url: %[1]s/admin
+    template: '{{ .Dashboard.Name }} {{ .Event }} {{ .Duration }}'
+    rules:
+      - event: end
+        users: [admin]
+        roles: [admin]
+  - name: viewer
+    url: %[1]s/viewer
+    rules:
+      - event: heartbeat
+        roles: [Viewer]
+  - name: long
+    url: %[1]s/long
+    template: '{{ .UUID }}'
+    rules:
+      - event: long_session
+        min_duration: 90s
+  - name: retry
+    url: %[1]s/retry
+    retries: 2
+    backoff: 1ms
+    template: '{{ .Type }}'
+    rules:
+      - event: start
+`, server.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &payloadtest.Recorder{}
+	handler := payload.NewHandler(cacher.NewCache(), 10, nil, []payload.Observer{r}, logger)
+	testserver := httptest.NewServer(handler)
+	defer testserver.Close()
+
+	request := payloadtest.GetPayload(t)
+	request.UUID = "a"
+	request.User.OrgRole = "Admin"
+	request.Type = "start"
+	request.Time = 1600000000
+	payloadtest.SendPayload(t, testserver.URL, request)
+	request.Type = "heartbeat"
+	for i := 1; i <= 2; i++ {
+		request.Time = 1600000000 + 60*i
+		payloadtest.SendPayload(t, testserver.URL, request)
+	}
+	request.Type = "end"
+	request.Time = 1600000150
+	payloadtest.SendPayload(t, testserver.URL, request)
+
+	request.UUID = "b"
+	request.Type = "start"
+	payloadtest.SendPayload(t, testserver.URL, request)
+	handler.Close()
+
+	history := webhook.NewHistory()
+	s := webhook.NewSink(config, time.Duration(0), history, server.Client())
+	for _, p := range r.Payloads() {
+		err := s.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string][]string{
+		"/first": {`{"event":"first_view","payload":{"uuid":"a"`},
+		"/admin": {"New Dashboard 1234 end 2m30s"},
+		"/long":  {"a"},
+		"/retry": {"start", "start"},
+	}
+	for path, bodies := range expected {
+		if len(received[path]) != len(bodies) {
+			t.Errorf("Expected %d requests to %s, got %v", len(bodies), path, received[path])
+			continue
+		}
+		for i, body := range bodies {
+			if !strings.HasPrefix(received[path][i], body) {
+				t.Errorf("Expected request to %s to start with %q, got %q", path, body, received[path][i])
+			}
+		}
+	}
+	if len(received["/viewer"]) != 0 {
+		t.Errorf("Expected no requests to /viewer, got %v", received["/viewer"])
+	}
+
+	// A Sink sharing the history does not send first views or long sessions
+	// again.
+	s = webhook.NewSink(config, time.Duration(0), history, server.Client())
+	for _, p := range r.Payloads() {
+		err := s.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"/first", "/long"} {
+		if len(received[path]) != 1 {
+			t.Errorf("Expected no further requests to %s, got %v", path, received[path])
+		}
+	}
+
+	// A heartbeat does not mark the dashboard as seen.
+	payloads := r.Payloads()
+	history = webhook.NewHistory()
+	s = webhook.NewSink(config, time.Duration(0), history, server.Client())
+	for _, p := range []payload.Payload{payloads[1], payloads[4]} {
+		err := s.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(received["/first"]) != 2 {
+		t.Errorf("Expected a first view after a heartbeat, got %v", received["/first"])
+	}
+
+	// Dashboards marked as seen, e.g. of restored sessions, have no first
+	// view.
+	history = webhook.NewHistory()
+	history.MarkSeen(payloads[0])
+	s = webhook.NewSink(config, time.Duration(0), history, server.Client())
+	err = s.Write(payloads[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received["/first"]) != 2 {
+		t.Errorf("Expected no first view of a seen dashboard, got %v", received["/first"])
+	}
+}